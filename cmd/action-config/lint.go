@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/dnd-it/action-config/v3/pkg/matrix"
+)
+
+// runLint implements "action-config lint [-root dir] [-dimension name]
+// [-profile name] [file]". It reports every value of the primary dimension without a
+// {base_dir}/{value} directory, exiting with status 1 if there are any.
+func runLint(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("lint", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	root := fs.String("root", ".", "repository root the directories are relative to")
+	dimension := fs.String("dimension", "", "primary dimension (default: settings.dimension)")
+	profile := fs.String("profile", "", "profile whose target selects the primary dimension")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: action-config lint [-root dir] [-dimension name] [-profile name] [file]")
+		fmt.Fprintln(stderr, "\nChecks that every value has a directory. file defaults to .github/matrix-config.yaml.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+	path := ".github/matrix-config.yaml"
+	if fs.NArg() == 1 {
+		path = fs.Arg(0)
+	}
+
+	ctx := context.Background()
+	conf, err := matrix.Load(ctx, path)
+	if err == nil {
+		var problems matrix.ConfigErrors
+		problems, err = matrix.Lint(ctx, conf, matrix.Options{Dimension: *dimension, Profile: *profile, Root: *root})
+		if err == nil && len(problems) > 0 {
+			err = problems
+		}
+	}
+	if err != nil {
+		var problems matrix.ConfigErrors
+		if errors.As(err, &problems) {
+			for _, p := range problems {
+				fmt.Fprintln(stderr, p)
+			}
+		} else {
+			fmt.Fprintf(stderr, "error: %v\n", err)
+		}
+		return 1
+	}
+	fmt.Fprintf(stdout, "%s: ok\n", path)
+	return 0
+}
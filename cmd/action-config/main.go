@@ -1,166 +1,310 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"slices"
 	"sort"
 	"strconv"
+	"strings"
 
-	"github.com/dnd-it/action-config/internal/expander"
-	gitdetect "github.com/dnd-it/action-config/internal/git"
-	"github.com/dnd-it/action-config/internal/inputs"
-	"github.com/dnd-it/action-config/internal/outputs"
+	"github.com/dnd-it/action-config/v3/internal/expander"
+	"github.com/dnd-it/action-config/v3/internal/formats"
+	gitdetect "github.com/dnd-it/action-config/v3/internal/git"
+	"github.com/dnd-it/action-config/v3/internal/inputs"
+	"github.com/dnd-it/action-config/v3/internal/outputs"
+	"github.com/dnd-it/action-config/v3/pkg/matrix"
 )
 
+// reservedOutputs are the fixed outputs of the action. Config fields with
+// these names are never emitted as flat outputs.
+var reservedOutputs = map[string]bool{
+	"matrix":           true,
+	"changes_detected": true,
+	"change_reasons":   true,
+	"config":           true,
+	"length":           true,
+	"base_dir":         true,
+	"dimension":        true,
+	"config_file":      true,
+	"output_file":      true,
+	"profile":          true,
+	"groups":           true,
+}
+
+// valuesOutputPrefix prefixes the per-dimension unique value outputs,
+// e.g. values_service.
+const valuesOutputPrefix = "values_"
+
 func main() {
-	if err := run(); err != nil {
-		outputs.LogError(err.Error())
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			os.Exit(runMigrate(os.Args[2:], os.Stdout, os.Stderr))
+		case "lint":
+			os.Exit(runLint(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
+	backend := flag.String("backend", "", "output backend: github, gitlab, buildkite, azure, or plain (default: detect from environment)")
+	flag.Parse()
+
+	if err := run(*backend); err != nil {
+		reportError(err)
 		os.Exit(1)
 	}
 }
 
-func run() error {
+// reportError logs err, annotating each configuration problem at its file
+// location so it is highlighted in the pull request diff. Field errors are
+// logged one per line.
+func reportError(err error) {
+	var fieldErrs matrix.FieldErrors
+	if errors.As(err, &fieldErrs) {
+		for _, fe := range fieldErrs {
+			outputs.LogError(fe.Error())
+		}
+		if len(fieldErrs) > 1 {
+			outputs.LogError(fmt.Sprintf("Found %d field errors", len(fieldErrs)))
+		}
+		return
+	}
+	var configErrs matrix.ConfigErrors
+	if !errors.As(err, &configErrs) {
+		outputs.LogError(err.Error())
+		return
+	}
+	for _, ce := range configErrs {
+		outputs.LogErrorAt(ce.File, ce.Line, ce.Column, ce.Message())
+	}
+	if len(configErrs) > 1 {
+		outputs.LogError(fmt.Sprintf("Found %d configuration errors", len(configErrs)))
+	}
+}
+
+func run(backendFlag string) error {
 	cfg := inputs.Parse()
 
-	opts, err := cfg.BuildExpanderOptions()
+	// Backend priority: --backend flag > backend input > environment detection.
+	backendName := cfg.Backend
+	if backendFlag != "" {
+		backendName = backendFlag
+	}
+	backend, err := outputs.New(backendName)
 	if err != nil {
-		return fmt.Errorf("invalid inputs: %w", err)
+		return err
 	}
+	outputs.Use(backend)
 
-	raw, err := expander.ParseConfigFile(cfg.ConfigPath)
+	ctx := context.Background()
+
+	conf, err := matrix.Load(ctx, cfg.ConfigPath)
 	if err != nil {
 		return err
 	}
-	outputs.SetOutput("config_file", cfg.ConfigPath)
-
-	optsCfg, dimensions := expander.ParseOptions(raw)
 
-	// Dimension priority: explicit input > config settings > default "service".
-	// action.yaml defaults dimension to "" so we can distinguish explicit input
-	// from unset. The "service" fallback preserves backward compat for v3;
-	// v4 will remove it to make dimension fully optional.
-	if cfg.Dimension == "" && optsCfg.Dimension == "" {
-		optsCfg.Dimension = "service"
+	// Mask sensitive values before anything that could contain them is
+	// printed or written.
+	for _, v := range conf.SensitiveValues() {
+		outputs.Mask(v)
 	}
 
-	// Set the filter key from the resolved dimension
-	opts.FilterKey = optsCfg.Dimension
+	for _, w := range conf.Warnings() {
+		outputs.LogWarningAt(conf.Path(), 0, 0, w)
+	}
 
-	// Resolve dimension selection (explicit input or target shorthand)
-	expander.ResolveTarget(dimensions, &optsCfg, &opts, cfg.Dimension)
+	if err := outputs.SetOutput("config_file", cfg.ConfigPath); err != nil {
+		return err
+	}
 
-	// If change detection is enabled, detect changes via git and filter
-	if cfg.ChangeDetection {
-		knownValues := expander.ExtractDimensionValues(dimensions, optsCfg.Dimension)
-		if knownValues == nil {
-			outputs.LogNotice(fmt.Sprintf("No %s dimension in config, skipping change detection", optsCfg.Dimension))
-		} else {
-			changedFiles, err := gitdetect.DetectChangedFiles()
-			if err != nil {
-				return fmt.Errorf("failed to detect changed files: %w", err)
-			}
+	opts, err := cfg.MatrixOptions()
+	if err != nil {
+		return fmt.Errorf("invalid inputs: %w", err)
+	}
+	flatMode, err := outputs.ParseFlatMode(cfg.FlatOutputs)
+	if err != nil {
+		return fmt.Errorf("invalid inputs: %w", err)
+	}
 
-			if changedFiles == nil {
-				outputs.LogNotice("Change detection not applicable for this event type, including all entries")
-			} else {
-				changedValues := expander.FilterChanged(changedFiles, optsCfg.BaseDir, knownValues)
-				outputs.LogNotice(fmt.Sprintf("Detected %d changed files, %d/%d %s(s) with changes: %v", len(changedFiles), len(changedValues), len(knownValues), optsCfg.Dimension, changedValues))
-
-				if len(changedValues) == 0 {
-					outputs.SetOutput("matrix", "[]")
-					outputs.SetOutput("config", "{}")
-					outputs.SetOutput("length", "0")
-					outputs.SetOutput("changes_detected", "false")
-					if cfg.Summary {
-						outputs.WriteSummary()
-					}
-					outputs.LogNotice("No entries with changes, matrix is empty")
-					return nil
-				}
+	if cfg.Lint {
+		problems, err := matrix.Lint(ctx, conf, opts)
+		if err != nil {
+			return err
+		}
+		if len(problems) > 0 {
+			return problems
+		}
+	}
 
-				// Merge with existing filter (intersect)
-				if len(opts.FilterValues) > 0 {
-					existing := make(map[string]bool, len(opts.FilterValues))
-					for _, s := range opts.FilterValues {
-						existing[s] = true
-					}
-					var merged []string
-					for _, s := range changedValues {
-						if existing[s] {
-							merged = append(merged, s)
-						}
-					}
-					opts.FilterValues = merged
-				} else {
-					opts.FilterValues = changedValues
-				}
-			}
+	// Changed files come from the changed_files input or, if change detection
+	// is enabled, from git; matrix.Expand keeps only the values with changes.
+	// Git only runs when the config has values of the primary dimension.
+	changedFiles, err := cfg.ChangedFileList()
+	if err != nil {
+		return fmt.Errorf("invalid inputs: %w", err)
+	}
+	changeDetection := cfg.ChangeDetection || changedFiles != nil
+	var detectErr error
+	if changedFiles != nil {
+		outputs.LogNotice(fmt.Sprintf("Using %d changed files from the changed_files input", len(changedFiles)))
+		opts.ChangedFiles = changedFiles
+	} else if cfg.ChangeDetection {
+		opts.DetectChanges = func() ([]string, error) {
+			files, err := detectChangedFiles(cfg)
+			detectErr = err
+			return files, err
 		}
 	}
 
-	entries, err := expander.Expand(dimensions, optsCfg, opts)
+	res, err := matrix.Expand(ctx, conf, opts)
 	if err != nil {
+		if detectErr != nil {
+			return detectErr
+		}
+		if errors.Is(err, matrix.ErrUnknownProfile) || errors.Is(err, matrix.ErrInvalidTarget) ||
+			errors.Is(err, matrix.ErrInvalidCollapse) {
+			return fmt.Errorf("invalid inputs: %w", err)
+		}
 		return fmt.Errorf("failed to expand configuration: %w", err)
 	}
+	entries := res.Entries
+
+	// Fragments and input includes may add sensitive values not present in
+	// the config; mask them before the warnings and violations are logged.
+	for _, v := range slices.Concat(res.SensitiveValues, expander.SensitiveValues(entries, res.Sensitive)) {
+		outputs.Mask(v)
+	}
+
+	for _, w := range res.Warnings {
+		outputs.LogWarning(w)
+	}
+
+	if err := reportViolations(conf.Path(), res.Violations); err != nil {
+		// The summary lists the violations, so write it even though the
+		// step fails.
+		if cfg.Summary {
+			outputs.WriteSummary()
+		}
+		return err
+	}
+
+	reportDisabled(res.Disabled)
+
+	if cfg.Profile != "" {
+		outputs.LogNotice(fmt.Sprintf("Using profile %s", cfg.Profile))
+		if err := outputs.SetOutput("profile", cfg.Profile); err != nil {
+			return err
+		}
+	}
 
-	matrixJSON, err := json.Marshal(entries)
+	if changeDetection && res.Values == nil {
+		outputs.LogNotice(fmt.Sprintf("No %s dimension in config, skipping change detection", res.Dimension))
+	}
+	if res.ChangeFiltered {
+		outputs.LogNotice(fmt.Sprintf("Detected %d changed files, %d/%d %s(s) with changes: %v", len(res.ChangedFiles), len(res.ChangedValues), len(res.Values), res.Dimension, res.ChangedValues))
+		if len(res.IgnoredFiles) > 0 {
+			outputs.LogNotice(fmt.Sprintf("Ignored %d changed files matching ignore_paths: %v", len(res.IgnoredFiles), res.IgnoredFiles))
+			var sb strings.Builder
+			for _, f := range res.IgnoredFiles {
+				fmt.Fprintf(&sb, "- `%s`\n", f)
+			}
+			outputs.AddSummarySection("Ignored changed files", sb.String())
+		}
+		if err := setChangeReasons(res); err != nil {
+			return err
+		}
+		if len(res.ChangedValues) == 0 {
+			return writeNoChanges(cfg, res.Keys)
+		}
+	}
+
+	dimKeys := res.Keys
+
+	matrixJSON, err := formats.Marshal(formats.JSON, entries, dimKeys)
 	if err != nil {
 		return fmt.Errorf("failed to marshal matrix: %w", err)
 	}
 
-	outputs.SetOutput("matrix", string(matrixJSON))
-	outputs.SetOutput("length", strconv.Itoa(len(entries)))
+	if err := outputs.SetOutput("matrix", string(matrixJSON)); err != nil {
+		return err
+	}
+	if err := outputs.SetOutput("length", strconv.Itoa(len(entries))); err != nil {
+		return err
+	}
+
+	if err := outputs.WriteMatrix(entries, dimKeys); err != nil {
+		return fmt.Errorf("failed to write %s matrix: %w", backend.Name(), err)
+	}
+
+	if err := writeOutputFile(cfg, entries, dimKeys); err != nil {
+		return err
+	}
+
+	if cfg.ExportEnv {
+		if len(entries) != 1 {
+			return fmt.Errorf("export_env requires exactly one matrix entry, got %d (narrow the matrix with target/environment)", len(entries))
+		}
+		for _, k := range sortedKeys(entries[0]) {
+			if err := outputs.SetEnv(formats.EnvName(k), expander.FormatValue(entries[0][k])); err != nil {
+				return fmt.Errorf("failed to export environment: %w", err)
+			}
+		}
+	}
 
 	// Emit reserved global settings as outputs.
-	if optsCfg.BaseDir != "" {
-		outputs.SetOutput("base_dir", optsCfg.BaseDir)
+	if res.BaseDir != "" {
+		if err := outputs.SetOutput("base_dir", res.BaseDir); err != nil {
+			return err
+		}
+	}
+	if err := outputs.SetOutput("dimension", res.Dimension); err != nil {
+		return err
+	}
+
+	generated, err := setDimensionOutputs(entries, dimKeys, cfg.GroupBy)
+	if err != nil {
+		return err
 	}
-	outputs.SetOutput("dimension", optsCfg.Dimension)
 
 	// Emit a nested "config" JSON blob indexed by dimension values,
 	// so users can access fields via fromJson: e.g. fromJson(steps.id.outputs.config).api.dev.directory
 	if len(entries) > 0 {
-		dimKeys := make([]string, 0, len(dimensions))
-		for k := range dimensions {
-			dimKeys = append(dimKeys, k)
-		}
-		sort.Strings(dimKeys)
-
 		configBlob := buildConfigBlob(entries, dimKeys)
 		configJSON, err := json.Marshal(configBlob)
 		if err == nil {
-			outputs.SetOutput("config", string(configJSON))
+			if err := outputs.SetOutput("config", string(configJSON)); err != nil {
+				return err
+			}
 		}
 
-		// Emit flat outputs for fields that have the same value across all entries.
-		// This covers single-entry matrices (all fields emitted) and multi-entry
+		// Emit flat outputs per the flat_outputs mode. By default (uniform) this
+		// covers single-entry matrices (all fields emitted) and multi-entry
 		// matrices (only shared fields like directory, ecr_repository are emitted;
 		// fields that differ per entry like environment, aws_account_id are skipped).
-		reserved := map[string]bool{"matrix": true, "changes_detected": true, "config": true, "length": true, "base_dir": true, "dimension": true, "config_file": true}
-		for k, v := range entries[0] {
-			if reserved[k] {
-				continue
-			}
-			val := fmt.Sprintf("%v", v)
-			uniform := true
-			for _, entry := range entries[1:] {
-				if fmt.Sprintf("%v", entry[k]) != val {
-					uniform = false
-					break
-				}
-			}
-			if uniform {
-				outputs.SetOutput(k, val)
+		skip := make(map[string]bool)
+		if conf.OmitSensitive() {
+			for _, f := range res.Sensitive {
+				skip[f] = true
 			}
 		}
+		if err := setFlatOutputs(entries, flatMode, cfg.FlatOutputsPrefix, skip, generated); err != nil {
+			return err
+		}
 	}
 
-	if cfg.ChangeDetection {
+	if changeDetection {
 		if len(entries) > 0 {
-			outputs.SetOutput("changes_detected", "true")
+			if err := outputs.SetOutput("changes_detected", "true"); err != nil {
+				return err
+			}
 		} else {
-			outputs.SetOutput("changes_detected", "false")
+			if err := outputs.SetOutput("changes_detected", "false"); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -169,16 +313,19 @@ func run() error {
 	}
 
 	// Log filters
-	if len(opts.FilterValues) > 0 {
-		outputs.LogNotice(fmt.Sprintf("Filtered by %s: %v", opts.FilterKey, opts.FilterValues))
+	if len(res.Target) > 0 {
+		outputs.LogNotice(fmt.Sprintf("Filtered by %s: %v", res.Dimension, res.Target))
+	}
+	if len(res.Environment) > 0 {
+		outputs.LogNotice(fmt.Sprintf("Filtered by environment: %v", res.Environment))
 	}
-	if len(opts.EnvironmentFilter) > 0 {
-		outputs.LogNotice(fmt.Sprintf("Filtered by environment: %v", opts.EnvironmentFilter))
+	if len(res.Collapsed) > 0 {
+		outputs.LogNotice(fmt.Sprintf("Collapsed dimensions: %v", res.Collapsed))
 	}
-	if len(opts.InputExclude) > 0 {
+	if len(opts.Exclude) > 0 {
 		outputs.LogNotice("Applied input exclude filter")
 	}
-	if len(opts.InputInclude) > 0 {
+	if len(opts.Include) > 0 {
 		outputs.LogNotice("Applied input include filter")
 	}
 
@@ -192,6 +339,229 @@ func run() error {
 	return nil
 }
 
+// writeNoChanges emits the outputs for a matrix left empty because no value
+// of the primary dimension has changes, and writes the summary.
+func writeNoChanges(cfg *inputs.Config, dimKeys []string) error {
+	if err := outputs.SetOutput("matrix", "[]"); err != nil {
+		return err
+	}
+	if err := outputs.SetOutput("config", "{}"); err != nil {
+		return err
+	}
+	if err := outputs.SetOutput("length", "0"); err != nil {
+		return err
+	}
+	if err := outputs.SetOutput("changes_detected", "false"); err != nil {
+		return err
+	}
+	if _, err := setDimensionOutputs(nil, dimKeys, cfg.GroupBy); err != nil {
+		return err
+	}
+	if err := outputs.WriteMatrix([]expander.MatrixEntry{}, nil); err != nil {
+		return fmt.Errorf("failed to write %s matrix: %w", outputs.Current().Name(), err)
+	}
+	if err := writeOutputFile(cfg, []expander.MatrixEntry{}, nil); err != nil {
+		return err
+	}
+	if cfg.Summary {
+		outputs.WriteSummary()
+	}
+	outputs.LogNotice("No entries with changes, matrix is empty")
+	return nil
+}
+
+// Modes accepted by the on_detection_failure input.
+const (
+	onFailureAll  = "all"
+	onFailureNone = "none"
+	onFailureFail = "fail"
+)
+
+// detectChangedFiles runs git change detection. It returns nil when every
+// entry should be included, and handles failures per on_detection_failure.
+func detectChangedFiles(cfg *inputs.Config) ([]string, error) {
+	maxDepth, err := strconv.Atoi(strings.TrimSpace(cfg.MaxFetchDepth))
+	if err != nil || maxDepth < 0 {
+		return nil, fmt.Errorf("invalid inputs: max_fetch_depth must be a non-negative integer, got %q", cfg.MaxFetchDepth)
+	}
+	mode := strings.TrimSpace(cfg.OnDetectionFailure)
+	switch mode {
+	case onFailureAll, onFailureNone, onFailureFail:
+	default:
+		return nil, fmt.Errorf("invalid inputs: on_detection_failure must be all, none or fail, got %q", cfg.OnDetectionFailure)
+	}
+
+	changedFiles, err := gitdetect.DetectChangedFiles(gitdetect.Options{MaxFetchDepth: maxDepth, Log: outputs.LogNotice})
+	switch {
+	case err == nil && changedFiles == nil:
+		outputs.LogNotice("Change detection not applicable for this event type, including all entries")
+		return nil, nil
+	case err == nil && len(changedFiles) == 0:
+		// A diff without changes, e.g. of an empty commit, includes every
+		// entry, as in earlier versions.
+		outputs.LogNotice("No changed files detected, including all entries")
+		return nil, nil
+	case err == nil:
+		return changedFiles, nil
+	case mode == onFailureAll:
+		outputs.LogWarning(fmt.Sprintf("Change detection failed, including all entries: %v", err))
+		return nil, nil
+	case mode == onFailureNone:
+		outputs.LogWarning(fmt.Sprintf("Change detection failed, matrix is empty: %v", err))
+		return []string{}, nil
+	default:
+		return nil, fmt.Errorf("failed to detect changed files: %w", err)
+	}
+}
+
+// setChangeReasons logs why each changed value was selected, adds them to
+// the summary and emits them as the change_reasons output, a JSON object
+// keyed by value.
+func setChangeReasons(res *matrix.Result) error {
+	var sb strings.Builder
+	sb.WriteString("| Value | Changed file | Via |\n")
+	sb.WriteString("|-------|--------------|-----|\n")
+	for _, v := range res.ChangedValues {
+		r := res.ChangeReasons[v]
+		outputs.LogInfo(fmt.Sprintf("%s %s changed: %s", res.Dimension, v, r))
+		fmt.Fprintf(&sb, "| `%s` | `%s` | %s |\n", v, r.File, strings.Join(r.Via, " → "))
+	}
+	if len(res.ChangedValues) > 0 {
+		outputs.AddSummarySection("Changed "+res.Dimension+" values", sb.String())
+	}
+
+	data, err := json.Marshal(res.ChangeReasons)
+	if err != nil {
+		return fmt.Errorf("failed to marshal change reasons: %w", err)
+	}
+	return outputs.SetOutput("change_reasons", string(data))
+}
+
+// reportDisabled logs the values turned off with enabled: false and lists
+// them in the summary.
+func reportDisabled(disabled []matrix.DisabledValue) {
+	if len(disabled) == 0 {
+		return
+	}
+	var sb strings.Builder
+	sb.WriteString("| Dimension | Value | Reason |\n")
+	sb.WriteString("|-----------|-------|--------|\n")
+	for _, d := range disabled {
+		msg := fmt.Sprintf("%s %s is disabled", d.Dimension, d.Value)
+		if d.Reason != "" {
+			msg += ": " + d.Reason
+		}
+		outputs.LogNotice(msg)
+		fmt.Fprintf(&sb, "| %s | `%s` | %s |\n", d.Dimension, d.Value, strings.ReplaceAll(d.Reason, "|", `\|`))
+	}
+	outputs.AddSummarySection("Disabled values", sb.String())
+}
+
+// reportViolations logs every rule violation at the config file and lists
+// them in the summary. It returns an error if any has severity error.
+func reportViolations(configPath string, violations []matrix.Violation) error {
+	if len(violations) == 0 {
+		return nil
+	}
+	var sb strings.Builder
+	sb.WriteString("| Severity | Rule | Entry | Message |\n")
+	sb.WriteString("|----------|------|-------|---------|\n")
+	errCount := 0
+	for _, v := range violations {
+		if v.Severity == matrix.SeverityError {
+			errCount++
+			outputs.LogErrorAt(configPath, 0, 0, v.String())
+		} else {
+			outputs.LogWarningAt(configPath, 0, 0, v.String())
+		}
+		// Pipes, e.g. from || in an assertion, would end the table cell.
+		fmt.Fprintf(&sb, "| %s | `%s` | %s | %s |\n", v.Severity, v.Rule, v.Entry, strings.ReplaceAll(v.Message, "|", `\|`))
+	}
+	outputs.AddSummarySection("Rule violations", sb.String())
+	if errCount > 0 {
+		return fmt.Errorf("%d rule violation(s) with severity error", errCount)
+	}
+	return nil
+}
+
+// setFlatOutputs emits the flat outputs selected by mode (see
+// outputs.FlatValues), named prefix+field. Fields in skip are silently left
+// out; fields whose output name collides with a reserved or generated output
+// are left out with a warning.
+func setFlatOutputs(entries []expander.MatrixEntry, mode outputs.FlatMode, prefix string, skip, generated map[string]bool) error {
+	values, err := outputs.FlatValues(entries, mode, skip)
+	if err != nil {
+		return err
+	}
+	for _, field := range sortedKeys(values) {
+		name := prefix + field
+		if reservedOutputs[name] || generated[name] {
+			outputs.LogWarning(fmt.Sprintf("Field %q is not emitted as a flat output because %q is a reserved output; use flat_outputs_prefix to expose it", field, name))
+			continue
+		}
+		if err := outputs.SetOutput(name, values[field]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setDimensionOutputs emits a values_<dimension> output with the JSON array of
+// unique values for each dimension, and a "groups" output mapping each value
+// of the group_by field to its entries. It returns the names it emitted.
+func setDimensionOutputs(entries []expander.MatrixEntry, dimKeys []string, groupBy string) (map[string]bool, error) {
+	emitted := make(map[string]bool, len(dimKeys))
+	for _, dk := range dimKeys {
+		values := expander.UniqueValues(entries, dk)
+		if values == nil {
+			values = []string{}
+		}
+		valuesJSON, err := json.Marshal(values)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal %s values: %w", dk, err)
+		}
+		name := valuesOutputPrefix + dk
+		if err := outputs.SetOutput(name, string(valuesJSON)); err != nil {
+			return nil, err
+		}
+		emitted[name] = true
+	}
+
+	if groupBy != "" {
+		groupsJSON, err := json.Marshal(expander.GroupBy(entries, groupBy))
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal groups: %w", err)
+		}
+		if err := outputs.SetOutput("groups", string(groupsJSON)); err != nil {
+			return nil, err
+		}
+	}
+	return emitted, nil
+}
+
+// writeOutputFile writes the matrix to the output_file input, if set, in the
+// requested output_format (inferred from the file extension when empty). A
+// relative path is relative to the workspace.
+func writeOutputFile(cfg *inputs.Config, entries []expander.MatrixEntry, dimKeys []string) error {
+	path := cfg.OutputPath()
+	if path == "" {
+		return nil
+	}
+	format := cfg.OutputFormat
+	if format == "" {
+		format = formats.FromPath(path)
+	}
+	written, err := formats.Write(path, format, entries, dimKeys)
+	if err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	if err := outputs.SetOutput("output_file", path); err != nil {
+		return err
+	}
+	outputs.LogNotice(fmt.Sprintf("Wrote %d entries as %s to %d file(s) under %s", len(entries), format, len(written), path))
+	return nil
+}
+
 // buildConfigBlob builds a nested map indexed by dimension values.
 // For dimensions [environment, service] and an entry {environment:dev, service:api, directory:deploy/api},
 // the result is {"dev": {"api": {"directory": "deploy/api", ...}}}.
@@ -212,7 +582,7 @@ func buildConfigBlob(entries []expander.MatrixEntry, dimKeys []string) map[strin
 
 		current := root
 		for i, dk := range dimKeys {
-			val := fmt.Sprintf("%v", entry[dk])
+			val := expander.FormatValue(entry[dk])
 			if i == len(dimKeys)-1 {
 				// Leaf: store the full entry
 				current[val] = map[string]any(entry)
@@ -228,3 +598,13 @@ func buildConfigBlob(entries []expander.MatrixEntry, dimKeys []string) map[strin
 	}
 	return root
 }
+
+// sortedKeys returns the keys of a map sorted alphabetically.
+func sortedKeys[M ~map[string]V, V any](m M) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/dnd-it/action-config/v3/pkg/matrix"
+)
+
+// runMigrate implements "action-config migrate [-w] [-check] [file]". It
+// prints the config rewritten to the current format, or writes it back with
+// -w. With -check it only reports whether a migration is needed, exiting
+// with status 1 if so.
+func runMigrate(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	write := fs.Bool("w", false, "write the result to the file instead of stdout")
+	check := fs.Bool("check", false, "only report whether the file needs migrating; exit 1 if it does")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: action-config migrate [-w] [-check] [file]")
+		fmt.Fprintln(stderr, "\nRewrites a config file to the current format. file defaults to .github/matrix-config.yaml.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+	path := ".github/matrix-config.yaml"
+	if fs.NArg() == 1 {
+		path = fs.Arg(0)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+	out, changes, err := matrix.Migrate(data, filepath.Ext(path))
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %s: %v\n", path, err)
+		return 1
+	}
+	for _, c := range changes {
+		fmt.Fprintf(stderr, "%s: %s\n", path, c)
+	}
+
+	switch {
+	case *check:
+		if len(changes) > 0 {
+			return 1
+		}
+		fmt.Fprintf(stderr, "%s: up to date\n", path)
+	case *write:
+		if len(changes) == 0 {
+			fmt.Fprintf(stderr, "%s: up to date\n", path)
+			return 0
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			fmt.Fprintf(stderr, "error: %v\n", err)
+			return 1
+		}
+		if err := os.WriteFile(path, out, info.Mode().Perm()); err != nil {
+			fmt.Fprintf(stderr, "error: %v\n", err)
+			return 1
+		}
+	default:
+		_, _ = stdout.Write(out)
+	}
+	return 0
+}
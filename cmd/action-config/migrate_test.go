@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const legacyConfig = "global:\n  dimension_key: app\n  region: eu-west-1\napp: [a]\n"
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "matrix-config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRunMigrate_Print(t *testing.T) {
+	path := writeConfig(t, legacyConfig)
+	var stdout, stderr bytes.Buffer
+	if code := runMigrate([]string{path}, &stdout, &stderr); code != 0 {
+		t.Fatalf("expected exit 0, got %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "dimension: app") {
+		t.Errorf("expected the migrated config, got:\n%s", stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "moved global.dimension_key to settings.dimension") {
+		t.Errorf("expected the changes on stderr, got %q", stderr.String())
+	}
+	if data, _ := os.ReadFile(path); string(data) != legacyConfig {
+		t.Errorf("expected the file to be unchanged, got:\n%s", data)
+	}
+}
+
+func TestRunMigrate_WriteAndCheck(t *testing.T) {
+	path := writeConfig(t, legacyConfig)
+	var stdout, stderr bytes.Buffer
+	if code := runMigrate([]string{"-check", path}, &stdout, &stderr); code != 1 {
+		t.Errorf("expected -check to exit 1 for an outdated config, got %d", code)
+	}
+
+	if code := runMigrate([]string{"-w", path}, &stdout, &stderr); code != 0 {
+		t.Fatalf("expected exit 0, got %d: %s", code, stderr.String())
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("expected nothing on stdout with -w, got %q", stdout.String())
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("expected the file mode to be kept, got %v", info.Mode().Perm())
+	}
+
+	stderr.Reset()
+	if code := runMigrate([]string{"-check", path}, &stdout, &stderr); code != 0 {
+		t.Errorf("expected -check to exit 0 after -w, got %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "up to date") {
+		t.Errorf("expected up to date, got %q", stderr.String())
+	}
+}
+
+func TestRunMigrate_Errors(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := runMigrate([]string{filepath.Join(t.TempDir(), "missing.yaml")}, &stdout, &stderr); code != 1 {
+		t.Errorf("expected exit 1 for a missing file, got %d", code)
+	}
+	if code := runMigrate([]string{writeConfig(t, "- a\n")}, &stdout, &stderr); code != 1 {
+		t.Errorf("expected exit 1 for an invalid config, got %d", code)
+	}
+	if code := runMigrate([]string{"a.yaml", "b.yaml"}, &stdout, &stderr); code != 2 {
+		t.Errorf("expected exit 2 for extra arguments, got %d", code)
+	}
+}
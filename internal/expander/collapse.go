@@ -0,0 +1,147 @@
+package expander
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Collapse policies for a field that differs between the entries merged by
+// collapsing dimensions: leave the field out, fail, keep the first entry's
+// value, or collect the distinct values into a list. Dropping is the
+// default, as such a field, e.g. a per-environment account, has no single
+// value for a job that runs once for all environments.
+const (
+	CollapseDrop  = "drop"
+	CollapseError = "error"
+	CollapseFirst = "first"
+	CollapseList  = "list"
+)
+
+// ErrInvalidCollapse is returned when a dimension to collapse does not
+// exist or is the primary dimension, when the policy is unknown, and when
+// merged entries conflict under the error policy.
+var ErrInvalidCollapse = errors.New("invalid collapse")
+
+// ValidateCollapse checks the dimensions to collapse and the policy against
+// the dimensions in raw and the primary dimension.
+func ValidateCollapse(raw RawConfig, primary string, collapse []string, policy string) error {
+	switch policy {
+	case "", CollapseDrop, CollapseError, CollapseFirst, CollapseList:
+	default:
+		return fmt.Errorf("%w: unknown policy %q (expected drop, error, first or list)", ErrInvalidCollapse, policy)
+	}
+	for _, dim := range collapse {
+		if dim == primary {
+			return fmt.Errorf("%w: %s is the primary dimension", ErrInvalidCollapse, dim)
+		}
+		if !isDimension(raw[dim]) {
+			return fmt.Errorf("%w: unknown dimension %q%s", ErrInvalidCollapse, dim, didYouMean(dim, DimensionKeys(raw)))
+		}
+	}
+	return nil
+}
+
+// collapseEntries removes the collapsed dimensions from the entries and
+// merges entries left with the same values of the other dimensions, in
+// order of first appearance. Fields that differ between merged entries,
+// including fields set in only some of them, are resolved by policy.
+func collapseEntries(entries []MatrixEntry, collapse []string, policy string, dimKeys []string) ([]MatrixEntry, error) {
+	var remaining []string
+	for _, k := range dimKeys {
+		if !slices.Contains(collapse, k) {
+			remaining = append(remaining, k)
+		}
+	}
+
+	var result []MatrixEntry
+	index := make(map[string]int)
+	// lists marks the fields of each merged entry that hold collected
+	// values rather than a value that was a list already, and dropped those
+	// left out by the drop policy.
+	var lists, dropped []map[string]bool
+	for _, entry := range entries {
+		id := entryKeys(entry, remaining)
+		i, seen := index[id]
+		if !seen {
+			i = len(result)
+			index[id] = i
+			result = append(result, make(MatrixEntry, len(entry)))
+			lists = append(lists, make(map[string]bool))
+			dropped = append(dropped, make(map[string]bool))
+		}
+		merged := result[i]
+		// A field set in only some of the merged entries differs too, so
+		// both the entry's and the merged fields are visited.
+		keys := make(map[string]bool, len(entry)+len(merged))
+		for k := range entry {
+			keys[k] = true
+		}
+		for k := range merged {
+			keys[k] = true
+		}
+		for _, k := range sortedKeys(keys) {
+			if slices.Contains(collapse, k) {
+				continue
+			}
+			v, set := entry[k]
+			prev, prevSet := merged[k]
+			switch {
+			case !seen:
+				merged[k] = v
+			case dropped[i][k]:
+			case lists[i][k]:
+				collected := prev.([]any)
+				if set && !slices.ContainsFunc(collected, func(c any) bool { return reflect.DeepEqual(c, v) }) {
+					merged[k] = append(collected, v)
+				}
+			case set && prevSet && reflect.DeepEqual(prev, v), policy == CollapseFirst:
+			case policy == CollapseList:
+				var collected []any
+				if prevSet {
+					collected = append(collected, prev)
+				}
+				if set {
+					collected = append(collected, v)
+				}
+				merged[k] = collected
+				lists[i][k] = true
+			case policy == CollapseError:
+				return nil, fmt.Errorf("%w: field %s of %s differs between %s values (%s and %s); set the collapse policy to drop, first or list",
+					ErrInvalidCollapse, k, id, strings.Join(collapse, ", "), collapsedValue(prev, prevSet), collapsedValue(v, set))
+			default:
+				delete(merged, k)
+				dropped[i][k] = true
+			}
+		}
+	}
+	return result, nil
+}
+
+// collapsedValue formats a field value for a collapse conflict.
+func collapsedValue(v any, set bool) string {
+	if !set {
+		return "unset"
+	}
+	return FormatValue(v)
+}
+
+// collapsedSources maps the fields set in the per-value configs of the
+// collapsed dimensions to "dimension.*", for Provenance.
+func collapsedSources(raw RawConfig, collapse []string) map[string]string {
+	sources := make(map[string]string)
+	for _, dim := range collapse {
+		dimMap, _ := raw[dim].(map[string]any)
+		for _, value := range sortedKeys(dimMap) {
+			cfg, _ := dimMap[value].(map[string]any)
+			for k := range cfg {
+				if _, ok := sources[k]; !ok && !isValueKey(cfg, k, dim, "") {
+					sources[k] = dim + ".*"
+				}
+			}
+		}
+	}
+	return sources
+}
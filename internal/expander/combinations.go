@@ -0,0 +1,269 @@
+package expander
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Keys of a per-value config that restrict the combinations a value is part
+// of, e.g.
+//
+//	service:
+//	  batch:
+//	    only: { environment: [prod, staging] }
+//	  legacy:
+//	    enabled: false
+//	    disabled_reason: replaced by api
+const (
+	onlyKey           = "only"
+	exceptKey         = "except"
+	enabledKey        = "enabled"
+	disabledReasonKey = "disabled_reason"
+)
+
+// filterKeys are the keys above. They were plain fields before, so they
+// only configure the action with a filter value (see isFilter); other values
+// stay matrix fields.
+var filterKeys = map[string]bool{
+	onlyKey:           true,
+	exceptKey:         true,
+	enabledKey:        true,
+	disabledReasonKey: true,
+}
+
+// isFilter reports whether key, one of filterKeys, has a filter value in the
+// per-value config cfg: only and except map names to a value or a list of
+// values, enabled is false and disabled_reason is a string next to
+// enabled: false. enabled: true is a no-op and stays a field, as before.
+func isFilter(cfg map[string]any, key string) bool {
+	switch key {
+	case onlyKey, exceptKey:
+		m, ok := cfg[key].(map[string]any)
+		if !ok || len(m) == 0 {
+			return false
+		}
+		for _, vals := range m {
+			if !isScalarList(vals) {
+				return false
+			}
+		}
+		return true
+	case enabledKey:
+		return cfg[key] == false
+	case disabledReasonKey:
+		_, ok := cfg[key].(string)
+		return ok && cfg[enabledKey] == false
+	}
+	return false
+}
+
+// isScalarList reports whether v is a scalar or a list of scalars.
+func isScalarList(v any) bool {
+	items, ok := toSlice(v)
+	if !ok {
+		items = []any{v}
+	}
+	for _, item := range items {
+		switch item.(type) {
+		case map[string]any, []any, nil:
+			return false
+		}
+	}
+	return true
+}
+
+// filterKeyWarnings warns about filter keys in the per-value configs of
+// dims that do not have a filter value and so stay matrix fields.
+func filterKeyWarnings(dims RawConfig) []string {
+	var warnings []string
+	for _, dim := range sortedKeys(dims) {
+		dimMap, ok := dims[dim].(map[string]any)
+		if !ok {
+			continue
+		}
+		for _, value := range sortedKeys(dimMap) {
+			cfg, ok := dimMap[value].(map[string]any)
+			if !ok {
+				continue
+			}
+			for _, key := range []string{onlyKey, exceptKey, enabledKey, disabledReasonKey} {
+				val, ok := cfg[key]
+				if !ok || isFilter(cfg, key) || key == enabledKey && val == true {
+					continue
+				}
+				var want string
+				switch key {
+				case onlyKey, exceptKey:
+					want = "a map of dimension names to values"
+				case enabledKey:
+					want = "true or false"
+				case disabledReasonKey:
+					want = "a string next to enabled: false"
+				}
+				warnings = append(warnings, fmt.Sprintf("%s.%s.%s is not %s and stays a matrix field; rename the field if it is not meant as a filter", dim, value, key, want))
+			}
+		}
+	}
+	return warnings
+}
+
+// DisabledValue is a dimension value turned off with enabled: false.
+type DisabledValue struct {
+	Dimension string `json:"dimension"`
+	Value     string `json:"value"`
+	// Reason is the value's disabled_reason, if any.
+	Reason string `json:"reason,omitempty"`
+}
+
+// valueRestriction limits the combinations of one dimension value to those
+// where other dimensions have (only) or do not have (except) given values.
+type valueRestriction struct {
+	dim, value   string
+	only, except map[string][]string
+}
+
+// combinationRules are the enabled and only/except settings of every value.
+type combinationRules struct {
+	disabled     map[string]map[string]bool
+	restrictions []valueRestriction
+}
+
+// parseCombinationRules collects the enabled, only and except keys of the
+// per-value configs in raw.
+func parseCombinationRules(raw RawConfig) combinationRules {
+	rules := combinationRules{disabled: make(map[string]map[string]bool)}
+	for _, dim := range sortedKeys(raw) {
+		dimMap, ok := raw[dim].(map[string]any)
+		if !ok {
+			continue
+		}
+		for _, value := range sortedKeys(dimMap) {
+			cfg, ok := dimMap[value].(map[string]any)
+			if !ok {
+				continue
+			}
+			if isFilter(cfg, enabledKey) {
+				if rules.disabled[dim] == nil {
+					rules.disabled[dim] = make(map[string]bool)
+				}
+				rules.disabled[dim][value] = true
+			}
+			var only, except map[string][]string
+			if isFilter(cfg, onlyKey) {
+				only = valueLists(cfg[onlyKey])
+			}
+			if isFilter(cfg, exceptKey) {
+				except = valueLists(cfg[exceptKey])
+			}
+			if only != nil || except != nil {
+				rules.restrictions = append(rules.restrictions, valueRestriction{dim: dim, value: value, only: only, except: except})
+			}
+		}
+	}
+	return rules
+}
+
+// valueLists converts an only or except block: dimension to a list of
+// values or a comma-separated string.
+func valueLists(v any) map[string][]string {
+	m, ok := v.(map[string]any)
+	if !ok || len(m) == 0 {
+		return nil
+	}
+	lists := make(map[string][]string, len(m))
+	for dim, vals := range m {
+		lists[dim] = toStringList(vals)
+	}
+	return lists
+}
+
+// allows reports whether a possibly partial combination is allowed.
+// Restrictions involving dimensions the combination does not have yet are
+// not checked.
+func (r combinationRules) allows(combo MatrixEntry) bool {
+	for dim, values := range r.disabled {
+		if v, ok := combo[dim]; ok && values[FormatValue(v)] {
+			return false
+		}
+	}
+	for _, vr := range r.restrictions {
+		if v, ok := combo[vr.dim]; !ok || FormatValue(v) != vr.value {
+			continue
+		}
+		for dim, values := range vr.only {
+			if v, ok := combo[dim]; ok && !slices.Contains(values, FormatValue(v)) {
+				return false
+			}
+		}
+		for dim, values := range vr.except {
+			if v, ok := combo[dim]; ok && slices.Contains(values, FormatValue(v)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// DisabledValues returns the values of the dimensions in raw that are
+// turned off with enabled: false, sorted by dimension and value.
+func DisabledValues(raw RawConfig) []DisabledValue {
+	var disabled []DisabledValue
+	for _, dim := range sortedKeys(raw) {
+		dimMap, ok := raw[dim].(map[string]any)
+		if !ok {
+			continue
+		}
+		for _, value := range sortedKeys(dimMap) {
+			cfg, ok := dimMap[value].(map[string]any)
+			if !ok {
+				continue
+			}
+			if isFilter(cfg, enabledKey) {
+				reason, _ := cfg[disabledReasonKey].(string)
+				disabled = append(disabled, DisabledValue{Dimension: dim, Value: value, Reason: reason})
+			}
+		}
+	}
+	return disabled
+}
+
+// combinations checks the only and except filters of a per-value config
+// for unknown dimensions. Values that are not filters are fields, which
+// filterKeyWarnings reports.
+func (v *validator) combinations(path string, cfg map[string]any, dims map[string]bool) {
+	for _, key := range []string{onlyKey, exceptKey} {
+		if !isFilter(cfg, key) {
+			continue
+		}
+		m := cfg[key].(map[string]any)
+		for _, dim := range sortedKeys(m) {
+			if !dims[dim] {
+				v.errorf(path+"."+key+"."+dim, "unknown dimension"+didYouMean(dim, sortedKeys(dims)))
+			}
+		}
+	}
+}
+
+// DisabledTargets checks the values of the primary dimension dim selected
+// by a target against the disabled values. Selecting only disabled values
+// is an error, since the matrix would be empty; selecting some of them
+// gives a warning for each.
+func DisabledTargets(dim string, targets []string, disabled []DisabledValue) ([]string, error) {
+	var warnings, names []string
+	for _, d := range disabled {
+		if d.Dimension != dim || !slices.Contains(targets, d.Value) {
+			continue
+		}
+		msg := d.Value
+		if d.Reason != "" {
+			msg += " (" + d.Reason + ")"
+		}
+		names = append(names, msg)
+		warnings = append(warnings, fmt.Sprintf("target selects %s %s, which is disabled", dim, msg))
+	}
+	if len(targets) > 0 && len(names) == len(targets) {
+		return nil, fmt.Errorf("%w: target selects only disabled %s values: %s", ErrInvalidTarget, dim, strings.Join(names, ", "))
+	}
+	return warnings, nil
+}
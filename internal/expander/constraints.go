@@ -0,0 +1,276 @@
+package expander
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// requiredFieldsKey lists fields every entry with a value must have in a
+// per-value config, e.g. environment.prod.required_fields.
+const requiredFieldsKey = "required_fields"
+
+// fieldTypeNames are the types a field can be declared as in
+// settings.field_types.
+var fieldTypeNames = map[string]bool{
+	"string": true,
+	"int":    true,
+	"number": true,
+	"bool":   true,
+	"list":   true,
+	"object": true,
+}
+
+// FieldType constrains the values of a field: a type, a regular expression
+// the value's string form must match, and a list of allowed values. Unset
+// parts are not checked.
+type FieldType struct {
+	Type    string
+	Pattern *regexp.Regexp
+	Enum    []any
+}
+
+// parseFieldTypes converts settings.field_types. A field maps to a type
+// name or to an object with type, pattern and enum. Malformed declarations
+// are reported by validateConfig and skipped here.
+func parseFieldTypes(val any) map[string]FieldType {
+	m, ok := val.(map[string]any)
+	if !ok {
+		return nil
+	}
+	types := make(map[string]FieldType, len(m))
+	for field, spec := range m {
+		var ft FieldType
+		switch spec := spec.(type) {
+		case string:
+			ft.Type = spec
+		case map[string]any:
+			ft.Type, _ = spec["type"].(string)
+			if p, ok := spec["pattern"].(string); ok {
+				re, err := regexp.Compile(p)
+				if err != nil {
+					continue
+				}
+				ft.Pattern = re
+			}
+			ft.Enum, _ = toSlice(spec["enum"])
+		default:
+			continue
+		}
+		types[field] = ft
+	}
+	return types
+}
+
+// fieldTypes checks settings.field_types.
+func (v *validator) fieldTypes(path string, val any) {
+	m, ok := v.object(path, val)
+	if !ok {
+		return
+	}
+	for _, field := range sortedKeys(m) {
+		fpath := path + "." + field
+		switch spec := m[field].(type) {
+		case string:
+			if !fieldTypeNames[spec] {
+				v.errorf(fpath, "unknown type "+strconv.Quote(spec)+" (expected string, int, number, bool, list or object)")
+			}
+		case map[string]any:
+			for _, key := range sortedKeys(spec) {
+				switch key {
+				case "type":
+					if s, ok := spec[key].(string); !ok || !fieldTypeNames[s] {
+						v.errorf(fpath+".type", "must be string, int, number, bool, list or object")
+					}
+				case "pattern":
+					s, ok := spec[key].(string)
+					if !ok {
+						v.errorf(fpath+".pattern", "must be a string")
+					} else if _, err := regexp.Compile(s); err != nil {
+						v.errorf(fpath+".pattern", "invalid regular expression: "+err.Error())
+					}
+				case "enum":
+					if _, ok := toSlice(spec[key]); !ok {
+						v.errorf(fpath+".enum", "must be a list")
+					}
+				default:
+					v.errorf(fpath+"."+key, "unknown key (expected type, pattern or enum)")
+				}
+			}
+		default:
+			v.errorf(fpath, "must be a type name or an object with type, pattern or enum")
+		}
+	}
+}
+
+// check returns why v does not satisfy the constraint, or "".
+func (ft FieldType) check(v any) string {
+	if ft.Type != "" && !hasType(v, ft.Type) {
+		return fmt.Sprintf("must be of type %s, got %s", ft.Type, typeName(v))
+	}
+	if ft.Pattern != nil && !ft.Pattern.MatchString(FormatValue(v)) {
+		return fmt.Sprintf("%q does not match %s", FormatValue(v), ft.Pattern)
+	}
+	if ft.Enum != nil {
+		for _, allowed := range ft.Enum {
+			if valuesEqual(v, allowed) {
+				return ""
+			}
+		}
+		allowed := make([]string, len(ft.Enum))
+		for i, a := range ft.Enum {
+			allowed[i] = FormatValue(a)
+		}
+		return fmt.Sprintf("%q is not one of %s", FormatValue(v), strings.Join(allowed, ", "))
+	}
+	return ""
+}
+
+func hasType(v any, name string) bool {
+	switch name {
+	case "int":
+		n, ok := v.(json.Number)
+		return ok && decimalIntRe.MatchString(string(n)) || isInt(v)
+	case "number":
+		return isNumber(v)
+	}
+	return typeName(v) == name
+}
+
+func isInt(v any) bool {
+	switch v.(type) {
+	case int, int64:
+		return true
+	}
+	return false
+}
+
+// typeName names the type of a config value.
+func typeName(v any) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case []any:
+		return "list"
+	case map[string]any:
+		return "object"
+	case nil:
+		return "null"
+	}
+	if isNumber(v) {
+		return "number"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// FieldError is an entry missing a required field or holding a value that
+// violates its declared type.
+type FieldError struct {
+	// Entry identifies the entry by its dimension values, e.g.
+	// "environment=prod, service=api".
+	Entry string
+	Field string
+	Msg   string
+}
+
+func (e *FieldError) Error() string {
+	return e.Entry + ": " + e.Field + ": " + e.Msg
+}
+
+// Is reports whether target is ErrInvalidConfig.
+func (e *FieldError) Is(target error) bool { return target == ErrInvalidConfig }
+
+// FieldErrors collects the field problems of every entry.
+type FieldErrors []*FieldError
+
+func (e FieldErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = "  " + fe.Error()
+	}
+	return fmt.Sprintf("%d field errors:\n%s", len(e), strings.Join(msgs, "\n"))
+}
+
+// Unwrap returns the individual errors.
+func (e FieldErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, fe := range e {
+		errs[i] = fe
+	}
+	return errs
+}
+
+// checkFields checks the entries against settings.required_fields, the
+// required_fields of the per-value configs of their dimension values and
+// settings.field_types.
+func checkFields(entries []MatrixEntry, raw RawConfig, optsCfg OptionsConfig) error {
+	if len(optsCfg.RequiredFields) == 0 && len(optsCfg.FieldTypes) == 0 && !hasValueKey(raw, requiredFieldsKey) {
+		return nil
+	}
+	dimKeys := DimensionKeys(raw)
+	var errs FieldErrors
+	for i, entry := range entries {
+		id := entryKeys(entry, dimKeys)
+		if id == "" {
+			id = "entry " + strconv.Itoa(i)
+		}
+		required := append([]string(nil), optsCfg.RequiredFields...)
+		for _, dimKey := range dimKeys {
+			v, ok := entry[dimKey]
+			if !ok {
+				continue
+			}
+			if dimMap, ok := raw[dimKey].(map[string]any); ok {
+				if valConfig, ok := dimMap[FormatValue(v)].(map[string]any); ok {
+					required = append(required, toStrings(valConfig[requiredFieldsKey])...)
+				}
+			}
+		}
+		seen := make(map[string]bool)
+		for _, field := range required {
+			if seen[field] {
+				continue
+			}
+			seen[field] = true
+			if entry[field] == nil {
+				errs = append(errs, &FieldError{Entry: id, Field: field, Msg: "required field is missing"})
+			}
+		}
+		for _, field := range sortedKeys(optsCfg.FieldTypes) {
+			v, ok := entry[field]
+			if !ok || v == nil {
+				continue
+			}
+			if msg := optsCfg.FieldTypes[field].check(v); msg != "" {
+				errs = append(errs, &FieldError{Entry: id, Field: field, Msg: msg})
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// hasValueKey reports whether any per-value config in raw sets key.
+func hasValueKey(raw RawConfig, key string) bool {
+	for _, val := range raw {
+		if dimMap, ok := val.(map[string]any); ok {
+			for _, cfg := range dimMap {
+				if m, ok := cfg.(map[string]any); ok {
+					if _, ok := m[key]; ok {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package expander
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// usesKey lists the paths a value of the primary dimension depends on in its
+// per-value config, e.g. service.api.uses. A change under any of them
+// selects the value.
+const usesKey = "uses"
+
+// ChangeReason explains why change detection selected a value.
+type ChangeReason struct {
+	// File is the changed file that selected the value.
+	File string `json:"file"`
+	// Via is the chain of used paths leading from the value to File. It is
+	// empty when File is in the value's own directory.
+	Via []string `json:"via,omitempty"`
+}
+
+// String formats the reason as "file" or "file (via a -> b)".
+func (r ChangeReason) String() string {
+	if len(r.Via) == 0 {
+		return r.File
+	}
+	return r.File + " (via " + strings.Join(r.Via, " -> ") + ")"
+}
+
+// ValueUses returns the uses paths of each value of a map dimension, keyed
+// by the value's directory so that a value used by another value passes on
+// its own dependencies.
+func ValueUses(raw RawConfig, key, baseDir string) map[string][]string {
+	dimMap, ok := raw[key].(map[string]any)
+	if !ok {
+		return nil
+	}
+	result := make(map[string][]string)
+	for value, cfg := range dimMap {
+		if m, ok := cfg.(map[string]any); ok {
+			var uses []string
+			for _, u := range toStrings(m[usesKey]) {
+				if u = cleanRepoPath(u); u != "" {
+					uses = append(uses, u)
+				}
+			}
+			if len(uses) > 0 {
+				result[valueDir(baseDir, value)] = uses
+			}
+		}
+	}
+	return result
+}
+
+// ChangedValuesWithDeps returns the values with a changed file in their
+// directory or in a path they depend on, directly or transitively, with the
+// reason each one was selected. deps returns the paths a directory depends
+// on; it is called at most once per directory.
+func ChangedValuesWithDeps(changedFiles []string, baseDir string, values []string, deps func(dir string) []string) map[string]ChangeReason {
+	files := make([]string, 0, len(changedFiles))
+	for _, f := range changedFiles {
+		files = append(files, strings.TrimSpace(f))
+	}
+	sort.Strings(files)
+
+	cache := make(map[string][]string)
+	edges := func(dir string) []string {
+		if d, ok := cache[dir]; ok {
+			return d
+		}
+		d := deps(dir)
+		cache[dir] = d
+		return d
+	}
+
+	reasons := make(map[string]ChangeReason)
+	for _, value := range values {
+		if r, ok := firstChange(valueDir(baseDir, value), files, edges); ok {
+			reasons[value] = r
+		}
+	}
+	return reasons
+}
+
+// firstChange searches the dependency graph breadth-first from dir, so the
+// reported chain is the shortest one.
+func firstChange(dir string, files []string, edges func(string) []string) (ChangeReason, bool) {
+	type node struct {
+		dir string
+		via []string
+	}
+	visited := map[string]bool{dir: true}
+	queue := []node{{dir: dir}}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for _, f := range files {
+			if f == n.dir || strings.HasPrefix(f, n.dir+"/") {
+				return ChangeReason{File: f, Via: n.via}, true
+			}
+		}
+		for _, dep := range edges(n.dir) {
+			if !visited[dep] {
+				visited[dep] = true
+				queue = append(queue, node{dir: dep, via: append(append([]string(nil), n.via...), dep)})
+			}
+		}
+	}
+	return ChangeReason{}, false
+}
+
+var (
+	// goReplaceRe matches a go.mod replace directive with a local target,
+	// in both the single-line and the block form.
+	goReplaceRe = regexp.MustCompile(`=>\s*(\.\.?(?:/\S*)?)\s*$`)
+	// tfSourceRe matches a Terraform module source with a local path.
+	tfSourceRe = regexp.MustCompile(`(?m)^\s*source\s*=\s*"(\.\.?/[^"]*)"`)
+)
+
+// DiscoverDependencies finds the local paths the directory dir depends on:
+// the targets of replace directives in its go.mod and the local sources of
+// Terraform modules in its .tf files. dir and the result are relative to
+// root. Files that cannot be read and paths outside root are skipped.
+func DiscoverDependencies(root, dir string) []string {
+	base := filepath.Join(root, filepath.FromSlash(dir))
+	var deps []string
+	add := func(rel string) {
+		if p := cleanRepoPath(path.Join(dir, rel)); p != "" && p != dir {
+			deps = append(deps, p)
+		}
+	}
+
+	if data, err := os.ReadFile(filepath.Join(base, "go.mod")); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if i := strings.Index(line, "//"); i >= 0 {
+				line = line[:i]
+			}
+			if m := goReplaceRe.FindStringSubmatch(line); m != nil {
+				add(m[1])
+			}
+		}
+	}
+
+	tfFiles, _ := filepath.Glob(filepath.Join(base, "*.tf"))
+	for _, f := range tfFiles {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		for _, m := range tfSourceRe.FindAllStringSubmatch(string(data), -1) {
+			add(m[1])
+		}
+	}
+
+	sort.Strings(deps)
+	return slices.Compact(deps)
+}
+
+// cleanRepoPath normalizes a slash-separated path relative to the repository
+// root, returning "" for paths outside it.
+func cleanRepoPath(p string) string {
+	p = path.Clean(strings.TrimPrefix(strings.TrimSpace(p), "./"))
+	if p == "." || p == ".." || strings.HasPrefix(p, "../") || strings.HasPrefix(p, "/") {
+		return ""
+	}
+	return p
+}
+
+// valueDir returns the directory of a value: {baseDir}/{value}, or {value}
+// when baseDir is empty.
+func valueDir(baseDir, value string) string {
+	if baseDir == "" {
+		return value
+	}
+	return baseDir + "/" + value
+}
@@ -0,0 +1,176 @@
+package expander
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Keys of a discovered dimension, e.g.
+//
+//	service:
+//	  discover: "deploy/*"
+//	  marker: main.tf
+//	  api: { replicas: 2 }
+//
+// Every other key is an explicit per-value config, as in any map dimension.
+const (
+	discoverKey = "discover"
+	markerKey   = "marker"
+)
+
+// discoverSpec returns the discover pattern and marker of a dimension, and
+// whether the dimension is discovered at all. A value named "discover" with
+// a per-value config is a map or null, never a string.
+func discoverSpec(val any) (pattern, marker string, ok bool) {
+	m, isMap := val.(map[string]any)
+	if !isMap {
+		return "", "", false
+	}
+	pattern, ok = m[discoverKey].(string)
+	if !ok {
+		return "", "", false
+	}
+	marker, _ = m[markerKey].(string)
+	return strings.TrimSuffix(pattern, "/"), marker, true
+}
+
+// valueConfigMap returns the per-value configs of a map dimension, leaving
+// out the keys of a discovered dimension.
+func valueConfigMap(m map[string]any) map[string]any {
+	if _, _, ok := discoverSpec(m); !ok {
+		return m
+	}
+	values := make(map[string]any, len(m))
+	for k, v := range m {
+		if k != discoverKey && k != markerKey {
+			values[k] = v
+		}
+	}
+	return values
+}
+
+// DiscoverValues replaces every discovered dimension in raw with a map
+// dimension holding the directories under root that match its pattern and
+// contain its marker. Explicit per-value configs are kept, including those of
+// values without a directory. It returns the static prefix of each
+// discovered dimension's pattern, e.g. "deploy" for "deploy/*", which is the
+// default base_dir when that dimension is primary.
+func DiscoverValues(raw RawConfig, root string) (map[string]string, error) {
+	prefixes := make(map[string]string)
+	for _, key := range sortedKeys(raw) {
+		pattern, marker, ok := discoverSpec(raw[key])
+		if !ok {
+			continue
+		}
+		dirs, err := discoverDirs(root, pattern, marker)
+		if err != nil {
+			return nil, fmt.Errorf("discover %s: %w", key, err)
+		}
+		prefix := globPrefix(pattern)
+		values := valueConfigMap(raw[key].(map[string]any))
+		for _, dir := range dirs {
+			value := strings.TrimPrefix(strings.TrimPrefix(dir, prefix), "/")
+			if _, ok := values[value]; !ok {
+				values[value] = nil
+			}
+		}
+		raw[key] = values
+		prefixes[key] = prefix
+	}
+	return prefixes, nil
+}
+
+// discoverDirs returns the directories below root, relative to it and
+// sorted, that match pattern and contain a file matching marker. An empty
+// marker accepts every directory.
+func discoverDirs(root, pattern, marker string) ([]string, error) {
+	if root == "" {
+		root = "."
+	}
+	prefix := globPrefix(pattern)
+	// Without "**" nothing deeper than the pattern can match.
+	maxDepth := -1
+	if !strings.Contains(pattern, "**") {
+		maxDepth = strings.Count(pattern, "/") + 1
+	}
+
+	var dirs []string
+	start := filepath.Join(root, filepath.FromSlash(prefix))
+	err := filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == start && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.Name() == ".git" {
+			return fs.SkipDir
+		}
+		depth := strings.Count(rel, "/") + 1
+		if maxDepth >= 0 && depth > maxDepth {
+			return fs.SkipDir
+		}
+		if rel != "." && MatchGlob(pattern, rel) && hasMarker(p, marker) {
+			dirs = append(dirs, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// hasMarker reports whether dir holds a file matching the marker pattern.
+func hasMarker(dir, marker string) bool {
+	if marker == "" {
+		return true
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, marker))
+	return len(matches) > 0
+}
+
+// globPrefix returns the leading segments of pattern that contain no glob
+// characters, e.g. "deploy" for "deploy/*" and "" for "*".
+func globPrefix(pattern string) string {
+	segments := strings.Split(pattern, "/")
+	for i, seg := range segments {
+		if strings.ContainsAny(seg, `*?[\`) {
+			return path.Join(segments[:i]...)
+		}
+	}
+	return path.Dir(pattern)
+}
+
+// MissingDirectories returns, for each value of the dimension key whose
+// {baseDir}/{value} directory does not exist under root, the dotted path of
+// the value and its directory.
+func MissingDirectories(raw RawConfig, key, baseDir, root string) map[string]string {
+	if root == "" {
+		root = "."
+	}
+	missing := make(map[string]string)
+	for _, value := range ExtractDimensionValues(raw, key) {
+		dir := valueDir(baseDir, value)
+		info, err := os.Stat(filepath.Join(root, filepath.FromSlash(dir)))
+		if err != nil || !info.IsDir() {
+			missing[key+"."+value] = dir
+		}
+	}
+	return missing
+}
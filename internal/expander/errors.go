@@ -0,0 +1,197 @@
+package expander
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// ErrConfigNotFound is returned when the configuration file does not exist.
+	ErrConfigNotFound = errors.New("configuration file not found")
+	// ErrInvalidConfig matches every error caused by a malformed configuration.
+	ErrInvalidConfig = errors.New("invalid configuration")
+)
+
+// ConfigError is a problem in a configuration file. Line and Column are
+// 1-based and zero when unknown; Path is the dotted path of the offending
+// value, e.g. "settings.sort_by" or "exclude[1]".
+type ConfigError struct {
+	File   string
+	Line   int
+	Column int
+	Path   string
+	Msg    string
+}
+
+// Error formats the problem as "file:line:col: path: msg".
+func (e *ConfigError) Error() string {
+	var sb strings.Builder
+	sb.WriteString(e.File)
+	if e.Line > 0 {
+		fmt.Fprintf(&sb, ":%d", e.Line)
+		if e.Column > 0 {
+			fmt.Fprintf(&sb, ":%d", e.Column)
+		}
+	}
+	sb.WriteString(": ")
+	sb.WriteString(e.Message())
+	return sb.String()
+}
+
+// Message returns the problem without the file location.
+func (e *ConfigError) Message() string {
+	if e.Path == "" {
+		return e.Msg
+	}
+	return e.Path + ": " + e.Msg
+}
+
+// Is reports whether target is ErrInvalidConfig.
+func (e *ConfigError) Is(target error) bool { return target == ErrInvalidConfig }
+
+// ConfigErrors collects every problem found in a configuration file, so they
+// can be reported together.
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	msgs := make([]string, len(e))
+	for i, ce := range e {
+		msgs[i] = "  " + ce.Error()
+	}
+	return fmt.Sprintf("%d configuration errors:\n%s", len(e), strings.Join(msgs, "\n"))
+}
+
+// Unwrap returns the individual errors.
+func (e ConfigErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, ce := range e {
+		errs[i] = ce
+	}
+	return errs
+}
+
+// position is a 1-based line and column in a configuration file.
+type position struct {
+	line, column int
+}
+
+// positions maps the dotted path of every value in a YAML (or JSON, which
+// yaml.v3 also parses) document to its position.
+func positions(doc *yaml.Node) map[string]position {
+	pos := make(map[string]position)
+	var walk func(n *yaml.Node, path string)
+	walk = func(n *yaml.Node, path string) {
+		pos[path] = position{n.Line, n.Column}
+		switch n.Kind {
+		case yaml.DocumentNode:
+			for _, c := range n.Content {
+				walk(c, path)
+			}
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				walk(n.Content[i+1], joinPath(path, n.Content[i].Value))
+			}
+		case yaml.SequenceNode:
+			for i, c := range n.Content {
+				walk(c, indexPath(path, i))
+			}
+		}
+	}
+	walk(doc, "")
+	return pos
+}
+
+// joinPath appends a key to a dotted path.
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// yamlLineRe matches the line prefix of yaml.v3 error messages.
+var yamlLineRe = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// yamlError converts a yaml.v3 parse or decode error to located errors.
+// Each message of a yaml.TypeError becomes its own error.
+func yamlError(file string, err error) ConfigErrors {
+	var msgs []string
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		msgs = typeErr.Errors
+	} else {
+		msgs = []string{err.Error()}
+	}
+
+	errs := make(ConfigErrors, 0, len(msgs))
+	for _, msg := range msgs {
+		ce := &ConfigError{File: file, Msg: "invalid YAML: " + strings.TrimPrefix(msg, "yaml: ")}
+		if m := yamlLineRe.FindStringSubmatch(msg); m != nil {
+			ce.Line, _ = strconv.Atoi(m[1])
+			ce.Msg = "invalid YAML: " + m[2]
+		}
+		errs = append(errs, ce)
+	}
+	return errs
+}
+
+// checkRoot reports a document whose root is not a mapping, at the
+// position of the root. An empty document is left to the caller.
+func checkRoot(file string, doc *yaml.Node) ConfigErrors {
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+	if root.Kind == yaml.MappingNode || root.Kind == yaml.ScalarNode && root.Tag == "!!null" {
+		return nil
+	}
+	return ConfigErrors{{File: file, Line: root.Line, Column: root.Column, Msg: "configuration must be an object"}}
+}
+
+// jsonError converts an encoding/json error to a located error.
+func jsonError(file string, data []byte, err error) ConfigErrors {
+	ce := &ConfigError{File: file, Msg: "invalid JSON: " + err.Error()}
+	var offset int64 = -1
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		// Offset is just past the offending byte.
+		offset = max(syntaxErr.Offset-1, 0)
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+		if typeErr.Field == "" {
+			ce.Msg = "configuration must be an object"
+		}
+	}
+	if offset >= 0 {
+		ce.Line, ce.Column = offsetPosition(data, offset)
+	}
+	return ConfigErrors{ce}
+}
+
+// offsetPosition converts a byte offset to a 1-based line and column.
+func offsetPosition(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	line, col := 1, 1
+	for _, b := range data[:offset] {
+		if b == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return line, col
+}
@@ -2,10 +2,16 @@
 package expander
 
 import (
+	"bytes"
+	"cmp"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"sort"
 	"strings"
 
@@ -20,12 +26,57 @@ type RawConfig map[string]any
 
 // OptionsConfig holds the parsed "settings" and "global" blocks from the config file.
 type OptionsConfig struct {
-	Dimension    string
-	BaseDir      string
-	SortBy       []string
+	Dimension string
+	BaseDir   string
+	// IdentityKey is the field holding the value of list-of-objects
+	// dimension items; empty means "name".
+	IdentityKey   string
+	SortBy        []string
+	Sensitive     []string
+	OmitSensitive bool
+	Fields        []string
+	Omit          []string
+	IgnorePaths   []string
+	// DiscoverDependencies adds the local go.mod replace targets and
+	// Terraform module sources of each directory to its uses.
+	DiscoverDependencies bool
+	// FragmentKeys are the keys a per-directory fragment may set; nil
+	// disables fragments.
+	FragmentKeys []string
+	// RequiredFields must be set in every entry.
+	RequiredFields []string
+	// FieldTypes constrain the values of fields, keyed by field.
+	FieldTypes map[string]FieldType
+	// Fragments are the loaded fragments of the primary dimension's values,
+	// keyed by value (see LoadFragments).
+	Fragments    map[string]Fragment
 	GlobalConfig map[string]any
 	Exclude      []MatrixEntry
 	Include      []MatrixEntry
+	Profiles     map[string]Profile
+	Rules        []Rule
+	// Groups are named lists of primary dimension values or glob patterns,
+	// selected in target with "@name".
+	Groups map[string][]string
+	// Warnings are warnings about the config, such as legacy keys or numbers
+	// that would lose precision.
+	Warnings []string
+}
+
+// Profile is a named bundle of expansion options from the "profiles" block,
+// selected with the profile input.
+type Profile struct {
+	Target      []string
+	Environment []string
+	Exclude     []MatrixEntry
+	Include     []MatrixEntry
+	SortBy      []string
+	Fields      []string
+	Omit        []string
+	// Collapse and CollapsePolicy are the profile's collapse and
+	// collapse_policy.
+	Collapse       []string
+	CollapsePolicy string
 }
 
 // Options controls the expansion behavior.
@@ -35,6 +86,19 @@ type Options struct {
 	EnvironmentFilter []string
 	InputExclude      []MatrixEntry
 	InputInclude      []MatrixEntry
+	SortBy            []string
+	Fields            []string
+	Omit              []string
+	// Collapse are dimensions removed from the entries, which are then
+	// merged according to CollapsePolicy (see collapseEntries).
+	Collapse       []string
+	CollapsePolicy string
+	// Event is the context rules see as event, e.g. {"name": "push"}.
+	Event map[string]any
+	// OnViolation, if set, receives every violation of optsCfg.Rules. Entry
+	// rules see the entries before collapsing and projection, with every
+	// field and dimension; length is that of the final matrix.
+	OnViolation func(Violation)
 }
 
 // ParseConfigFile reads and validates a JSON or YAML configuration file.
@@ -42,7 +106,7 @@ func ParseConfigFile(path string) (RawConfig, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("configuration file not found: %s", path)
+			return nil, fmt.Errorf("%w: %s", ErrConfigNotFound, path)
 		}
 		return nil, fmt.Errorf("failed to read configuration file: %w", err)
 	}
@@ -50,33 +114,106 @@ func ParseConfigFile(path string) (RawConfig, error) {
 	ext := strings.ToLower(filepath.Ext(path))
 
 	var raw RawConfig
+	var secrets []string
+	var doc yaml.Node
 
 	switch ext {
 	case ".json":
-		if err := json.Unmarshal(data, &raw); err != nil {
-			return nil, fmt.Errorf("invalid JSON in %s: %w", path, err)
+		// Keep numbers as written.
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&raw); err != nil {
+			return nil, jsonError(path, data, err)
 		}
+		end := dec.InputOffset()
+		if _, err := dec.Token(); err != io.EOF {
+			rest := data[end:]
+			line, col := offsetPosition(data, end+int64(len(rest)-len(bytes.TrimLeft(rest, " \t\r\n"))))
+			return nil, ConfigErrors{{File: path, Line: line, Column: col, Msg: "invalid JSON: unexpected data after the top-level value"}}
+		}
+		// yaml.v3 parses JSON too; it is only used to locate problems.
+		_ = yaml.Unmarshal(data, &doc)
 	case ".yaml", ".yml":
-		if err := yaml.Unmarshal(data, &raw); err != nil {
-			return nil, fmt.Errorf("invalid YAML in %s: %w", path, err)
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, yamlError(path, err)
+		}
+		if errs := checkRoot(path, &doc); errs != nil {
+			return nil, errs
+		}
+		secrets = collectSecretTags(&doc)
+		// Decoding reports type errors and duplicate keys; the values are
+		// taken from the nodes to keep numbers and timestamps as written.
+		if err := doc.Decode(&raw); err != nil {
+			return nil, yamlError(path, err)
+		}
+		if raw != nil {
+			v, err := nodeValue(&doc)
+			if err != nil {
+				return nil, yamlError(path, err)
+			}
+			raw = v.(map[string]any)
 		}
 	default:
-		return nil, fmt.Errorf("unsupported file type. Use .json, .yaml, or .yml")
+		return nil, ConfigErrors{{File: path, Msg: "unsupported file type. Use .json, .yaml, or .yml"}}
 	}
 
 	if raw == nil {
-		return nil, fmt.Errorf("configuration must be an object")
+		return nil, ConfigErrors{{File: path, Msg: "configuration must be an object"}}
 	}
 
-	// Normalize: yaml.v3 may produce named map types (RawConfig) for nested
-	// objects, which won't match plain map[string]any type assertions.
-	// Round-trip through JSON to ensure uniform types.
-	normalized, err := normalizeViaJSON(raw)
-	if err != nil {
-		return nil, fmt.Errorf("failed to normalize config: %w", err)
+	if errs := validateConfig(path, raw, positions(&doc)); len(errs) > 0 {
+		return nil, errs
+	}
+
+	if len(secrets) > 0 {
+		addSensitive(raw, secrets)
+	}
+
+	return raw, nil
+}
+
+// secretTag marks a YAML value as sensitive, e.g. `aws_account_id: !secret "1234"`.
+const secretTag = "!secret"
+
+// collectSecretTags returns the keys whose values carry the !secret tag and
+// strips the tag so the value decodes as if it were untagged.
+func collectSecretTags(node *yaml.Node) []string {
+	var keys []string
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, val := node.Content[i], node.Content[i+1]
+			if val.Tag == secretTag {
+				keys = append(keys, key.Value)
+				val.Tag = ""
+			}
+		}
+	}
+	for _, child := range node.Content {
+		keys = append(keys, collectSecretTags(child)...)
 	}
+	return keys
+}
 
-	return normalized, nil
+// addSensitive appends field names to settings.sensitive, creating the
+// settings block if needed.
+func addSensitive(raw RawConfig, fields []string) {
+	settings, ok := raw["settings"].(map[string]any)
+	if !ok {
+		settings = make(map[string]any)
+		raw["settings"] = settings
+	}
+	existing, _ := toSlice(settings["sensitive"])
+	seen := make(map[string]bool, len(existing))
+	for _, v := range existing {
+		seen[FormatValue(v)] = true
+	}
+	for _, f := range fields {
+		if !seen[f] {
+			seen[f] = true
+			existing = append(existing, f)
+		}
+	}
+	settings["sensitive"] = existing
 }
 
 // reservedKeys are top-level keys that are never treated as dimensions.
@@ -85,6 +222,9 @@ var reservedKeys = map[string]bool{
 	"global":   true,
 	"exclude":  true,
 	"include":  true,
+	"profiles": true,
+	"rules":    true,
+	"groups":   true,
 }
 
 // ParseOptions extracts reserved top-level keys from a raw config, returning
@@ -113,7 +253,9 @@ func ParseOptions(raw RawConfig) (OptionsConfig, RawConfig) {
 		}
 	}
 
-	// Settings block — action settings (dimension, base_dir, sort_by)
+	// Settings block — action settings (dimension, base_dir, sort_by, sensitive,
+	// omit_sensitive, fields, omit, ignore_paths, discover_dependencies,
+	// fragment_keys, required_fields, field_types, identity_key)
 	if settingsRaw, ok := raw["settings"]; ok {
 		if settingsMap, ok := settingsRaw.(map[string]any); ok {
 			if d, ok := settingsMap["dimension"].(string); ok && d != "" {
@@ -124,6 +266,8 @@ func ParseOptions(raw RawConfig) (OptionsConfig, RawConfig) {
 				optsCfg.BaseDir = bd
 			}
 
+			optsCfg.IdentityKey, _ = settingsMap["identity_key"].(string)
+
 			if sb, ok := settingsMap["sort_by"]; ok {
 				if arr, ok := toSlice(sb); ok {
 					sortBy := make([]string, 0, len(arr))
@@ -135,6 +279,47 @@ func ParseOptions(raw RawConfig) (OptionsConfig, RawConfig) {
 					optsCfg.SortBy = sortBy
 				}
 			}
+
+			if sens, ok := settingsMap["sensitive"]; ok {
+				if arr, ok := toSlice(sens); ok {
+					for _, v := range arr {
+						if s, ok := v.(string); ok {
+							optsCfg.Sensitive = append(optsCfg.Sensitive, s)
+						}
+					}
+				}
+			}
+
+			if omit, ok := settingsMap["omit_sensitive"].(bool); ok {
+				optsCfg.OmitSensitive = omit
+			}
+
+			optsCfg.Fields = toStrings(settingsMap["fields"])
+			optsCfg.Omit = toStrings(settingsMap["omit"])
+			optsCfg.IgnorePaths = toStrings(settingsMap["ignore_paths"])
+			optsCfg.DiscoverDependencies, _ = settingsMap["discover_dependencies"].(bool)
+			optsCfg.FragmentKeys = toStrings(settingsMap["fragment_keys"])
+			optsCfg.RequiredFields = toStrings(settingsMap["required_fields"])
+			optsCfg.FieldTypes = parseFieldTypes(settingsMap["field_types"])
+		}
+	}
+
+	// Profiles block — named option bundles selected via the profile input
+	if profilesRaw, ok := raw["profiles"].(map[string]any); ok {
+		optsCfg.Profiles = make(map[string]Profile, len(profilesRaw))
+		for name, v := range profilesRaw {
+			optsCfg.Profiles[name] = parseProfile(v)
+		}
+	}
+
+	// Rules block — policy assertions checked against the expanded matrix
+	optsCfg.Rules = parseRules(raw["rules"])
+
+	// Groups block — named value lists selected in target with @name
+	if groupsRaw, ok := raw["groups"].(map[string]any); ok {
+		optsCfg.Groups = make(map[string][]string, len(groupsRaw))
+		for name, v := range groupsRaw {
+			optsCfg.Groups[name] = toStringList(v)
 		}
 	}
 
@@ -151,9 +336,59 @@ func ParseOptions(raw RawConfig) (OptionsConfig, RawConfig) {
 		}
 	}
 
+	normalizeObjectLists(dimensions, cmp.Or(optsCfg.IdentityKey, defaultIdentityKey))
+
+	// Legacy keys from before 3.0.0 still apply, with a warning.
+	optsCfg.Warnings = applyLegacyKeys(raw, &optsCfg)
+	optsCfg.Warnings = append(optsCfg.Warnings, largeNumberWarnings(raw)...)
+	optsCfg.Warnings = append(optsCfg.Warnings, filterKeyWarnings(dimensions)...)
+
 	return optsCfg, dimensions
 }
 
+// parseProfile converts a raw profile block. target and environment accept
+// either a comma-separated string or a list.
+func parseProfile(v any) Profile {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return Profile{}
+	}
+	p := Profile{
+		Target:      toStringList(m["target"]),
+		Environment: toStringList(m["environment"]),
+		SortBy:      toStrings(m["sort_by"]),
+		Fields:      toStrings(m["fields"]),
+		Omit:        toStrings(m["omit"]),
+		Collapse:    toStringList(m["collapse"]),
+	}
+	p.CollapsePolicy, _ = m["collapse_policy"].(string)
+	if exc, ok := m["exclude"]; ok {
+		if entries, err := toMatrixEntries(exc); err == nil {
+			p.Exclude = entries
+		}
+	}
+	if inc, ok := m["include"]; ok {
+		if entries, err := toMatrixEntries(inc); err == nil {
+			p.Include = entries
+		}
+	}
+	return p
+}
+
+// toStringList accepts a comma-separated string or a list of strings.
+func toStringList(v any) []string {
+	if s, ok := v.(string); ok {
+		var result []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				result = append(result, item)
+			}
+		}
+		return result
+	}
+	return toStrings(v)
+}
+
 // dimension represents a named list of values for cartesian product.
 type dimension struct {
 	key    string
@@ -193,13 +428,13 @@ func ExtractDimensionValues(raw RawConfig, key string) []string {
 	if arr, ok := toSlice(val); ok {
 		values := make([]string, 0, len(arr))
 		for _, v := range arr {
-			values = append(values, fmt.Sprintf("%v", v))
+			values = append(values, FormatValue(v))
 		}
 		return values
 	}
 	// Map dimension
 	if m, ok := val.(map[string]any); ok {
-		return sortedKeys(m)
+		return mapValues(m)
 	}
 	return nil
 }
@@ -220,11 +455,11 @@ func Expand(raw RawConfig, optsCfg OptionsConfig, opts Options) ([]MatrixEntry,
 		entries = []MatrixEntry{entry}
 	} else {
 		// Build cartesian product
-		entries = cartesianProduct(dimensions)
+		entries = cartesianProduct(dimensions, parseCombinationRules(raw))
 
 		// Merge base config, global config, and per-dimension-value configs
 		baseConfig := extractBaseConfig(raw)
-		entries = mergeConfig(entries, baseConfig, optsCfg.GlobalConfig, raw)
+		entries = mergeConfig(entries, baseConfig, raw, optsCfg)
 	}
 
 	// Apply options-level exclude
@@ -258,27 +493,177 @@ func Expand(raw RawConfig, optsCfg OptionsConfig, opts Options) ([]MatrixEntry,
 	// Add directory field to each entry
 	addDirectoryField(entries, optsCfg)
 
+	// Rules are checked on the entries as they are now.
+	dimKeys := make([]string, len(dimensions))
+	for i, d := range dimensions {
+		dimKeys[i] = d.key
+	}
+	full := entries
+
+	// Check required fields and types before collapsing merges values and
+	// projection hides fields.
+	if err := checkFields(entries, raw, optsCfg); err != nil {
+		return nil, err
+	}
+
+	// Merge entries that differ only in collapsed dimensions
+	if len(opts.Collapse) > 0 {
+		var err error
+		if entries, err = collapseEntries(entries, opts.Collapse, opts.CollapsePolicy, dimKeys); err != nil {
+			return nil, err
+		}
+	}
+
 	// Sort entries by sort_by keys (default: ["environment"])
-	sortBy := optsCfg.SortBy
+	sortBy := opts.SortBy
+	if sortBy == nil {
+		sortBy = optsCfg.SortBy
+	}
 	if sortBy == nil {
 		sortBy = []string{"environment"}
 	}
 	sortEntries(entries, sortBy)
 
+	// Project fields after sorting, so sort_by keys may be omitted.
+	fields := opts.Fields
+	if fields == nil {
+		fields = optsCfg.Fields
+	}
+	omit := opts.Omit
+	if omit == nil {
+		omit = optsCfg.Omit
+	}
+	if len(fields) > 0 || len(omit) > 0 {
+		keep := make([]string, len(dimensions))
+		for i, d := range dimensions {
+			keep[i] = d.key
+		}
+		entries = ProjectEntries(entries, fields, omit, keep)
+	}
+
 	// Ensure we never return nil so json.Marshal produces "[]" not "null".
 	if entries == nil {
 		entries = []MatrixEntry{}
 	}
 
+	if opts.OnViolation != nil {
+		for _, v := range CheckRules(optsCfg.Rules, full, dimKeys, opts.Event, len(entries)) {
+			opts.OnViolation(v)
+		}
+	}
 	return entries, nil
 }
 
+// ProjectEntries reduces each entry to the given field paths and then removes
+// the omitted paths. Paths are dot-separated (e.g. "tags.team") and each
+// segment may be a glob (e.g. "aws_*", "tags.*"). An empty fields list keeps
+// every field. The keep keys (dimension keys) are never removed.
+func ProjectEntries(entries []MatrixEntry, fields, omit, keep []string) []MatrixEntry {
+	include := splitPaths(fields)
+	exclude := splitPaths(omit)
+
+	result := make([]MatrixEntry, len(entries))
+	for i, entry := range entries {
+		projected := map[string]any(entry)
+		if len(include) > 0 {
+			projected = selectPaths(projected, include)
+		}
+		if len(exclude) > 0 {
+			projected = omitPaths(projected, exclude)
+		}
+		for _, k := range keep {
+			if v, ok := entry[k]; ok {
+				projected[k] = v
+			}
+		}
+		result[i] = MatrixEntry(projected)
+	}
+	return result
+}
+
+func splitPaths(paths []string) [][]string {
+	result := make([][]string, 0, len(paths))
+	for _, p := range paths {
+		if p = strings.TrimSpace(p); p != "" {
+			result = append(result, strings.Split(p, "."))
+		}
+	}
+	return result
+}
+
+// matchSegment reports whether a path segment glob matches a key. Invalid
+// patterns fall back to exact comparison.
+func matchSegment(pattern, key string) bool {
+	ok, err := path.Match(pattern, key)
+	if err != nil {
+		return pattern == key
+	}
+	return ok
+}
+
+// selectPaths returns a copy of m containing only the given paths.
+func selectPaths(m map[string]any, paths [][]string) map[string]any {
+	result := make(map[string]any)
+	for k, v := range m {
+		whole := false
+		var nested [][]string
+		for _, p := range paths {
+			if !matchSegment(p[0], k) {
+				continue
+			}
+			if len(p) == 1 {
+				whole = true
+				break
+			}
+			nested = append(nested, p[1:])
+		}
+		if whole {
+			result[k] = v
+			continue
+		}
+		if sub, ok := v.(map[string]any); ok && len(nested) > 0 {
+			if selected := selectPaths(sub, nested); len(selected) > 0 {
+				result[k] = selected
+			}
+		}
+	}
+	return result
+}
+
+// omitPaths returns a copy of m without the given paths.
+func omitPaths(m map[string]any, paths [][]string) map[string]any {
+	result := make(map[string]any, len(m))
+	for k, v := range m {
+		drop := false
+		var nested [][]string
+		for _, p := range paths {
+			if !matchSegment(p[0], k) {
+				continue
+			}
+			if len(p) == 1 {
+				drop = true
+				break
+			}
+			nested = append(nested, p[1:])
+		}
+		if drop {
+			continue
+		}
+		if sub, ok := v.(map[string]any); ok && len(nested) > 0 {
+			result[k] = omitPaths(sub, nested)
+		} else {
+			result[k] = v
+		}
+	}
+	return result
+}
+
 // sortEntries sorts matrix entries by the given keys in order.
 func sortEntries(entries []MatrixEntry, keys []string) {
 	sort.SliceStable(entries, func(i, j int) bool {
 		for _, key := range keys {
-			vi := fmt.Sprintf("%v", entries[i][key])
-			vj := fmt.Sprintf("%v", entries[j][key])
+			vi := FormatValue(entries[i][key])
+			vj := FormatValue(entries[j][key])
 			if vi != vj {
 				return vi < vj
 			}
@@ -299,7 +684,7 @@ func addDirectoryField(entries []MatrixEntry, optsCfg OptionsConfig) {
 			}
 			continue
 		}
-		strVal := fmt.Sprintf("%v", val)
+		strVal := FormatValue(val)
 		if optsCfg.BaseDir != "" {
 			entry["directory"] = optsCfg.BaseDir + "/" + strVal
 		} else {
@@ -308,6 +693,88 @@ func addDirectoryField(entries []MatrixEntry, optsCfg OptionsConfig) {
 	}
 }
 
+// DimensionKeys returns the sorted keys of the dimensions (arrays and maps) in
+// a dimensions-only config.
+func DimensionKeys(raw RawConfig) []string {
+	dims := extractDimensions(raw)
+	keys := make([]string, len(dims))
+	for i, d := range dims {
+		keys[i] = d.key
+	}
+	return keys
+}
+
+// Provenance reports which layer of the config supplied each field of an
+// entry expanded from raw. Sources are "base" (top-level scalars), "global",
+// "dimension" (the entry's own dimension values), "<dimension>.<value>" (a
+// per-value config such as "service.api"), the path of a fragment such as
+// "deploy/api/.matrix.yaml", "directory" (the computed
+// directory field), "<dimension>.*" for a field merged from the values of a
+// dimension in collapse and "include" for anything the layers do not explain.
+func Provenance(raw RawConfig, optsCfg OptionsConfig, entry MatrixEntry, collapse []string) map[string]string {
+	values := make(map[string]any)
+	sources := make(map[string]string)
+	set := func(k string, v any, src string) {
+		values[k] = v
+		sources[k] = src
+	}
+
+	dims := extractDimensions(raw)
+	if len(dims) == 0 {
+		for k, v := range raw {
+			set(k, v, "base")
+		}
+	} else {
+		combo := make(MatrixEntry, len(dims))
+		for _, d := range dims {
+			if slices.Contains(collapse, d.key) {
+				continue
+			}
+			v, ok := entry[d.key]
+			if !ok {
+				// Entries lacking a dimension can only come from include.
+				combo = nil
+				break
+			}
+			combo[d.key] = v
+		}
+		if combo != nil {
+			for k, v := range extractBaseConfig(raw) {
+				set(k, v, "base")
+			}
+			for k, v := range optsCfg.GlobalConfig {
+				set(k, v, "global")
+			}
+			for k, v := range combo {
+				set(k, v, "dimension")
+			}
+			applyValueConfigs(raw, optsCfg, combo, set)
+		}
+	}
+
+	computed := []MatrixEntry{{}}
+	if v, ok := entry[optsCfg.Dimension]; ok {
+		computed[0][optsCfg.Dimension] = v
+	}
+	addDirectoryField(computed, optsCfg)
+	if dir, ok := computed[0]["directory"]; ok {
+		set("directory", dir, "directory")
+	}
+
+	collapsed := collapsedSources(raw, collapse)
+	result := make(map[string]string, len(entry))
+	for k, v := range entry {
+		if src, ok := sources[k]; ok && reflect.DeepEqual(values[k], v) {
+			result[k] = src
+		} else if src, ok := collapsed[k]; ok {
+			result[k] = src
+		} else {
+			result[k] = "include"
+		}
+	}
+	return result
+}
+
 // extractDimensions finds all dimensions from the config.
 // Arrays become dimensions directly. Maps become dimensions with sorted keys as values.
 func extractDimensions(raw RawConfig) []dimension {
@@ -322,8 +789,9 @@ func extractDimensions(raw RawConfig) []dimension {
 			// Array dimension
 			dims = append(dims, dimension{key: k, values: arr})
 		} else if m, ok := v.(map[string]any); ok {
-			// Map dimension: sorted keys become values
-			mapKeys := sortedKeys(m)
+			// Map dimension: sorted keys, or the list order of a list of
+			// objects, become values
+			mapKeys := mapValues(m)
 			values := make([]any, len(mapKeys))
 			for i, mk := range mapKeys {
 				values[i] = mk
@@ -350,8 +818,9 @@ func extractBaseConfig(raw RawConfig) MatrixEntry {
 	return base
 }
 
-// cartesianProduct computes the cartesian product of all dimensions.
-func cartesianProduct(dims []dimension) []MatrixEntry {
+// cartesianProduct computes the cartesian product of all dimensions. Disabled
+// values and combinations ruled out by only or except are never generated.
+func cartesianProduct(dims []dimension, rules combinationRules) []MatrixEntry {
 	result := []MatrixEntry{{}}
 
 	for _, dim := range dims {
@@ -363,7 +832,9 @@ func cartesianProduct(dims []dimension) []MatrixEntry {
 					newEntry[k] = v
 				}
 				newEntry[dim.key] = val
-				next = append(next, newEntry)
+				if rules.allows(newEntry) {
+					next = append(next, newEntry)
+				}
 			}
 		}
 		result = next
@@ -379,8 +850,10 @@ func cartesianProduct(dims []dimension) []MatrixEntry {
 //  1. Base config (scalar top-level values)
 //  2. Global config values (from "global" minus reserved keys)
 //  3. Combo dimension values (e.g. service=api, environment=dev)
-//  4. Per-dimension-value configs in alphabetical dimension key order
-func mergeConfig(entries []MatrixEntry, baseConfig MatrixEntry, globalConfig map[string]any, raw RawConfig) []MatrixEntry {
+//  4. Per-dimension-value configs in alphabetical dimension key order,
+//     without keys that configure the action (see isValueKey), each
+//     followed by the value's fragment for the primary dimension
+func mergeConfig(entries []MatrixEntry, baseConfig MatrixEntry, raw RawConfig, optsCfg OptionsConfig) []MatrixEntry {
 	result := make([]MatrixEntry, len(entries))
 
 	for i, combo := range entries {
@@ -392,7 +865,7 @@ func mergeConfig(entries []MatrixEntry, baseConfig MatrixEntry, globalConfig map
 		}
 
 		// 2. Global config values
-		for k, v := range globalConfig {
+		for k, v := range optsCfg.GlobalConfig {
 			entry[k] = v
 		}
 
@@ -402,17 +875,9 @@ func mergeConfig(entries []MatrixEntry, baseConfig MatrixEntry, globalConfig map
 		}
 
 		// 4. Per-dimension-value configs in alphabetical dimension key order
-		dimKeys := sortedKeys(combo)
-		for _, dimKey := range dimKeys {
-			dimValue := fmt.Sprintf("%v", combo[dimKey])
-			if dimMap, ok := raw[dimKey].(map[string]any); ok {
-				if valConfig, ok := dimMap[dimValue].(map[string]any); ok {
-					for ck, cv := range valConfig {
-						entry[ck] = cv
-					}
-				}
-			}
-		}
+		applyValueConfigs(raw, optsCfg, combo, func(k string, v any, _ string) {
+			entry[k] = v
+		})
 
 		result[i] = entry
 	}
@@ -420,6 +885,36 @@ func mergeConfig(entries []MatrixEntry, baseConfig MatrixEntry, globalConfig map
 	return result
 }
 
+// applyValueConfigs calls set for every field of the per-value configs of a
+// combination, in merge order, with its source: "<dimension>.<value>" or the
+// path of the value's fragment.
+func applyValueConfigs(raw RawConfig, optsCfg OptionsConfig, combo MatrixEntry, set func(k string, v any, src string)) {
+	for _, dimKey := range sortedKeys(combo) {
+		dimValue := FormatValue(combo[dimKey])
+		if dimMap, ok := raw[dimKey].(map[string]any); ok {
+			if valConfig, ok := dimMap[dimValue].(map[string]any); ok {
+				for ck, cv := range valConfig {
+					if isValueKey(valConfig, ck, dimKey, optsCfg.Dimension) {
+						continue
+					}
+					set(ck, cv, dimKey+"."+dimValue)
+				}
+			}
+		}
+		if dimKey != optsCfg.Dimension {
+			continue
+		}
+		if f, ok := optsCfg.Fragments[dimValue]; ok {
+			for ck, cv := range f.Config {
+				if isValueKey(f.Config, ck, dimKey, optsCfg.Dimension) {
+					continue
+				}
+				set(ck, cv, f.Path)
+			}
+		}
+	}
+}
+
 // applyExclude removes entries matching all key/value pairs in any pattern.
 func applyExclude(entries []MatrixEntry, patterns []MatrixEntry) []MatrixEntry {
 	var result []MatrixEntry
@@ -453,7 +948,7 @@ func applyFilter(entries []MatrixEntry, key string, allowed []string) []MatrixEn
 	var result []MatrixEntry
 	for _, entry := range entries {
 		if val, ok := entry[key]; ok {
-			if allowedSet[fmt.Sprintf("%v", val)] {
+			if allowedSet[FormatValue(val)] {
 				result = append(result, entry)
 			}
 		}
@@ -469,7 +964,7 @@ func matchesPattern(entry, pattern MatrixEntry) bool {
 			return false
 		}
 		// Use string comparison for cross-type matching
-		if fmt.Sprintf("%v", ev) != fmt.Sprintf("%v", pv) {
+		if FormatValue(ev) != FormatValue(pv) {
 			return false
 		}
 	}
@@ -484,6 +979,22 @@ func toSlice(v any) ([]any, bool) {
 	return nil, false
 }
 
+// toStrings converts a list value to a slice of strings, skipping non-strings.
+// Returns nil if the value is not a list.
+func toStrings(v any) []string {
+	arr, ok := toSlice(v)
+	if !ok {
+		return nil
+	}
+	result := make([]string, 0, len(arr))
+	for _, item := range arr {
+		if s, ok := item.(string); ok {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
 // toMatrixEntries converts an interface{} to []MatrixEntry.
 func toMatrixEntries(v any) ([]MatrixEntry, error) {
 	arr, ok := toSlice(v)
@@ -500,19 +1011,54 @@ func toMatrixEntries(v any) ([]MatrixEntry, error) {
 	return result, nil
 }
 
-// normalizeViaJSON round-trips through JSON to ensure all nested maps are
-// plain map[string]any and all slices are []any, regardless of the source
-// parser's named types.
-func normalizeViaJSON(raw RawConfig) (RawConfig, error) {
-	data, err := json.Marshal(raw)
-	if err != nil {
-		return nil, err
+// SensitiveConfigValues returns every scalar value stored under one of the
+// given field names anywhere in the config (global, dimension value configs,
+// include entries), so they can be masked before expansion prints anything.
+func SensitiveConfigValues(raw RawConfig, fields []string) []string {
+	if len(fields) == 0 {
+		return nil
 	}
-	var result RawConfig
-	if err := json.Unmarshal(data, &result); err != nil {
-		return nil, err
+	sensitive := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		sensitive[f] = true
 	}
-	return result, nil
+
+	seen := make(map[string]bool)
+	var values []string
+	var collect func(v any, inSensitive bool)
+	collect = func(v any, inSensitive bool) {
+		switch val := v.(type) {
+		case map[string]any:
+			for _, k := range sortedKeys(val) {
+				collect(val[k], inSensitive || sensitive[k])
+			}
+		case []any:
+			for _, item := range val {
+				collect(item, inSensitive)
+			}
+		case nil:
+		default:
+			if inSensitive {
+				s := FormatValue(val)
+				if !seen[s] {
+					seen[s] = true
+					values = append(values, s)
+				}
+			}
+		}
+	}
+	collect(map[string]any(raw), false)
+	return values
+}
+
+// SensitiveValues returns the distinct string values of the given fields
+// across all entries, for registering with the CI system's log masking.
+func SensitiveValues(entries []MatrixEntry, fields []string) []string {
+	var values []string
+	for _, field := range fields {
+		values = append(values, UniqueValues(entries, field)...)
+	}
+	return values
 }
 
 // UniqueValues extracts the unique string values for a given key from matrix
@@ -522,7 +1068,7 @@ func UniqueValues(entries []MatrixEntry, key string) []string {
 	var result []string
 	for _, entry := range entries {
 		if val, ok := entry[key]; ok {
-			s := fmt.Sprintf("%v", val)
+			s := FormatValue(val)
 			if !seen[s] {
 				seen[s] = true
 				result = append(result, s)
@@ -532,45 +1078,18 @@ func UniqueValues(entries []MatrixEntry, key string) []string {
 	return result
 }
 
-// ResolveTarget handles dimension selection. If dimensionOverride is set (from
-// dimension input), it overrides the config's dimension and removes the old
-// dimension. Otherwise, if target is a single value matching a dimension name (but
-// not a value of the current dimension), it triggers the same switch.
-func ResolveTarget(raw RawConfig, optsCfg *OptionsConfig, opts *Options, dimensionOverride string) {
-	configDim := optsCfg.Dimension
-
-	// Explicit dimension input override
-	if dimensionOverride != "" && dimensionOverride != configDim {
-		if isDimension(raw[dimensionOverride]) {
-			delete(raw, configDim)
-			optsCfg.Dimension = dimensionOverride
-			opts.FilterKey = dimensionOverride
-			return
-		}
-	}
-
-	// Auto-detect: single target value matching a dimension name
-	if len(opts.FilterValues) != 1 {
-		return
-	}
-	target := opts.FilterValues[0]
-
-	if !isDimension(raw[target]) {
-		return
-	}
-
-	// If it's also a value of the current dimension, treat as value filter
-	for _, v := range ExtractDimensionValues(raw, configDim) {
-		if v == target {
-			return
+// GroupBy groups matrix entries by the string value of the given key,
+// preserving entry order within each group. Entries without the key are
+// skipped.
+func GroupBy(entries []MatrixEntry, key string) map[string][]MatrixEntry {
+	groups := make(map[string][]MatrixEntry)
+	for _, entry := range entries {
+		if val, ok := entry[key]; ok {
+			s := FormatValue(val)
+			groups[s] = append(groups[s], entry)
 		}
 	}
-
-	// Switch dimensions
-	delete(raw, configDim)
-	optsCfg.Dimension = target
-	opts.FilterKey = target
-	opts.FilterValues = nil
+	return groups
 }
 
 // isDimension returns true if the value is a map or slice (i.e. a dimension).
@@ -2,9 +2,13 @@ package expander
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sort"
+	"strings"
 	"testing"
 )
 
@@ -53,6 +57,88 @@ func TestParseConfigFile_NonObjectConfig(t *testing.T) {
 	}
 }
 
+func TestParseConfigFile_NonObjectYAMLLocation(t *testing.T) {
+	tmp, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	_, _ = tmp.WriteString("# comment\n- a\n- b\n")
+	_ = tmp.Close()
+
+	_, err = ParseConfigFile(tmp.Name())
+	var errs ConfigErrors
+	if !errors.As(err, &errs) || len(errs) != 1 {
+		t.Fatalf("expected one ConfigError, got %v", err)
+	}
+	want := ConfigError{File: tmp.Name(), Line: 2, Column: 1, Msg: "configuration must be an object"}
+	if *errs[0] != want {
+		t.Errorf("expected %+v, got %+v", want, *errs[0])
+	}
+}
+
+func TestParseConfigFile_CollectsLocatedErrors(t *testing.T) {
+	tmp, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	_, _ = tmp.WriteString("settings:\n  sort_by: environment\n  omit_sensitive: \"yes\"\nexclude:\n  - service: a\n  - b\nservice: [a]\n")
+	_ = tmp.Close()
+
+	_, err = ParseConfigFile(tmp.Name())
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected ConfigErrors, got %v", err)
+	}
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Error("expected errors to match ErrInvalidConfig")
+	}
+
+	want := []ConfigError{
+		{File: tmp.Name(), Line: 2, Column: 12, Path: "settings.sort_by", Msg: "must be a list of strings"},
+		{File: tmp.Name(), Line: 3, Column: 19, Path: "settings.omit_sensitive", Msg: "must be true or false"},
+		{File: tmp.Name(), Line: 6, Column: 5, Path: "exclude[1]", Msg: "must be an object"},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("expected %d errors, got %v", len(want), errs)
+	}
+	for i := range want {
+		if *errs[i] != want[i] {
+			t.Errorf("error %d: expected %+v, got %+v", i, want[i], *errs[i])
+		}
+	}
+}
+
+func TestParseConfigFile_SyntaxErrorLocation(t *testing.T) {
+	tests := []struct {
+		ext, content string
+		line, column int
+	}{
+		{".json", "{\n  \"a\": 1,\n  \"b\":\n}\n", 4, 1},
+		{".json", "{\"a\": 1}\n  {\"b\": 2}\n", 2, 3},
+		{".yaml", "a: [1\nb: 2\n", 1, 0},
+	}
+	for _, tt := range tests {
+		tmp, err := os.CreateTemp("", "config-*"+tt.ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(tmp.Name())
+		_, _ = tmp.WriteString(tt.content)
+		_ = tmp.Close()
+
+		_, err = ParseConfigFile(tmp.Name())
+		var errs ConfigErrors
+		if !errors.As(err, &errs) || len(errs) != 1 {
+			t.Fatalf("%s: expected one ConfigError, got %v", tt.ext, err)
+		}
+		if errs[0].Line != tt.line || errs[0].Column != tt.column {
+			t.Errorf("%s: expected %d:%d, got %d:%d (%v)", tt.ext, tt.line, tt.column, errs[0].Line, errs[0].Column, errs[0])
+		}
+	}
+}
+
 func TestParseConfigFile_ValidJSON(t *testing.T) {
 	path := filepath.Join("..", "..", "testdata", "valid-list-config.json")
 	raw, err := ParseConfigFile(path)
@@ -983,6 +1069,217 @@ func TestParseOptions_SortBy(t *testing.T) {
 	}
 }
 
+func TestParseOptions_Sensitive(t *testing.T) {
+	raw := RawConfig{
+		"settings": map[string]any{
+			"sensitive": []any{"aws_account_id", "api_token"},
+		},
+		"service": []any{"api"},
+	}
+
+	optsCfg, _ := ParseOptions(raw)
+
+	if len(optsCfg.Sensitive) != 2 || optsCfg.Sensitive[0] != "aws_account_id" || optsCfg.Sensitive[1] != "api_token" {
+		t.Errorf("expected sensitive [aws_account_id api_token], got %v", optsCfg.Sensitive)
+	}
+}
+
+func TestParseConfigFile_SecretTag(t *testing.T) {
+	tmp, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	_, _ = tmp.WriteString(`settings:
+  sensitive: [api_token]
+environment:
+  dev:
+    aws_account_id: !secret "111111111111"
+service:
+  api:
+`)
+	_ = tmp.Close()
+
+	raw, err := ParseConfigFile(tmp.Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	optsCfg, dims := ParseOptions(raw)
+	if len(optsCfg.Sensitive) != 2 || optsCfg.Sensitive[0] != "api_token" || optsCfg.Sensitive[1] != "aws_account_id" {
+		t.Errorf("expected sensitive [api_token aws_account_id], got %v", optsCfg.Sensitive)
+	}
+
+	dev := dims["environment"].(map[string]any)["dev"].(map[string]any)
+	if dev["aws_account_id"] != "111111111111" {
+		t.Errorf("expected tagged value to decode as a plain string, got %v", dev["aws_account_id"])
+	}
+}
+
+func TestSensitiveConfigValues(t *testing.T) {
+	raw := RawConfig{
+		"global": map[string]any{"token": "g-token"},
+		"environment": map[string]any{
+			"dev":  map[string]any{"token": "dev-token", "region": "eu"},
+			"prod": map[string]any{"credentials": map[string]any{"user": "u", "pass": "p"}},
+		},
+		"include": []any{map[string]any{"token": "inc-token"}},
+	}
+
+	values := SensitiveConfigValues(raw, []string{"token", "credentials"})
+	want := map[string]bool{"g-token": true, "dev-token": true, "inc-token": true, "u": true, "p": true}
+	if len(values) != len(want) {
+		t.Fatalf("expected %d values, got %v", len(want), values)
+	}
+	for _, v := range values {
+		if !want[v] {
+			t.Errorf("unexpected sensitive value %q", v)
+		}
+	}
+}
+
+func TestSensitiveValues(t *testing.T) {
+	entries := []MatrixEntry{
+		{"environment": "dev", "aws_account_id": "111111111111"},
+		{"environment": "prod", "aws_account_id": "222222222222"},
+		{"environment": "staging", "aws_account_id": "111111111111"},
+	}
+
+	values := SensitiveValues(entries, []string{"aws_account_id", "missing"})
+	if len(values) != 2 || values[0] != "111111111111" || values[1] != "222222222222" {
+		t.Errorf("expected [111111111111 222222222222], got %v", values)
+	}
+}
+
+func TestExpand_FieldsProjection(t *testing.T) {
+	raw := RawConfig{
+		"environment": map[string]any{
+			"dev": map[string]any{"aws_account_id": "111", "aws_region": "eu", "timeout": "30"},
+		},
+		"service": map[string]any{
+			"api": map[string]any{"tags": map[string]any{"team": "core", "cost": "x"}},
+		},
+	}
+	optsCfg := OptionsConfig{Dimension: "service", BaseDir: "deploy"}
+	opts := Options{Fields: []string{"aws_*", "tags.team"}}
+
+	entries, err := Expand(raw, optsCfg, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entry := entries[0]
+
+	for _, k := range []string{"environment", "service", "aws_account_id", "aws_region", "tags"} {
+		if _, ok := entry[k]; !ok {
+			t.Errorf("expected field %q to be kept, got %v", k, entry)
+		}
+	}
+	for _, k := range []string{"timeout", "directory"} {
+		if _, ok := entry[k]; ok {
+			t.Errorf("expected field %q to be projected away, got %v", k, entry)
+		}
+	}
+	tags := entry["tags"].(map[string]any)
+	if len(tags) != 1 || tags["team"] != "core" {
+		t.Errorf("expected tags to contain only team, got %v", tags)
+	}
+}
+
+func TestExpand_OmitKeepsDimensionKeys(t *testing.T) {
+	raw := RawConfig{
+		"environment": map[string]any{
+			"dev": map[string]any{"aws_account_id": "111", "tags": map[string]any{"team": "core", "cost": "x"}},
+		},
+		"service": []any{"api"},
+	}
+	optsCfg := OptionsConfig{Dimension: "service", Omit: []string{"environment", "aws_*"}}
+	opts := Options{Omit: []string{"tags.c*", "environment"}}
+
+	entries, err := Expand(raw, optsCfg, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entry := entries[0]
+
+	if entry["environment"] != "dev" {
+		t.Errorf("expected dimension key environment to be kept, got %v", entry)
+	}
+	// Input omit replaces the settings omit, so aws_account_id stays.
+	if entry["aws_account_id"] != "111" {
+		t.Errorf("expected input omit to override settings omit, got %v", entry)
+	}
+	tags := entry["tags"].(map[string]any)
+	if _, ok := tags["cost"]; ok || tags["team"] != "core" {
+		t.Errorf("expected tags.cost omitted, got %v", tags)
+	}
+}
+
+func TestParseOptions_FieldsAndOmit(t *testing.T) {
+	raw := RawConfig{
+		"settings": map[string]any{
+			"fields": []any{"directory", "aws_*"},
+			"omit":   []any{"internal_*"},
+		},
+	}
+
+	optsCfg, _ := ParseOptions(raw)
+
+	if len(optsCfg.Fields) != 2 || optsCfg.Fields[1] != "aws_*" {
+		t.Errorf("expected fields [directory aws_*], got %v", optsCfg.Fields)
+	}
+	if len(optsCfg.Omit) != 1 || optsCfg.Omit[0] != "internal_*" {
+		t.Errorf("expected omit [internal_*], got %v", optsCfg.Omit)
+	}
+}
+
+func TestParseOptions_Profiles(t *testing.T) {
+	raw := RawConfig{
+		"profiles": map[string]any{
+			"lint": map[string]any{
+				"target":      "api, frontend",
+				"environment": []any{"dev"},
+				"exclude":     []any{map[string]any{"service": "legacy"}},
+				"sort_by":     []any{"service"},
+				"fields":      []any{"directory"},
+			},
+		},
+		"service": []any{"api"},
+	}
+
+	optsCfg, dims := ParseOptions(raw)
+
+	if _, ok := dims["profiles"]; ok {
+		t.Error("profiles should be reserved, not a dimension")
+	}
+	p, ok := optsCfg.Profiles["lint"]
+	if !ok {
+		t.Fatalf("expected lint profile, got %v", optsCfg.Profiles)
+	}
+	if len(p.Target) != 2 || p.Target[0] != "api" || p.Target[1] != "frontend" {
+		t.Errorf("expected target [api frontend], got %v", p.Target)
+	}
+	if len(p.Environment) != 1 || len(p.Exclude) != 1 || len(p.SortBy) != 1 || len(p.Fields) != 1 {
+		t.Errorf("unexpected profile %+v", p)
+	}
+}
+
+func TestExpand_OptionsSortByOverridesSettings(t *testing.T) {
+	raw := RawConfig{
+		"environment": []any{"dev", "prod"},
+		"service":     []any{"frontend", "api"},
+	}
+	optsCfg := OptionsConfig{Dimension: "service", SortBy: []string{"environment"}}
+	opts := Options{SortBy: []string{"service", "environment"}}
+
+	entries, err := Expand(raw, optsCfg, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entries[0]["service"] != "api" || entries[1]["service"] != "api" {
+		t.Errorf("expected entries sorted by service first, got %v", entries)
+	}
+}
+
 func TestUniqueValues(t *testing.T) {
 	entries := []MatrixEntry{
 		{"service": "api", "environment": "dev"},
@@ -1032,6 +1329,26 @@ func TestUniqueValues_PreservesOrder(t *testing.T) {
 	}
 }
 
+func TestGroupBy(t *testing.T) {
+	entries := []MatrixEntry{
+		{"service": "api", "environment": "dev"},
+		{"service": "frontend", "environment": "dev"},
+		{"service": "api", "environment": "prod"},
+		{"service": "shared"},
+	}
+
+	groups := GroupBy(entries, "environment")
+	if len(groups) != 2 {
+		t.Fatalf("expected 2 groups, got %v", groups)
+	}
+	if len(groups["dev"]) != 2 || groups["dev"][0]["service"] != "api" || groups["dev"][1]["service"] != "frontend" {
+		t.Errorf("unexpected dev group %v", groups["dev"])
+	}
+	if len(groups["prod"]) != 1 {
+		t.Errorf("unexpected prod group %v", groups["prod"])
+	}
+}
+
 func TestFilterChanged_WithBaseDir(t *testing.T) {
 	files := []string{
 		"deploy/infra/waf.tf",
@@ -1109,6 +1426,174 @@ func TestFilterChanged_MultipleFilesInSameValue(t *testing.T) {
 	}
 }
 
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"**/*.md", "README.md", true},
+		{"**/*.md", "deploy/api/README.md", true},
+		{"*.md", "deploy/api/README.md", false},
+		{"docs/**", "docs/a/b.txt", true},
+		{"docs/", "docs/a.txt", true},
+		{"docs/", "docs", false},
+		{"deploy/*/docs/**", "deploy/api/docs/x.md", true},
+		{"deploy/*/docs/**", "deploy/api/v1/docs/x.md", false},
+		{"deploy/**/test_*.py", "deploy/api/src/test_app.py", true},
+		{"[docs", "[docs", false},
+	}
+	for _, tt := range tests {
+		if got := MatchGlob(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("MatchGlob(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIgnoreChanged(t *testing.T) {
+	files := []string{"deploy/api/main.tf", "deploy/api/docs/a.md", "deploy/web/docs/b.md", "CHANGELOG.md"}
+	kept, ignored := IgnoreChanged(files, "deploy", []string{"*.md"}, map[string][]string{"api": {"docs/**"}})
+	if want := []string{"deploy/api/main.tf", "deploy/web/docs/b.md"}; !reflect.DeepEqual(kept, want) {
+		t.Errorf("expected kept %v, got %v", want, kept)
+	}
+	if want := []string{"deploy/api/docs/a.md", "CHANGELOG.md"}; !reflect.DeepEqual(ignored, want) {
+		t.Errorf("expected ignored %v, got %v", want, ignored)
+	}
+}
+
+func TestChangedValuesWithDeps(t *testing.T) {
+	deps := map[string][]string{
+		"deploy/api":  {"libs/auth", "deploy/core"},
+		"deploy/core": {"modules/vpc"},
+		"modules/vpc": {"deploy/api"}, // cycles are fine
+	}
+	var calls []string
+	lookup := func(dir string) []string {
+		calls = append(calls, dir)
+		return deps[dir]
+	}
+
+	reasons := ChangedValuesWithDeps([]string{"modules/vpc/main.tf", "deploy/web/app.ts"}, "deploy", []string{"api", "core", "web", "batch"}, lookup)
+	want := map[string]ChangeReason{
+		"api":  {File: "modules/vpc/main.tf", Via: []string{"deploy/core", "modules/vpc"}},
+		"core": {File: "modules/vpc/main.tf", Via: []string{"modules/vpc"}},
+		"web":  {File: "deploy/web/app.ts"},
+	}
+	if !reflect.DeepEqual(reasons, want) {
+		t.Errorf("expected %v, got %v", want, reasons)
+	}
+	seen := make(map[string]bool)
+	for _, dir := range calls {
+		if seen[dir] {
+			t.Errorf("deps called twice for %s", dir)
+		}
+		seen[dir] = true
+	}
+	if got := want["api"].String(); got != "modules/vpc/main.tf (via deploy/core -> modules/vpc)" {
+		t.Errorf("unexpected reason string %q", got)
+	}
+}
+
+func TestDiscoverDependencies(t *testing.T) {
+	root := t.TempDir()
+	write := func(name, content string) {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("deploy/api/go.mod", `module example.com/api
+
+require example.com/auth v0.0.0
+
+replace example.com/auth => ../../libs/auth // local copy
+replace (
+	example.com/log v1.2.0 => ../../libs/log
+	example.com/x => example.com/y v1.0.0
+	example.com/outside => ../../../elsewhere
+)
+`)
+	write("deploy/api/main.tf", `module "vpc" {
+  source = "../../modules/vpc"
+}
+
+module "remote" {
+  source = "terraform-aws-modules/vpc/aws"
+}
+`)
+
+	got := DiscoverDependencies(root, "deploy/api")
+	want := []string{"libs/auth", "libs/log", "modules/vpc"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if got := DiscoverDependencies(root, "deploy/missing"); got != nil {
+		t.Errorf("expected no dependencies for a missing directory, got %v", got)
+	}
+}
+
+func TestExpand_StripsValueKeys(t *testing.T) {
+	raw := RawConfig{
+		"service": map[string]any{
+			"api": map[string]any{"port": 8080, "uses": []any{"libs/auth"}, "ignore_paths": []any{"docs/"}},
+		},
+	}
+	optsCfg, dims := ParseOptions(raw)
+	optsCfg.Dimension = "service"
+	entries, err := Expand(dims, optsCfg, Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := (MatrixEntry{"service": "api", "port": 8080, "directory": "api"}); !reflect.DeepEqual(entries[0], want) {
+		t.Errorf("expected %v, got %v", want, entries[0])
+	}
+}
+
+func TestExpand_ChangeDetectionKeysOutsidePrimaryAreFields(t *testing.T) {
+	tmp, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	_, _ = tmp.WriteString("service:\n  api:\n    ignore_paths: [docs/]\n    uses: [libs/auth]\nenvironment:\n  dev:\n    ignore_paths: none\n    uses: shared\n")
+	_ = tmp.Close()
+
+	raw, err := ParseConfigFile(tmp.Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	optsCfg, dims := ParseOptions(raw)
+	optsCfg.Dimension = "service"
+	entries, err := Expand(dims, optsCfg, Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := (MatrixEntry{"service": "api", "environment": "dev", "ignore_paths": "none", "uses": "shared", "directory": "api"}); !reflect.DeepEqual(entries[0], want) {
+		t.Errorf("expected %v, got %v", want, entries[0])
+	}
+}
+
+func TestParseConfigFile_InvalidIgnorePaths(t *testing.T) {
+	tmp, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	_, _ = tmp.WriteString("settings:\n  ignore_paths: [\"[docs\"]\nservice:\n  api:\n    ignore_paths: docs/\n")
+	_ = tmp.Close()
+
+	_, err = ParseConfigFile(tmp.Name())
+	var errs ConfigErrors
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %v", err)
+	}
+	if errs[0].Path != "settings.ignore_paths[0]" || errs[1].Path != "service.api.ignore_paths" {
+		t.Errorf("unexpected errors %v", errs)
+	}
+}
+
 func TestExtractDimensionValues_ArrayPresent(t *testing.T) {
 	raw := RawConfig{
 		"service": []any{"api", "infra"},
@@ -1333,3 +1818,1122 @@ func TestResolveTarget_ArrayDimension(t *testing.T) {
 		t.Error("service dimension should have been removed")
 	}
 }
+
+func TestParseOptions_LegacyKeys(t *testing.T) {
+	raw := RawConfig{
+		"global": map[string]any{
+			"dimension_key": "app",
+			"base_dir":      "deploy",
+			"sort_by":       []any{"app"},
+			"region":        "eu-west-1",
+		},
+		"settings": map[string]any{"base_dir": "stacks"},
+		"app":      []any{"a"},
+	}
+	optsCfg, _ := ParseOptions(raw)
+	if optsCfg.Dimension != "app" || optsCfg.BaseDir != "stacks" || !reflect.DeepEqual(optsCfg.SortBy, []string{"app"}) {
+		t.Errorf("unexpected settings %q %q %v", optsCfg.Dimension, optsCfg.BaseDir, optsCfg.SortBy)
+	}
+	if !reflect.DeepEqual(optsCfg.GlobalConfig, map[string]any{"region": "eu-west-1"}) {
+		t.Errorf("expected legacy keys to be removed from global, got %v", optsCfg.GlobalConfig)
+	}
+	if len(optsCfg.Warnings) != 3 {
+		t.Errorf("expected 3 warnings, got %v", optsCfg.Warnings)
+	}
+}
+
+func TestParseOptions_LegacyDimensionPrecedence(t *testing.T) {
+	raw := RawConfig{
+		"global":   map[string]any{"dimension_key": "app"},
+		"settings": map[string]any{"dimension_key": "stack"},
+		"app":      []any{"a"},
+		"stack":    []any{"s"},
+	}
+	optsCfg, _ := ParseOptions(raw)
+	if optsCfg.Dimension != "stack" {
+		t.Errorf("expected settings.dimension_key to win, got %q", optsCfg.Dimension)
+	}
+	if len(optsCfg.Warnings) != 2 || !strings.Contains(optsCfg.Warnings[1], "ignored because settings.dimension_key is set") {
+		t.Errorf("unexpected warnings %v", optsCfg.Warnings)
+	}
+
+	// Migrate keeps the same one.
+	out, _, err := Migrate([]byte("global:\n  dimension_key: app\nsettings:\n  dimension_key: stack\napp: [a]\nstack: [s]\n"), ".yaml")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(string(out), "dimension: stack") || strings.Contains(string(out), "dimension: app") {
+		t.Errorf("expected settings.dimension stack, got:\n%s", out)
+	}
+}
+
+func TestMigrate_YAML(t *testing.T) {
+	in := `# Deployment matrix
+global:
+  # primary dimension
+  dimension_key: service
+  base_dir: deploy # where stacks live
+environment:
+  dev:
+    aws_account_id: "111111111111"
+service:
+  - api
+`
+	want := `# Deployment matrix
+settings:
+  # primary dimension
+  dimension: service
+  base_dir: deploy # where stacks live
+environment:
+  dev:
+    aws_account_id: "111111111111"
+service:
+  - api
+`
+	out, changes, err := Migrate([]byte(in), ".yaml")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(out) != want {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+	if len(changes) != 3 {
+		t.Errorf("expected 3 changes, got %v", changes)
+	}
+
+	// Migrating again changes nothing.
+	again, changes, err := Migrate(out, ".yaml")
+	if err != nil || changes != nil || string(again) != string(out) {
+		t.Errorf("expected no further changes, got %v, %v", changes, err)
+	}
+}
+
+func TestMigrate_ServiceFallback(t *testing.T) {
+	out, changes, err := Migrate([]byte("settings: {base_dir: deploy}\nservice: [api]\n"), ".yml")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "settings:\n  dimension: service\n  base_dir: deploy\nservice: [api]\n"; string(out) != want {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+	if len(changes) != 1 {
+		t.Errorf("expected 1 change, got %v", changes)
+	}
+}
+
+func TestMigrate_JSON(t *testing.T) {
+	in := `{"global": {"dimension_key": "app", "port": 8080, "debug": false}, "app": ["a", "b"]}`
+	out, _, err := Migrate([]byte(in), ".json")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `{
+  "settings": {
+    "dimension": "app"
+  },
+  "global": {
+    "port": 8080,
+    "debug": false
+  },
+  "app": [
+    "a",
+    "b"
+  ]
+}
+`
+	if string(out) != want {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
+
+func TestParseConfigFile_KeepsValuesAsWritten(t *testing.T) {
+	tmp, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	_, _ = tmp.WriteString(`settings:
+  dimension: account
+account:
+  111111111111: &defaults
+    created: 2024-01-02
+    ratio: 1.50
+    mode: 0x1F
+  222222222222:
+    <<: *defaults
+    enabled: true
+`)
+	_ = tmp.Close()
+
+	raw, err := ParseConfigFile(tmp.Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	optsCfg, dims := ParseOptions(raw)
+	entries, err := Expand(dims, optsCfg, Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := MatrixEntry{
+		"account":   "222222222222",
+		"directory": "222222222222",
+		"created":   "2024-01-02",
+		"ratio":     json.Number("1.50"),
+		"mode":      json.Number("31"),
+		"enabled":   true,
+	}
+	if len(entries) != 2 || !reflect.DeepEqual(entries[1], want) {
+		t.Errorf("expected %v, got %v", want, entries)
+	}
+}
+
+func TestParseConfigFile_JSONNumbers(t *testing.T) {
+	tmp, err := os.CreateTemp("", "config-*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	_, _ = tmp.WriteString(`{"global": {"aws_account_id": 111111111111, "ratio": 1.50}, "service": ["api"]}`)
+	_ = tmp.Close()
+
+	raw, err := ParseConfigFile(tmp.Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	global := raw["global"].(map[string]any)
+	if global["aws_account_id"] != json.Number("111111111111") || global["ratio"] != json.Number("1.50") {
+		t.Errorf("expected numbers as written, got %v", global)
+	}
+}
+
+func TestFilter_LargeInteger(t *testing.T) {
+	raw := RawConfig{
+		"service": map[string]any{
+			"api": map[string]any{"aws_account_id": json.Number("111111111111")},
+			"web": map[string]any{"aws_account_id": json.Number("222222222222")},
+		},
+	}
+	optsCfg, dims := ParseOptions(raw)
+	entries, err := Expand(dims, optsCfg, Options{FilterKey: "aws_account_id", FilterValues: []string{"111111111111"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(entries) != 1 || entries[0]["service"] != "api" {
+		t.Errorf("expected only api, got %v", entries)
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	tests := []struct {
+		in   any
+		want string
+	}{
+		{nil, ""},
+		{"eu-west-1", "eu-west-1"},
+		{json.Number("111111111111"), "111111111111"},
+		{true, "true"},
+		{float64(111111111111), "111111111111"},
+		{[]any{"a", json.Number("1")}, `["a",1]`},
+		{map[string]any{"k": "v"}, `{"k":"v"}`},
+	}
+	for _, tt := range tests {
+		if got := FormatValue(tt.in); got != tt.want {
+			t.Errorf("FormatValue(%#v) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseOptions_LargeNumberWarning(t *testing.T) {
+	raw := RawConfig{
+		"settings": map[string]any{"dimension": "service"},
+		"global":   map[string]any{"id": json.Number("9007199254740993"), "small": json.Number("111111111111")},
+		"service":  []any{"api"},
+	}
+	optsCfg, _ := ParseOptions(raw)
+	if len(optsCfg.Warnings) != 1 || !strings.HasPrefix(optsCfg.Warnings[0], "global.id: ") {
+		t.Errorf("expected a warning for global.id, got %v", optsCfg.Warnings)
+	}
+}
+
+func TestDiscoverValues(t *testing.T) {
+	root := t.TempDir()
+	for _, d := range []string{"stacks/dev/api", "stacks/dev/web", "stacks/prod/api", ".git/stacks"} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.FromSlash(d)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	raw := RawConfig{
+		"stack":   map[string]any{"discover": "stacks/*/*", "prod/api": map[string]any{"size": "large"}},
+		"missing": map[string]any{"discover": "nowhere/*"},
+		"region":  []any{"eu"},
+	}
+	prefixes, err := DiscoverValues(raw, root)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string]any{"dev/api": nil, "dev/web": nil, "prod/api": map[string]any{"size": "large"}}
+	if !reflect.DeepEqual(raw["stack"], want) {
+		t.Errorf("expected %v, got %v", want, raw["stack"])
+	}
+	if m := raw["missing"].(map[string]any); len(m) != 0 {
+		t.Errorf("expected no values, got %v", m)
+	}
+	if prefixes["stack"] != "stacks" || prefixes["missing"] != "nowhere" {
+		t.Errorf("unexpected prefixes %v", prefixes)
+	}
+}
+
+func TestParseConfigFile_InvalidDiscover(t *testing.T) {
+	tmp, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	_, _ = tmp.WriteString("service:\n  discover: \"deploy/[\"\n  marker: [main.tf]\n")
+	_ = tmp.Close()
+
+	_, err = ParseConfigFile(tmp.Name())
+	var errs ConfigErrors
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %v", err)
+	}
+	if errs[0].Path != "service.discover" || errs[1].Path != "service.marker" {
+		t.Errorf("unexpected errors %v", errs)
+	}
+}
+
+func TestLoadFragments(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"deploy/api/.matrix.yaml": "replicas: 3\n",
+		"deploy/web/.matrix.yaml": "replicas: 1\naws_account_id: \"999\"\n",
+	}
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	raw := RawConfig{
+		"settings": map[string]any{"dimension": "service", "base_dir": "deploy", "fragment_keys": []any{"replicas"}},
+		"global":   map[string]any{"aws_account_id": "111"},
+		"service":  map[string]any{"api": map[string]any{"replicas": json.Number("2")}, "worker": nil},
+	}
+	optsCfg, dims := ParseOptions(raw)
+	if err := LoadFragments(dims, &optsCfg, root); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries, err := Expand(dims, optsCfg, Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entries[0]["replicas"] != json.Number("3") {
+		t.Errorf("expected the fragment to override the config, got %v", entries[0])
+	}
+	if src := Provenance(dims, optsCfg, entries[0], nil)["replicas"]; src != "deploy/api/.matrix.yaml" {
+		t.Errorf("expected the fragment as source, got %q", src)
+	}
+
+	dims["service"].(map[string]any)["web"] = nil
+	err = LoadFragments(dims, &optsCfg, root)
+	var errs ConfigErrors
+	if !errors.As(err, &errs) || len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %v", err)
+	}
+	if errs[0].File != "deploy/web/.matrix.yaml" || errs[0].Path != "aws_account_id" || errs[0].Line != 2 {
+		t.Errorf("unexpected error %v", errs[0])
+	}
+}
+
+func TestLoadFragments_SecretsAndReservedKeys(t *testing.T) {
+	root := t.TempDir()
+	write := func(name, content string) {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("deploy/api/.matrix.yaml", "token: !secret 12345678\n")
+	raw := RawConfig{
+		"settings": map[string]any{"dimension": "service", "base_dir": "deploy", "fragment_keys": []any{"token", "uses"}},
+		"service":  []any{"api"},
+	}
+	optsCfg, dims := ParseOptions(raw)
+	if err := LoadFragments(dims, &optsCfg, root); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(optsCfg.Sensitive, []string{"token"}) {
+		t.Errorf("expected token to be sensitive, got %v", optsCfg.Sensitive)
+	}
+	if got := optsCfg.Fragments["api"].Config["token"]; got != json.Number("12345678") {
+		t.Errorf("expected the untagged value, got %#v", got)
+	}
+	if got := SensitiveFragmentValues(optsCfg.Fragments, optsCfg.Sensitive); !reflect.DeepEqual(got, []string{"12345678"}) {
+		t.Errorf("unexpected sensitive values %v", got)
+	}
+
+	// Keys that configure the action are rejected, even when listed.
+	write("deploy/api/.matrix.yaml", "uses: [libs/auth]\nignore_paths: [docs/]\n")
+	optsCfg, dims = ParseOptions(raw)
+	err := LoadFragments(dims, &optsCfg, root)
+	var errs ConfigErrors
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %v", err)
+	}
+	if errs[0].Path != "ignore_paths" || errs[1].Path != "uses" || !strings.Contains(errs[1].Msg, "configures the action") {
+		t.Errorf("unexpected errors %v", errs)
+	}
+}
+
+func TestLoadFragments_ExcessiveAliasing(t *testing.T) {
+	root := t.TempDir()
+	var sb strings.Builder
+	sb.WriteString("a: &a [x, x, x, x, x, x, x, x, x, x]\n")
+	for i := 'b'; i <= 'h'; i++ {
+		fmt.Fprintf(&sb, "%c: &%c [*%c, *%c, *%c, *%c, *%c, *%c, *%c, *%c, *%c, *%c]\n", i, i, i-1, i-1, i-1, i-1, i-1, i-1, i-1, i-1, i-1, i-1)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "api"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "api", ".matrix.yaml"), []byte(sb.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	raw := RawConfig{
+		"settings": map[string]any{"dimension": "service", "fragment_keys": []any{"h"}},
+		"service":  []any{"api"},
+	}
+	optsCfg, dims := ParseOptions(raw)
+	err := LoadFragments(dims, &optsCfg, root)
+	var errs ConfigErrors
+	if !errors.As(err, &errs) || !strings.Contains(err.Error(), "excessive aliasing") {
+		t.Errorf("expected excessive aliasing to be rejected, got %v", err)
+	}
+}
+
+func TestExpr(t *testing.T) {
+	scope := exprScope{
+		entry: map[string]any{
+			"environment":    "prod",
+			"aws_account_id": json.Number("222222222222"),
+			"id":             json.Number("222222222222222222"),
+			"replicas":       "3",
+			"approval":       true,
+			"tags":           map[string]any{"team": "core"},
+			"regions":        []any{"eu-west-1", "us-east-1"},
+		},
+		event:  map[string]any{"name": "pull_request"},
+		length: 4,
+	}
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{`environment == "prod"`, true},
+		{`environment != 'prod'`, false},
+		{`aws_account_id == 222222222222`, true},
+		{`aws_account_id == "222222222222"`, true},
+		{`id == 222222222222222222`, true},
+		{`id != 222222222222222223`, true},
+		{`id < 222222222222222223 && id > 222222222222222221`, true},
+		{`id == "222222222222222223"`, false},
+		{`replicas >= 2 && replicas < 10`, true},
+		{`approval`, true},
+		{`!approval || missing`, false},
+		{`missing == null`, true},
+		{`missing == ""`, false},
+		{`tags.team in ["core", "infra"]`, true},
+		{`"eu-west-1" in regions`, true},
+		{`contains(regions, "ap-south-1")`, false},
+		{`startsWith(environment, "pr") && endsWith(environment, "od")`, true},
+		{`matches(event.name, "pull_*")`, true},
+		{`len(regions) == 2 && length > 3`, true},
+		{`(environment == "dev" || environment == "prod") && !(event.name == "push")`, true},
+		{`entry.environment == environment`, true},
+	}
+	for _, tt := range tests {
+		e, err := compileExpr(tt.src)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.src, err)
+			continue
+		}
+		v, err := e.eval(scope)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.src, err)
+			continue
+		}
+		if truthy(v) != tt.want {
+			t.Errorf("%s = %v, want %v", tt.src, v, tt.want)
+		}
+	}
+}
+
+func TestCompileExpr_Errors(t *testing.T) {
+	for _, src := range []string{``, `a ==`, `"open`, `a = b`, `foo(a)`, `len(a, b)`, `(a`, `a b`} {
+		if _, err := compileExpr(src); err == nil {
+			t.Errorf("%q: expected an error", src)
+		}
+	}
+}
+
+func TestCheckRules(t *testing.T) {
+	rules := parseRules([]any{
+		map[string]any{"name": "approval", "when": `environment == "prod"`, "assert": "approval == true", "message": "prod needs approval"},
+		map[string]any{"assert": "length <= 1", "scope": "matrix", "severity": "warn"},
+		map[string]any{"name": "bad", "assert": `region in 5`},
+	})
+	entries := []MatrixEntry{
+		{"environment": "dev", "service": "api"},
+		{"environment": "prod", "service": "api", "approval": true},
+		{"environment": "prod", "service": "web"},
+	}
+	got := CheckRules(rules, entries, []string{"service", "environment"}, nil, len(entries))
+	want := []Violation{
+		{Rule: "approval", Severity: SeverityError, Message: "prod needs approval", Entry: "environment=prod, service=web"},
+		{Rule: "rules[1]", Severity: SeverityWarn, Message: "assertion failed: length <= 1"},
+		{Rule: "bad", Severity: SeverityError, Message: `evaluation failed: "in" needs a list or an object on the right`, Entry: "environment=dev, service=api"},
+		{Rule: "bad", Severity: SeverityError, Message: `evaluation failed: "in" needs a list or an object on the right`, Entry: "environment=prod, service=api"},
+		{Rule: "bad", Severity: SeverityError, Message: `evaluation failed: "in" needs a list or an object on the right`, Entry: "environment=prod, service=web"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestParseConfigFile_InvalidRules(t *testing.T) {
+	tmp, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	_, _ = tmp.WriteString(`rules:
+  - assert: environment ==
+    severity: fatal
+  - when: true
+    level: high
+service: [api]
+`)
+	_ = tmp.Close()
+
+	_, err = ParseConfigFile(tmp.Name())
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected ConfigErrors, got %v", err)
+	}
+	var paths []string
+	for _, e := range errs {
+		paths = append(paths, e.Path)
+	}
+	want := []string{"rules[0].assert", "rules[0].severity", "rules[1].level", "rules[1]", "rules[1].when"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("expected errors at %v, got %v", want, errs)
+	}
+}
+
+func TestExpand_RequiredFieldsAndTypes(t *testing.T) {
+	raw := RawConfig{
+		"settings": map[string]any{
+			"required_fields": []any{"aws_account_id"},
+			"field_types": map[string]any{
+				"replicas":       "int",
+				"tier":           map[string]any{"enum": []any{"gold", "silver"}},
+				"aws_account_id": map[string]any{"type": "string", "pattern": "^[0-9]{12}$"},
+			},
+		},
+		"environment": map[string]any{
+			"dev":  map[string]any{"aws_account_id": "111111111111"},
+			"prod": map[string]any{"aws_account_id": nil, "required_fields": []any{"approval"}},
+		},
+		"service": map[string]any{
+			"api": map[string]any{"replicas": json.Number("2"), "tier": "gold"},
+			"web": map[string]any{"replicas": "2", "tier": "bronze"},
+		},
+	}
+	optsCfg, dims := ParseOptions(raw)
+
+	_, err := Expand(dims, optsCfg, Options{FilterKey: "service", FilterValues: []string{"api"}, EnvironmentFilter: []string{"dev"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = Expand(dims, optsCfg, Options{})
+	var errs FieldErrors
+	if !errors.As(err, &errs) || !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("expected FieldErrors, got %v", err)
+	}
+	var got []string
+	for _, e := range errs {
+		got = append(got, e.Error())
+	}
+	want := []string{
+		"environment=dev, service=web: replicas: must be of type int, got string",
+		`environment=dev, service=web: tier: "bronze" is not one of gold, silver`,
+		"environment=prod, service=api: aws_account_id: required field is missing",
+		"environment=prod, service=api: approval: required field is missing",
+		"environment=prod, service=web: aws_account_id: required field is missing",
+		"environment=prod, service=web: approval: required field is missing",
+		"environment=prod, service=web: replicas: must be of type int, got string",
+		`environment=prod, service=web: tier: "bronze" is not one of gold, silver`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestParseConfigFile_InvalidFieldTypes(t *testing.T) {
+	tmp, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	_, _ = tmp.WriteString(`settings:
+  required_fields: aws_account_id
+  field_types:
+    a: integer
+    b: {pattern: "[", enum: x, min: 1}
+service:
+  api:
+    required_fields: [1]
+`)
+	_ = tmp.Close()
+
+	_, err = ParseConfigFile(tmp.Name())
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected ConfigErrors, got %v", err)
+	}
+	var paths []string
+	for _, e := range errs {
+		paths = append(paths, e.Path)
+	}
+	want := []string{"settings.required_fields", "settings.field_types.a", "settings.field_types.b.enum", "settings.field_types.b.min", "settings.field_types.b.pattern", "service.api.required_fields[0]"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("expected errors at %v, got %v", want, errs)
+	}
+}
+
+func TestExpand_OnlyExceptEnabled(t *testing.T) {
+	raw := RawConfig{
+		"environment": []any{"dev", "staging", "prod"},
+		"service": map[string]any{
+			"api":    nil,
+			"batch":  map[string]any{"only": map[string]any{"environment": []any{"prod", "staging"}}, "team": "data"},
+			"web":    map[string]any{"except": map[string]any{"environment": "dev"}},
+			"legacy": map[string]any{"enabled": false, "disabled_reason": "replaced by api"},
+		},
+	}
+	optsCfg, dims := ParseOptions(raw)
+	entries, err := Expand(dims, optsCfg, Options{SortBy: []string{"service", "environment"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e["service"].(string)+"/"+e["environment"].(string))
+		if _, ok := e["only"]; ok {
+			t.Errorf("expected only to be stripped, got %v", e)
+		}
+	}
+	want := []string{"api/dev", "api/prod", "api/staging", "batch/prod", "batch/staging", "web/prod", "web/staging"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	disabled := DisabledValues(dims)
+	if len(disabled) != 1 || disabled[0] != (DisabledValue{Dimension: "service", Value: "legacy", Reason: "replaced by api"}) {
+		t.Errorf("unexpected disabled values %v", disabled)
+	}
+}
+
+func TestParseConfigFile_InvalidOnlyExcept(t *testing.T) {
+	tmp, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	_, _ = tmp.WriteString(`environment: [dev, prod]
+service:
+  batch:
+    only: {region: [eu]}
+    except: [dev]
+    enabled: "no"
+`)
+	_ = tmp.Close()
+
+	_, err = ParseConfigFile(tmp.Name())
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected ConfigErrors, got %v", err)
+	}
+	var paths []string
+	for _, e := range errs {
+		paths = append(paths, e.Path)
+	}
+	want := []string{"service.batch.only.region"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("expected errors at %v, got %v", want, errs)
+	}
+}
+
+func TestExpand_FilterKeysAsFields(t *testing.T) {
+	raw := RawConfig{
+		"environment": []any{"dev", "prod"},
+		"service": map[string]any{
+			"api":   map[string]any{"only": "prod", "except": []any{"dev"}, "enabled": true},
+			"batch": map[string]any{"enabled": "yes", "disabled_reason": "none"},
+		},
+	}
+	optsCfg, dims := ParseOptions(raw)
+	want := []string{
+		"service.api.only is not a map of dimension names to values and stays a matrix field; rename the field if it is not meant as a filter",
+		"service.api.except is not a map of dimension names to values and stays a matrix field; rename the field if it is not meant as a filter",
+		"service.batch.enabled is not true or false and stays a matrix field; rename the field if it is not meant as a filter",
+		"service.batch.disabled_reason is not a string next to enabled: false and stays a matrix field; rename the field if it is not meant as a filter",
+	}
+	if !reflect.DeepEqual(optsCfg.Warnings, want) {
+		t.Errorf("expected warnings %v, got %v", want, optsCfg.Warnings)
+	}
+
+	entries, err := Expand(dims, optsCfg, Options{SortBy: []string{"service", "environment"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("expected every combination, got %v", entries)
+	}
+	if e := entries[0]; e["only"] != "prod" || !reflect.DeepEqual(e["except"], []any{"dev"}) || e["enabled"] != true {
+		t.Errorf("expected the keys to stay fields, got %v", e)
+	}
+	if e := entries[2]; e["enabled"] != "yes" || e["disabled_reason"] != "none" {
+		t.Errorf("expected the keys to stay fields, got %v", e)
+	}
+}
+
+func TestDisabledTargets(t *testing.T) {
+	disabled := []DisabledValue{{Dimension: "service", Value: "legacy", Reason: "replaced by api"}, {Dimension: "environment", Value: "api"}}
+
+	warnings, err := DisabledTargets("service", []string{"api", "legacy"}, disabled)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"target selects service legacy (replaced by api), which is disabled"}; !reflect.DeepEqual(warnings, want) {
+		t.Errorf("expected %v, got %v", want, warnings)
+	}
+
+	_, err = DisabledTargets("service", []string{"legacy"}, disabled)
+	if !errors.Is(err, ErrInvalidTarget) || !strings.Contains(err.Error(), "only disabled service values: legacy (replaced by api)") {
+		t.Errorf("expected ErrInvalidTarget, got %v", err)
+	}
+}
+
+func TestExpand_ObjectListDimension(t *testing.T) {
+	raw := RawConfig{
+		"settings": map[string]any{"dimension": "service", "base_dir": "deploy", "identity_key": "id"},
+		"service": []any{
+			map[string]any{"id": "api", "port": json.Number("8080")},
+			map[string]any{"id": "web", "port": json.Number("3000"), "uses": []any{"libs/ui"}},
+			"worker",
+		},
+	}
+	optsCfg, dims := ParseOptions(raw)
+	if got := ExtractDimensionValues(dims, "service"); !reflect.DeepEqual(got, []string{"api", "web", "worker"}) {
+		t.Errorf("unexpected values %v", got)
+	}
+	entries, err := Expand(dims, optsCfg, Options{FilterKey: "service", FilterValues: []string{"web"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []MatrixEntry{{"service": "web", "port": json.Number("3000"), "directory": "deploy/web"}}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("expected %v, got %v", want, entries)
+	}
+	if got := FilterChanged([]string{"deploy/api/main.go"}, optsCfg.BaseDir, ExtractDimensionValues(dims, "service")); !reflect.DeepEqual(got, []string{"api"}) {
+		t.Errorf("unexpected changed values %v", got)
+	}
+}
+
+func TestParseConfigFile_InvalidObjectList(t *testing.T) {
+	tmp, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	_, _ = tmp.WriteString("service:\n  - name: api\n  - port: 1\n  - name: api\n  - name: [x]\n")
+	_ = tmp.Close()
+
+	_, err = ParseConfigFile(tmp.Name())
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected ConfigErrors, got %v", err)
+	}
+	var paths []string
+	for _, e := range errs {
+		paths = append(paths, e.Path)
+	}
+	want := []string{"service[1]", "service[2].name", "service[3].name"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("expected errors at %v, got %v", want, errs)
+	}
+}
+
+func TestExpand_ObjectListOrder(t *testing.T) {
+	raw := RawConfig{
+		"service":     []any{map[string]any{"name": "web"}, "worker", map[string]any{"name": "api", "port": json.Number("8080")}},
+		"environment": []any{"dev"},
+	}
+	optsCfg, dims := ParseOptions(raw)
+	if got := ExtractDimensionValues(dims, "service"); !reflect.DeepEqual(got, []string{"web", "worker", "api"}) {
+		t.Errorf("expected the list order, got %v", got)
+	}
+	entries, err := Expand(dims, optsCfg, Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e["service"].(string))
+	}
+	if !reflect.DeepEqual(got, []string{"web", "worker", "api"}) {
+		t.Errorf("expected entries in list order, got %v", got)
+	}
+}
+
+func TestParseConfigFile_ObjectListErrorLocations(t *testing.T) {
+	tmp, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	_, _ = tmp.WriteString("environment: [dev]\nservice:\n  - name: web\n  - name: api\n    required_fields: [1]\n    only: {region: eu}\n")
+	_ = tmp.Close()
+
+	_, err = ParseConfigFile(tmp.Name())
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected ConfigErrors, got %v", err)
+	}
+	var got []string
+	for _, e := range errs {
+		got = append(got, fmt.Sprintf("%s:%d", e.Path, e.Line))
+	}
+	want := []string{"service[1].required_fields[0]:5", "service[1].only.region:6"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected errors at %v, got %v", want, errs)
+	}
+}
+
+func TestResolveTarget_DimensionPrefix(t *testing.T) {
+	raw := RawConfig{
+		"service":   map[string]any{"api": nil},
+		"terraform": map[string]any{"infra": nil, "dns": nil},
+	}
+	optsCfg := OptionsConfig{Dimension: "service"}
+	opts := Options{FilterKey: "service", FilterValues: []string{"terraform:infra", "dns"}}
+
+	warnings, err := ResolveTarget(raw, &optsCfg, &opts, "")
+	if err != nil || len(warnings) != 0 {
+		t.Fatalf("unexpected result %v, %v", warnings, err)
+	}
+	if optsCfg.Dimension != "terraform" || opts.FilterKey != "terraform" {
+		t.Errorf("expected dimension terraform, got %q", optsCfg.Dimension)
+	}
+	if !reflect.DeepEqual(opts.FilterValues, []string{"infra", "dns"}) {
+		t.Errorf("unexpected filter values %v", opts.FilterValues)
+	}
+
+	opts = Options{FilterValues: []string{"terraform:*"}}
+	optsCfg = OptionsConfig{Dimension: "terraform"}
+	if _, err := ResolveTarget(raw, &optsCfg, &opts, ""); err != nil || opts.FilterValues != nil {
+		t.Errorf("expected all values, got %v, %v", opts.FilterValues, err)
+	}
+
+	raw["environment"] = []any{"dev"}
+	opts = Options{FilterValues: []string{"terraform:infra", "environment:dev"}}
+	if _, err := ResolveTarget(raw, &optsCfg, &opts, ""); !errors.Is(err, ErrInvalidTarget) {
+		t.Errorf("expected ErrInvalidTarget for two dimensions, got %v", err)
+	}
+	opts = Options{FilterValues: []string{"environment:dev"}}
+	if _, err := ResolveTarget(raw, &optsCfg, &opts, "terraform"); !errors.Is(err, ErrInvalidTarget) {
+		t.Errorf("expected ErrInvalidTarget for a conflicting dimension input, got %v", err)
+	}
+}
+
+func TestResolveTarget_ShorthandWarning(t *testing.T) {
+	raw := RawConfig{
+		"service":   map[string]any{"api": nil},
+		"terraform": map[string]any{"infra": nil},
+	}
+	optsCfg := OptionsConfig{Dimension: "service"}
+	opts := Options{FilterValues: []string{"terraform"}}
+
+	warnings, err := ResolveTarget(raw, &optsCfg, &opts, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if optsCfg.Dimension != "terraform" || len(warnings) != 1 || !strings.Contains(warnings[0], `"terraform:*"`) {
+		t.Errorf("expected a switch with a warning, got %q, %v", optsCfg.Dimension, warnings)
+	}
+}
+
+func TestMatchTargets(t *testing.T) {
+	values := []string{"api-public", "api-internal", "worker", "legacy"}
+	groups := map[string][]string{"backend": {"api-*", "worker"}}
+
+	tests := []struct {
+		patterns []string
+		want     []string
+		err      string
+	}{
+		{patterns: []string{"worker", "legacy"}, want: []string{"worker", "legacy"}},
+		{patterns: []string{"api-*"}, want: []string{"api-public", "api-internal"}},
+		{patterns: []string{"!legacy"}, want: []string{"api-public", "api-internal", "worker"}},
+		{patterns: []string{"@backend", "!api-internal"}, want: []string{"api-public", "worker"}},
+		{patterns: []string{"!api-*", "!worker", "!legacy"}, want: []string{}},
+		{patterns: []string{"legcy"}, err: `invalid target: unknown service value "legcy" (did you mean "legacy"?)`},
+		{patterns: []string{"backend"}, err: `invalid target: unknown service value "backend" (did you mean "@backend"?)`},
+		{patterns: []string{"db"}, err: `invalid target: unknown service value "db"`},
+		{patterns: []string{"!db-*"}, err: `invalid target: "db-*" matches no service value`},
+		{patterns: []string{"@backed"}, err: `invalid target: unknown group "backed" (did you mean "backend"?)`},
+	}
+	for _, tt := range tests {
+		got, err := MatchTargets("service", tt.patterns, values, groups, nil)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err || !errors.Is(err, ErrInvalidTarget) {
+				t.Errorf("%v: expected error %q, got %v", tt.patterns, tt.err, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: expected %v, got %v, %v", tt.patterns, tt.want, got, err)
+		}
+	}
+
+	groups["stale"] = []string{"api", "worker"}
+	_, err := MatchTargets("service", []string{"@stale"}, values, groups, nil)
+	if err == nil || !strings.Contains(err.Error(), `group stale: unknown service value "api"`) {
+		t.Errorf("expected the group's unknown value to be reported, got %v", err)
+	}
+
+	disabled := []DisabledValue{{Dimension: "service", Value: "legacy"}, {Dimension: "service", Value: "api-internal"}}
+	for _, tt := range []struct {
+		patterns []string
+		want     []string
+	}{
+		{patterns: []string{"*"}, want: []string{"api-public", "worker"}},
+		{patterns: []string{"!worker"}, want: []string{"api-public"}},
+		{patterns: []string{"@backend"}, want: []string{"api-public", "worker"}},
+		{patterns: []string{"legacy"}, want: []string{"legacy"}},
+	} {
+		got, err := MatchTargets("service", tt.patterns, values, groups, disabled)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: expected %v, got %v, %v", tt.patterns, tt.want, got, err)
+		}
+	}
+	_, err = MatchTargets("service", []string{"api-int*"}, values, groups, disabled)
+	if err == nil || err.Error() != `invalid target: "api-int*" matches only disabled service values: api-internal` {
+		t.Errorf("expected a glob matching only disabled values to fail, got %v", err)
+	}
+}
+
+func TestParseConfigFile_GroupsDimension(t *testing.T) {
+	for _, config := range []string{
+		"groups: [admins, users]\nservice: [api]\n",
+		"groups:\n  admins: {role: admin}\n  users:\nservice: [api]\n",
+		"settings:\n  dimension: groups\ngroups:\n  admins: [api]\n",
+	} {
+		tmp, err := os.CreateTemp("", "config-*.yaml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(tmp.Name())
+		_, _ = tmp.WriteString(config)
+		_ = tmp.Close()
+
+		_, err = ParseConfigFile(tmp.Name())
+		var errs ConfigErrors
+		if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Path != "groups" || !strings.Contains(errs[0].Msg, "rename the dimension named groups") {
+			t.Errorf("%q: expected the groups dimension to be reported, got %v", config, err)
+		}
+	}
+}
+
+func TestParseConfigFile_InvalidGroups(t *testing.T) {
+	tmp, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	_, _ = tmp.WriteString("groups:\n  backend: [api, 1]\n  nested: ['@backend']\n  ok: api, worker\n  'a:b': [api]\nservice: [api, worker]\n")
+	_ = tmp.Close()
+
+	_, err = ParseConfigFile(tmp.Name())
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected ConfigErrors, got %v", err)
+	}
+	var paths []string
+	for _, e := range errs {
+		paths = append(paths, e.Path)
+	}
+	want := []string{"groups.a:b", "groups.backend[1]", "groups.nested"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("expected errors at %v, got %v", want, errs)
+	}
+}
+
+func TestExpand_Collapse(t *testing.T) {
+	raw := RawConfig{
+		"service": map[string]any{
+			"api":   map[string]any{"image": "api"},
+			"batch": map[string]any{"image": "batch", "only": map[string]any{"environment": []any{"prod"}}},
+		},
+		"environment": map[string]any{
+			"dev":  map[string]any{"account": "111", "region": "eu"},
+			"prod": map[string]any{"account": "222", "region": "eu"},
+		},
+	}
+	optsCfg, dims := ParseOptions(raw)
+	optsCfg.Dimension = "service"
+
+	entries, err := Expand(dims, optsCfg, Options{Collapse: []string{"environment"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []MatrixEntry{
+		{"service": "api", "image": "api", "region": "eu", "directory": "api"},
+		{"service": "batch", "image": "batch", "account": "222", "region": "eu", "directory": "batch"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("expected the differing account to be dropped, got %v", entries)
+	}
+
+	_, err = Expand(dims, optsCfg, Options{Collapse: []string{"environment"}, CollapsePolicy: CollapseError})
+	if !errors.Is(err, ErrInvalidCollapse) || !strings.Contains(err.Error(), "field account of service=api") {
+		t.Errorf("expected a conflict on account, got %v", err)
+	}
+
+	entries, err = Expand(dims, optsCfg, Options{Collapse: []string{"environment"}, CollapsePolicy: CollapseFirst})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want = []MatrixEntry{
+		{"service": "api", "image": "api", "account": "111", "region": "eu", "directory": "api"},
+		{"service": "batch", "image": "batch", "account": "222", "region": "eu", "directory": "batch"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("expected %v, got %v", want, entries)
+	}
+
+	entries, err = Expand(dims, optsCfg, Options{Collapse: []string{"environment"}, CollapsePolicy: CollapseList})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := entries[0]["account"]; !reflect.DeepEqual(got, []any{"111", "222"}) {
+		t.Errorf("expected collected accounts, got %v", got)
+	}
+	if got := entries[1]["account"]; got != "222" {
+		t.Errorf("expected batch to only see prod, got %v", got)
+	}
+
+	sources := Provenance(dims, optsCfg, entries[0], []string{"environment"})
+	if sources["account"] != "environment.*" || sources["image"] != "service.api" {
+		t.Errorf("unexpected sources %v", sources)
+	}
+}
+
+func TestExpand_CollapsePartialField(t *testing.T) {
+	raw := RawConfig{
+		"service": []any{"api"},
+		"environment": map[string]any{
+			"dev":  map[string]any{"region": "eu"},
+			"prod": map[string]any{"account": "222", "region": "eu"},
+			"qa":   map[string]any{"account": "333", "region": "eu"},
+		},
+	}
+	optsCfg, dims := ParseOptions(raw)
+	optsCfg.Dimension = "service"
+
+	tests := []struct {
+		policy string
+		want   MatrixEntry
+	}{
+		{policy: CollapseDrop, want: MatrixEntry{"service": "api", "region": "eu", "directory": "api"}},
+		{policy: CollapseFirst, want: MatrixEntry{"service": "api", "region": "eu", "directory": "api"}},
+		{policy: CollapseList, want: MatrixEntry{"service": "api", "account": []any{"222", "333"}, "region": "eu", "directory": "api"}},
+	}
+	for _, tt := range tests {
+		entries, err := Expand(dims, optsCfg, Options{Collapse: []string{"environment"}, CollapsePolicy: tt.policy})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.policy, err)
+		}
+		if len(entries) != 1 || !reflect.DeepEqual(entries[0], tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.policy, tt.want, entries)
+		}
+	}
+
+	_, err := Expand(dims, optsCfg, Options{Collapse: []string{"environment"}, CollapsePolicy: CollapseError})
+	if !errors.Is(err, ErrInvalidCollapse) || !strings.Contains(err.Error(), "field account of service=api") || !strings.Contains(err.Error(), "(unset and 222)") {
+		t.Errorf("expected a conflict on the partly set account, got %v", err)
+	}
+}
+
+func TestExpand_CollapseChecksFieldsFirst(t *testing.T) {
+	raw := RawConfig{
+		"settings": map[string]any{
+			"required_fields": []any{"account"},
+			"field_types":     map[string]any{"account": map[string]any{"type": "string", "pattern": "^[0-9]+$"}},
+		},
+		"service": []any{"api"},
+		"environment": map[string]any{
+			"dev":  map[string]any{"account": "111"},
+			"prod": map[string]any{"account": "222"},
+		},
+	}
+	optsCfg, dims := ParseOptions(raw)
+	optsCfg.Dimension = "service"
+
+	entries, err := Expand(dims, optsCfg, Options{Collapse: []string{"environment"}, CollapsePolicy: CollapseList})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := entries[0]["account"]; !reflect.DeepEqual(got, []any{"111", "222"}) {
+		t.Errorf("expected collected accounts, got %v", got)
+	}
+	if _, err := Expand(dims, optsCfg, Options{Collapse: []string{"environment"}}); err != nil {
+		t.Errorf("expected the dropped required field to be checked before collapsing, got %v", err)
+	}
+
+	raw["environment"].(map[string]any)["dev"] = map[string]any{"account": "x"}
+	optsCfg, dims = ParseOptions(raw)
+	optsCfg.Dimension = "service"
+	_, err = Expand(dims, optsCfg, Options{Collapse: []string{"environment"}, CollapsePolicy: CollapseList})
+	var errs FieldErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Error() != `environment=dev, service=api: account: "x" does not match ^[0-9]+$` {
+		t.Errorf("expected the uncollapsed entry to be reported, got %v", err)
+	}
+}
+
+func TestValidateCollapse(t *testing.T) {
+	dims := RawConfig{"service": []any{"api"}, "environment": []any{"dev"}}
+	tests := []struct {
+		collapse []string
+		policy   string
+		err      string
+	}{
+		{collapse: []string{"environment"}, policy: CollapseList},
+		{collapse: []string{"service"}, err: "invalid collapse: service is the primary dimension"},
+		{collapse: []string{"enviroment"}, err: `invalid collapse: unknown dimension "enviroment" (did you mean "environment"?)`},
+		{collapse: []string{"environment"}, policy: "last", err: `invalid collapse: unknown policy "last" (expected drop, error, first or list)`},
+	}
+	for _, tt := range tests {
+		err := ValidateCollapse(dims, "service", tt.collapse, tt.policy)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("%v %q: expected error %q, got %v", tt.collapse, tt.policy, tt.err, err)
+		}
+	}
+}
@@ -0,0 +1,641 @@
+package expander
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expressions are the assertions of the rules block. The language is small:
+//
+//	literals     "str" 'str' 42 1.5 true false null [a, b]
+//	names        environment, tags.team, event.name, entry.event, length
+//	operators    == != < <= > >= in ! && || ( )
+//	functions    startsWith(s, p) endsWith(s, p) contains(s|list, x)
+//	             matches(s, glob) len(x)
+//
+// A bare name is a field of the entry; event holds the event context and
+// length the number of entries. Missing fields are null. Numbers compare
+// numerically, also against strings holding numbers; everything else
+// compares by its string form, except that null only equals null. In a
+// boolean context null, false, "" and 0 are false.
+
+// expr is a compiled expression.
+type expr interface {
+	eval(scope exprScope) (any, error)
+}
+
+// exprScope resolves the names of an expression.
+type exprScope struct {
+	entry  map[string]any
+	event  map[string]any
+	length int
+}
+
+// compileExpr parses an expression.
+func compileExpr(src string) (expr, error) {
+	p := &exprParser{src: src}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	return e, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokName
+	tokString
+	tokNumber
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+type exprParser struct {
+	src string
+	off int
+	tok token
+}
+
+func (p *exprParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("column %d: %s", p.tok.pos+1, fmt.Sprintf(format, args...))
+}
+
+// next scans the next token.
+func (p *exprParser) next() error {
+	for p.off < len(p.src) && unicode.IsSpace(rune(p.src[p.off])) {
+		p.off++
+	}
+	start := p.off
+	if p.off >= len(p.src) {
+		p.tok = token{kind: tokEOF, pos: start}
+		return nil
+	}
+	c := p.src[p.off]
+	switch {
+	case c == '"' || c == '\'':
+		var sb strings.Builder
+		p.off++
+		for {
+			if p.off >= len(p.src) {
+				p.tok = token{pos: start}
+				return p.errorf("unterminated string")
+			}
+			ch := p.src[p.off]
+			p.off++
+			if ch == c {
+				break
+			}
+			if ch == '\\' && p.off < len(p.src) {
+				ch = p.src[p.off]
+				p.off++
+			}
+			sb.WriteByte(ch)
+		}
+		p.tok = token{kind: tokString, text: sb.String(), pos: start}
+	case c >= '0' && c <= '9' || c == '-' && p.off+1 < len(p.src) && p.src[p.off+1] >= '0' && p.src[p.off+1] <= '9':
+		p.off++
+		for p.off < len(p.src) && strings.IndexByte("0123456789.eE+-", p.src[p.off]) >= 0 {
+			if (p.src[p.off] == '+' || p.src[p.off] == '-') && p.src[p.off-1] != 'e' && p.src[p.off-1] != 'E' {
+				break
+			}
+			p.off++
+		}
+		text := p.src[start:p.off]
+		if !jsonNumberRe.MatchString(text) {
+			p.tok = token{pos: start}
+			return p.errorf("invalid number %q", text)
+		}
+		p.tok = token{kind: tokNumber, text: text, pos: start}
+	case c == '_' || unicode.IsLetter(rune(c)):
+		for p.off < len(p.src) && (p.src[p.off] == '_' || p.src[p.off] == '-' || unicode.IsLetter(rune(p.src[p.off])) || unicode.IsDigit(rune(p.src[p.off]))) {
+			p.off++
+		}
+		p.tok = token{kind: tokName, text: p.src[start:p.off], pos: start}
+	default:
+		for _, op := range []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ",", "."} {
+			if strings.HasPrefix(p.src[p.off:], op) {
+				p.off += len(op)
+				p.tok = token{kind: tokOp, text: op, pos: start}
+				return nil
+			}
+		}
+		p.tok = token{pos: start}
+		return p.errorf("unexpected character %q", c)
+	}
+	return nil
+}
+
+func (p *exprParser) isOp(op string) bool {
+	return p.tok.kind == tokOp && p.tok.text == op
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.isOp(op) {
+		return p.errorf("expected %q, found %s", op, p.tok)
+	}
+	return p.next()
+}
+
+func (p *exprParser) parseOr() (expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalExpr{or: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (expr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalExpr{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseNot() (expr, error) {
+	if p.isOp("!") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		e, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{e}, nil
+	}
+	return p.parseComparison()
+}
+
+var comparisonOps = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+func (p *exprParser) parseComparison() (expr, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case p.tok.kind == tokOp && comparisonOps[p.tok.text]:
+		op := p.tok.text
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return compareExpr{op: op, left: left, right: right}, nil
+	case p.tok.kind == tokName && p.tok.text == "in":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return inExpr{item: left, list: right}, nil
+	}
+	return left, nil
+}
+
+func (p *exprParser) parsePrimary() (expr, error) {
+	tok := p.tok
+	switch {
+	case tok.kind == tokString:
+		return literalExpr{tok.text}, p.next()
+	case tok.kind == tokNumber:
+		return literalExpr{json.Number(tok.text)}, p.next()
+	case p.isOp("("):
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	case p.isOp("["):
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		var items listExpr
+		for !p.isOp("]") {
+			if len(items) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			item, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, p.next()
+	case tok.kind == tokName:
+		switch tok.text {
+		case "true", "false":
+			return literalExpr{tok.text == "true"}, p.next()
+		case "null":
+			return literalExpr{nil}, p.next()
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if p.isOp("(") {
+			return p.parseCall(tok)
+		}
+		path := []string{tok.text}
+		for p.isOp(".") {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if p.tok.kind != tokName {
+				return nil, p.errorf("expected a name after \".\", found %s", p.tok)
+			}
+			path = append(path, p.tok.text)
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+		return nameExpr(path), nil
+	}
+	return nil, p.errorf("unexpected %s", tok)
+}
+
+// exprFuncs are the functions of the language with their number of
+// arguments.
+var exprFuncs = map[string]int{
+	"startsWith": 2,
+	"endsWith":   2,
+	"contains":   2,
+	"matches":    2,
+	"len":        1,
+}
+
+func (p *exprParser) parseCall(name token) (expr, error) {
+	arity, ok := exprFuncs[name.text]
+	if !ok {
+		p.tok = name
+		return nil, p.errorf("unknown function %q", name.text)
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	call := callExpr{name: name.text}
+	for !p.isOp(")") {
+		if len(call.args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+	}
+	if len(call.args) != arity {
+		p.tok = name
+		return nil, p.errorf("%s takes %d arguments, got %d", name.text, arity, len(call.args))
+	}
+	return call, p.next()
+}
+
+type literalExpr struct{ v any }
+
+func (e literalExpr) eval(exprScope) (any, error) { return e.v, nil }
+
+type listExpr []expr
+
+func (e listExpr) eval(s exprScope) (any, error) {
+	list := make([]any, len(e))
+	for i, item := range e {
+		v, err := item.eval(s)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = v
+	}
+	return list, nil
+}
+
+// nameExpr is a dotted name such as environment or event.name.
+type nameExpr []string
+
+func (e nameExpr) eval(s exprScope) (any, error) {
+	var v any
+	rest := e[1:]
+	switch e[0] {
+	case "event":
+		v = s.event
+	case "entry":
+		v = s.entry
+	case "length":
+		v = json.Number(strconv.Itoa(s.length))
+	default:
+		v = s.entry[e[0]]
+	}
+	for _, key := range rest {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, nil
+		}
+		v = m[key]
+	}
+	return v, nil
+}
+
+type notExpr struct{ e expr }
+
+func (e notExpr) eval(s exprScope) (any, error) {
+	v, err := e.e.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	return !truthy(v), nil
+}
+
+type logicalExpr struct {
+	or          bool
+	left, right expr
+}
+
+func (e logicalExpr) eval(s exprScope) (any, error) {
+	l, err := e.left.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	if truthy(l) == e.or {
+		return e.or, nil
+	}
+	r, err := e.right.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	return truthy(r), nil
+}
+
+type compareExpr struct {
+	op          string
+	left, right expr
+}
+
+func (e compareExpr) eval(s exprScope) (any, error) {
+	l, err := e.left.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	r, err := e.right.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "==":
+		return valuesEqual(l, r), nil
+	case "!=":
+		return !valuesEqual(l, r), nil
+	}
+	if l == nil || r == nil {
+		return false, nil
+	}
+	c := compareValues(l, r)
+	switch e.op {
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	default:
+		return c >= 0, nil
+	}
+}
+
+type inExpr struct{ item, list expr }
+
+func (e inExpr) eval(s exprScope) (any, error) {
+	item, err := e.item.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	list, err := e.list.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	switch list := list.(type) {
+	case []any:
+		for _, v := range list {
+			if valuesEqual(item, v) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case map[string]any:
+		_, ok := list[FormatValue(item)]
+		return ok, nil
+	case nil:
+		return false, nil
+	}
+	return nil, errors.New(`"in" needs a list or an object on the right`)
+}
+
+type callExpr struct {
+	name string
+	args []expr
+}
+
+func (e callExpr) eval(s exprScope) (any, error) {
+	args := make([]any, len(e.args))
+	for i, a := range e.args {
+		v, err := a.eval(s)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	switch e.name {
+	case "startsWith":
+		return strings.HasPrefix(FormatValue(args[0]), FormatValue(args[1])), nil
+	case "endsWith":
+		return strings.HasSuffix(FormatValue(args[0]), FormatValue(args[1])), nil
+	case "contains":
+		if list, ok := args[0].([]any); ok {
+			for _, v := range list {
+				if valuesEqual(v, args[1]) {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+		return strings.Contains(FormatValue(args[0]), FormatValue(args[1])), nil
+	case "matches":
+		return MatchGlob(FormatValue(args[1]), FormatValue(args[0])), nil
+	default: // len
+		switch v := args[0].(type) {
+		case []any:
+			return json.Number(strconv.Itoa(len(v))), nil
+		case map[string]any:
+			return json.Number(strconv.Itoa(len(v))), nil
+		case nil:
+			return json.Number("0"), nil
+		}
+		return json.Number(strconv.Itoa(len(FormatValue(args[0])))), nil
+	}
+}
+
+// truthy reports whether a value counts as true: everything but null,
+// false, "" and 0.
+func truthy(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	}
+	if f, ok := numberValue(v); ok {
+		return f != 0
+	}
+	return true
+}
+
+// numberValue returns v as a float64 if it is a number or a string holding
+// one.
+func numberValue(v any) (float64, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case string:
+		if !jsonNumberRe.MatchString(v) {
+			return 0, false
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil && !math.IsInf(f, 0)
+	}
+	return 0, false
+}
+
+// intValue returns v as an integer when it is one. Integers are compared
+// exactly, as float64 cannot tell apart those above 2^53, e.g. account IDs.
+func intValue(v any) (int64, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		n, err := v.Int64()
+		return n, err == nil
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	case string:
+		if !jsonNumberRe.MatchString(v) {
+			return 0, false
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// isNumber reports whether v is a number rather than a string.
+func isNumber(v any) bool {
+	switch v.(type) {
+	case json.Number, float64, int, int64:
+		return true
+	}
+	return false
+}
+
+func valuesEqual(a, b any) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if isNumber(a) || isNumber(b) {
+		ia, okA := intValue(a)
+		ib, okB := intValue(b)
+		if okA && okB {
+			return ia == ib
+		}
+		fa, okA := numberValue(a)
+		fb, okB := numberValue(b)
+		if okA && okB {
+			return fa == fb
+		}
+	}
+	return FormatValue(a) == FormatValue(b)
+}
+
+// compareValues orders two non-null values, numerically when both are
+// numbers and by their string form otherwise.
+func compareValues(a, b any) int {
+	ia, okA := intValue(a)
+	ib, okB := intValue(b)
+	if okA && okB {
+		return cmp.Compare(ia, ib)
+	}
+	fa, okA := numberValue(a)
+	fb, okB := numberValue(b)
+	if okA && okB {
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(FormatValue(a), FormatValue(b))
+}
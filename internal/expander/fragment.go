@@ -0,0 +1,126 @@
+package expander
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FragmentFile is the name of the per-directory config fragment, looked up
+// in {base_dir}/{value}/ for each value of the primary dimension.
+const FragmentFile = ".matrix.yaml"
+
+// Fragment is a per-directory config fragment, merged into entries as part
+// of its value's per-value config.
+type Fragment struct {
+	// Path is the fragment file relative to the repository root.
+	Path   string
+	Config map[string]any
+}
+
+// SensitiveFragmentValues returns every value stored under one of the given
+// fields in the fragments, for masking.
+func SensitiveFragmentValues(fragments map[string]Fragment, fields []string) []string {
+	var values []string
+	for _, value := range sortedKeys(fragments) {
+		values = append(values, SensitiveConfigValues(fragments[value].Config, fields)...)
+	}
+	return values
+}
+
+// LoadFragments reads the fragment of every value of the primary dimension
+// from {root}/{base_dir}/{value}/.matrix.yaml into optsCfg.Fragments. It does
+// nothing unless settings.fragment_keys is set. Fragments may only set the
+// keys it lists, so that teams cannot override protected fields; every key
+// outside the list, and every key that configures the action, such as uses,
+// is reported as a ConfigError located in the fragment. Fields tagged
+// !secret are added to optsCfg.Sensitive.
+func LoadFragments(raw RawConfig, optsCfg *OptionsConfig, root string) error {
+	if optsCfg.FragmentKeys == nil {
+		return nil
+	}
+	if root == "" {
+		root = "."
+	}
+
+	fragments := make(map[string]Fragment)
+	var errs ConfigErrors
+	for _, value := range ExtractDimensionValues(raw, optsCfg.Dimension) {
+		rel := valueDir(optsCfg.BaseDir, value) + "/" + FragmentFile
+		data, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(rel)))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read fragment: %w", err)
+		}
+		cfg, secrets, ferrs := parseFragment(rel, data, optsCfg.FragmentKeys)
+		if len(ferrs) > 0 {
+			errs = append(errs, ferrs...)
+			continue
+		}
+		for _, s := range secrets {
+			if !slices.Contains(optsCfg.Sensitive, s) {
+				optsCfg.Sensitive = append(optsCfg.Sensitive, s)
+			}
+		}
+		if cfg != nil {
+			fragments[value] = Fragment{Path: rel, Config: cfg}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	optsCfg.Fragments = fragments
+	return nil
+}
+
+// parseFragment parses a fragment and checks its keys against allowed. It
+// returns the config and the fields tagged !secret. An empty fragment yields
+// a nil config.
+func parseFragment(file string, data []byte, allowed []string) (map[string]any, []string, ConfigErrors) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, yamlError(file, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil, nil
+	}
+	if doc.Content[0].Kind != yaml.MappingNode {
+		return nil, nil, ConfigErrors{{File: file, Line: doc.Content[0].Line, Column: doc.Content[0].Column, Msg: "fragment must be an object"}}
+	}
+	secrets := collectSecretTags(&doc)
+	// Decoding guards against excessive aliasing, which nodeValue would
+	// expand without limit, and reports duplicate keys.
+	var decoded map[string]any
+	if err := doc.Decode(&decoded); err != nil {
+		return nil, nil, yamlError(file, err)
+	}
+	v, err := nodeValue(&doc)
+	if err != nil {
+		return nil, nil, yamlError(file, err)
+	}
+	cfg := v.(map[string]any)
+
+	pos := positions(&doc)
+	var errs ConfigErrors
+	for _, key := range sortedKeys(cfg) {
+		var msg string
+		switch {
+		case valueKeys[key] || primaryValueKeys[key] || filterKeys[key]:
+			msg = "configures the action and cannot be set in a fragment; set it in the config file"
+		case !slices.Contains(allowed, key):
+			msg = fmt.Sprintf("not allowed in a fragment (settings.fragment_keys: %s)", strings.Join(allowed, ", "))
+		default:
+			continue
+		}
+		p := pos[key]
+		errs = append(errs, &ConfigError{File: file, Line: p.line, Column: p.column, Path: key, Msg: msg})
+	}
+	return cfg, secrets, errs
+}
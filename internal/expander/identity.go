@@ -0,0 +1,98 @@
+package expander
+
+import "fmt"
+
+// defaultIdentityKey names the field of a list-of-objects dimension item
+// that holds its dimension value, unless settings.identity_key says
+// otherwise.
+const defaultIdentityKey = "name"
+
+// valueOrderKey holds, in the map dimension a list of objects is turned
+// into, the values in list order, so that the matrix keeps that order. The
+// NUL byte keeps it apart from any value written in a config.
+const valueOrderKey = "\x00order"
+
+// objectItems reports whether a list dimension has object items, e.g.
+// service: [{name: api, port: 8080}].
+func objectItems(arr []any) bool {
+	for _, item := range arr {
+		if _, ok := item.(map[string]any); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeObjectLists turns list dimensions with object items into map
+// dimensions: each item's identity field becomes the value and its other
+// fields the value's per-value config. Scalar items become values without
+// config. The values keep their list order (see valueOrderKey).
+func normalizeObjectLists(dims RawConfig, identityKey string) {
+	for key, val := range dims {
+		arr, ok := toSlice(val)
+		if !ok || !objectItems(arr) {
+			continue
+		}
+		m := make(map[string]any, len(arr)+1)
+		var order []string
+		for _, item := range arr {
+			obj, ok := item.(map[string]any)
+			if !ok {
+				order = append(order, FormatValue(item))
+				m[FormatValue(item)] = nil
+				continue
+			}
+			id, ok := obj[identityKey]
+			if !ok {
+				continue
+			}
+			cfg := make(map[string]any, len(obj)-1)
+			for k, v := range obj {
+				if k != identityKey {
+					cfg[k] = v
+				}
+			}
+			order = append(order, FormatValue(id))
+			m[FormatValue(id)] = cfg
+		}
+		m[valueOrderKey] = order
+		dims[key] = m
+	}
+}
+
+// mapValues returns the values of a map dimension: in list order for a
+// list of objects, otherwise sorted.
+func mapValues(m map[string]any) []string {
+	if order, ok := m[valueOrderKey].([]string); ok {
+		return order
+	}
+	return sortedKeys(valueConfigMap(m))
+}
+
+// objectList checks the items of a list-of-objects dimension: every object
+// needs a scalar identity field, and values must be unique.
+func (v *validator) objectList(key string, arr []any, identityKey string) {
+	seen := make(map[string]bool, len(arr))
+	for i, item := range arr {
+		path := indexPath(key, i)
+		id := item
+		if obj, ok := item.(map[string]any); ok {
+			var has bool
+			if id, has = obj[identityKey]; !has {
+				v.errorf(path, fmt.Sprintf("missing identity field %q (settings.identity_key)", identityKey))
+				continue
+			}
+			path += "." + identityKey
+			switch id.(type) {
+			case map[string]any, []any, nil:
+				v.errorf(path, "must be a string or number")
+				continue
+			}
+		}
+		value := FormatValue(id)
+		if seen[value] {
+			v.errorf(path, fmt.Sprintf("duplicate value %q", value))
+		}
+		seen[value] = true
+	}
+}
@@ -0,0 +1,138 @@
+package expander
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ignorePathsKey holds ignore patterns in a per-value config of the primary
+// dimension, e.g. service.api.ignore_paths. It configures change detection
+// and is not merged into entries.
+const ignorePathsKey = "ignore_paths"
+
+// valueKeys are keys of per-value configs that are not matrix fields.
+var valueKeys = map[string]bool{
+	requiredFieldsKey: true,
+}
+
+// primaryValueKeys configure change detection. They are only reserved in the
+// per-value configs of the primary dimension; elsewhere they are fields.
+var primaryValueKeys = map[string]bool{
+	ignorePathsKey: true,
+	usesKey:        true,
+}
+
+// isValueKey reports whether key in the per-value config cfg of dim is not
+// a matrix field, given the primary dimension.
+func isValueKey(cfg map[string]any, key, dim, primary string) bool {
+	if filterKeys[key] {
+		return isFilter(cfg, key)
+	}
+	return valueKeys[key] || primaryValueKeys[key] && dim == primary
+}
+
+// ValueIgnorePaths returns the ignore_paths of each value of a map
+// dimension, keyed by value. Values without patterns are left out.
+func ValueIgnorePaths(raw RawConfig, key string) map[string][]string {
+	dimMap, ok := raw[key].(map[string]any)
+	if !ok {
+		return nil
+	}
+	result := make(map[string][]string)
+	for value, cfg := range dimMap {
+		if m, ok := cfg.(map[string]any); ok {
+			if patterns := toStrings(m[ignorePathsKey]); len(patterns) > 0 {
+				result[value] = patterns
+			}
+		}
+	}
+	return result
+}
+
+// IgnoreChanged splits changed files into those that count for change
+// detection and those matched by an ignore pattern. Global patterns match
+// the path from the repository root; per-value patterns match the path
+// relative to {baseDir}/{value}/.
+func IgnoreChanged(changedFiles []string, baseDir string, global []string, perValue map[string][]string) (kept, ignored []string) {
+	kept = []string{}
+	for _, f := range changedFiles {
+		f = strings.TrimSpace(f)
+		if isIgnored(f, baseDir, global, perValue) {
+			ignored = append(ignored, f)
+		} else {
+			kept = append(kept, f)
+		}
+	}
+	return kept, ignored
+}
+
+func isIgnored(file, baseDir string, global []string, perValue map[string][]string) bool {
+	for _, p := range global {
+		if MatchGlob(p, file) {
+			return true
+		}
+	}
+	for value, patterns := range perValue {
+		prefix := value + "/"
+		if baseDir != "" {
+			prefix = baseDir + "/" + value + "/"
+		}
+		rel, ok := strings.CutPrefix(file, prefix)
+		if !ok {
+			continue
+		}
+		for _, p := range patterns {
+			if MatchGlob(p, rel) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MatchGlob reports whether a slash-separated path matches pattern. Each
+// segment is matched with path.Match; a "**" segment matches any number of
+// segments, and a trailing "/" matches everything below a directory.
+// Malformed patterns match nothing; check them with ValidateGlob.
+func MatchGlob(pattern, name string) bool {
+	if strings.HasSuffix(pattern, "/") {
+		pattern += "*/**"
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], name[1:])
+}
+
+// ValidateGlob reports whether pattern is well-formed for MatchGlob.
+func ValidateGlob(pattern string) error {
+	if pattern == "" {
+		return errors.New("empty glob pattern")
+	}
+	for _, seg := range strings.Split(pattern, "/") {
+		if _, err := path.Match(seg, ""); err != nil {
+			return fmt.Errorf("invalid glob pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
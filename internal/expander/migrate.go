@@ -0,0 +1,262 @@
+package expander
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// legacyKey is a key that moved to settings in a breaking format change.
+type legacyKey struct {
+	block, key string
+	// setting is the settings key that replaces it.
+	setting string
+}
+
+// legacyKeys are the keys moved by the 3.0.0 format change, which left them
+// in global to be treated as ordinary fields. When several set the same
+// setting, the first one wins, at runtime and in Migrate.
+var legacyKeys = []legacyKey{
+	{"settings", "dimension_key", "dimension"},
+	{"global", "dimension_key", "dimension"},
+	{"global", "base_dir", "base_dir"},
+	{"global", "sort_by", "sort_by"},
+}
+
+func (k legacyKey) String() string { return k.block + "." + k.key }
+
+// applyLegacyKeys uses the values of legacy keys for settings that are not
+// set, removes them from the global fields and returns a deprecation warning
+// for each one found.
+func applyLegacyKeys(raw RawConfig, optsCfg *OptionsConfig) []string {
+	var warnings []string
+	settings, _ := raw["settings"].(map[string]any)
+	applied := make(map[string]legacyKey)
+	for _, lk := range legacyKeys {
+		block, _ := raw[lk.block].(map[string]any)
+		val, ok := block[lk.key]
+		if !ok {
+			continue
+		}
+		if lk.block == "global" {
+			delete(optsCfg.GlobalConfig, lk.key)
+		}
+		if _, set := settings[lk.setting]; set {
+			warnings = append(warnings, fmt.Sprintf("%s is deprecated and ignored because settings.%s is set; remove it (run action-config migrate)", lk, lk.setting))
+			continue
+		}
+		if prev, ok := applied[lk.setting]; ok {
+			warnings = append(warnings, fmt.Sprintf("%s is deprecated and ignored because %s is set; remove it (run action-config migrate)", lk, prev))
+			continue
+		}
+		applied[lk.setting] = lk
+		warnings = append(warnings, fmt.Sprintf("%s is deprecated: move it to settings.%s (run action-config migrate)", lk, lk.setting))
+		switch lk.setting {
+		case "dimension":
+			if s, ok := val.(string); ok {
+				optsCfg.Dimension = s
+			}
+		case "base_dir":
+			if s, ok := val.(string); ok {
+				optsCfg.BaseDir = s
+			}
+		case "sort_by":
+			optsCfg.SortBy = toStrings(val)
+		}
+	}
+	if len(optsCfg.GlobalConfig) == 0 {
+		optsCfg.GlobalConfig = nil
+	}
+	return warnings
+}
+
+// ServiceFallbackWarning is the deprecation warning for a config that
+// relies on the implicit "service" primary dimension, which v4 drops.
+const ServiceFallbackWarning = `settings.dimension is not set: the implicit "service" dimension is deprecated and will be removed in v4; add dimension: service to settings (run action-config migrate)`
+
+// Migrate rewrites a configuration file to the current format: legacy keys
+// are moved to settings and the implicit "service" dimension is made
+// explicit. YAML comments and key order are preserved. ext selects the
+// format (".json", ".yaml" or ".yml"). It returns the rewritten file and a
+// description of each change; without changes the data is returned as is.
+func Migrate(data []byte, ext string) ([]byte, []string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse configuration: %w", err)
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, nil, errors.New("configuration must be an object")
+	}
+	root := doc.Content[0]
+
+	var changes []string
+	settings := mappingValue(root, "settings")
+	ensureSettings := func() *yaml.Node {
+		if settings == nil {
+			settings = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			// settings goes first, like in the documented format, and takes
+			// over the comment at the top of the file.
+			key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "settings"}
+			if len(root.Content) > 0 {
+				key.HeadComment, root.Content[0].HeadComment = root.Content[0].HeadComment, ""
+			}
+			root.Content = append([]*yaml.Node{key, settings}, root.Content...)
+		}
+		// Moved keys may carry comments, which a flow mapping cannot hold
+		// readably.
+		settings.Style &^= yaml.FlowStyle
+		return settings
+	}
+
+	for _, lk := range legacyKeys {
+		block := mappingValue(root, lk.block)
+		if lk.block == "settings" {
+			block = settings
+		}
+		if block == nil || block.Kind != yaml.MappingNode {
+			continue
+		}
+		i := mappingIndex(block, lk.key)
+		if i < 0 {
+			continue
+		}
+		keyNode, valNode := block.Content[i], block.Content[i+1]
+		block.Content = append(block.Content[:i], block.Content[i+2:]...)
+
+		if mappingIndex(ensureSettings(), lk.setting) >= 0 {
+			changes = append(changes, fmt.Sprintf("removed %s, settings.%s is already set", lk, lk.setting))
+		} else {
+			keyNode.Value = lk.setting
+			settings.Content = append(settings.Content, keyNode, valNode)
+			changes = append(changes, fmt.Sprintf("moved %s to settings.%s", lk, lk.setting))
+		}
+		if lk.block == "global" && len(block.Content) == 0 {
+			removeKey(root, "global")
+			changes = append(changes, "removed the empty global block")
+		}
+	}
+
+	if mappingIndex(root, "service") >= 0 && (settings == nil || mappingIndex(settings, "dimension") < 0) {
+		s := ensureSettings()
+		s.Content = append([]*yaml.Node{
+			{Kind: yaml.ScalarNode, Tag: "!!str", Value: "dimension"},
+			{Kind: yaml.ScalarNode, Tag: "!!str", Value: "service"},
+		}, s.Content...)
+		changes = append(changes, "set settings.dimension to service, which v4 no longer assumes")
+	}
+
+	if len(changes) == 0 {
+		return data, nil, nil
+	}
+	var out []byte
+	var err error
+	if strings.EqualFold(ext, ".json") {
+		out, err = encodeJSON(root)
+	} else {
+		var buf bytes.Buffer
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		if err = enc.Encode(&doc); err == nil {
+			err = enc.Close()
+		}
+		out = buf.Bytes()
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode configuration: %w", err)
+	}
+	return out, changes, nil
+}
+
+// mappingIndex returns the index of key in the content of a mapping node,
+// or -1.
+func mappingIndex(m *yaml.Node, key string) int {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// mappingValue returns the value of key in a mapping node, or nil.
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	if i := mappingIndex(m, key); i >= 0 {
+		return m.Content[i+1]
+	}
+	return nil
+}
+
+// removeKey removes key from a mapping node. A comment above the key is
+// kept above the next key.
+func removeKey(m *yaml.Node, key string) {
+	i := mappingIndex(m, key)
+	if i < 0 {
+		return
+	}
+	if c := m.Content[i].HeadComment; c != "" && i+2 < len(m.Content) {
+		next := m.Content[i+2]
+		next.HeadComment = strings.TrimSuffix(c+"\n"+next.HeadComment, "\n")
+	}
+	m.Content = append(m.Content[:i], m.Content[i+2:]...)
+}
+
+// encodeJSON renders a node tree as indented JSON, keeping key order.
+func encodeJSON(n *yaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, n); err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, buf.Bytes(), "", "  "); err != nil {
+		return nil, err
+	}
+	out.WriteByte('\n')
+	return out.Bytes(), nil
+}
+
+func writeJSON(buf *bytes.Buffer, n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.MappingNode:
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(n.Content[i].Value)
+			buf.Write(key)
+			buf.WriteByte(':')
+			if err := writeJSON(buf, n.Content[i+1]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case yaml.SequenceNode:
+		buf.WriteByte('[')
+		for i, c := range n.Content {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeJSON(buf, c); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case yaml.ScalarNode:
+		switch n.ShortTag() {
+		case "!!int", "!!float", "!!bool", "!!null":
+			buf.WriteString(n.Value)
+		default:
+			s, _ := json.Marshal(n.Value)
+			buf.Write(s)
+		}
+	case yaml.AliasNode:
+		return writeJSON(buf, n.Alias)
+	default:
+		return fmt.Errorf("unsupported YAML node kind %d", n.Kind)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package expander
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Rule severities. Violations of an error rule fail the step; warnings are
+// only reported.
+const (
+	SeverityError = "error"
+	SeverityWarn  = "warn"
+)
+
+// Rule scopes: an entry rule is checked against every entry it applies to,
+// a matrix rule once against the whole matrix.
+const (
+	scopeEntry  = "entry"
+	scopeMatrix = "matrix"
+)
+
+// ruleKeys are the keys of a rule in the rules block.
+var ruleKeys = map[string]bool{
+	"name":     true,
+	"when":     true,
+	"assert":   true,
+	"message":  true,
+	"severity": true,
+	"scope":    true,
+}
+
+// Rule is a policy assertion from the rules block, checked against the
+// expanded matrix.
+type Rule struct {
+	Name string
+	// When selects the entries the rule applies to; empty means all.
+	When string
+	// Assert must hold for every selected entry, or for the matrix.
+	Assert   string
+	Message  string
+	Severity string
+	Scope    string
+
+	when, assert expr
+}
+
+// Violation is a rule that did not hold.
+type Violation struct {
+	Rule     string
+	Severity string
+	Message  string
+	// Entry identifies the violating entry by its dimension values, e.g.
+	// "environment=prod, service=api". It is empty for matrix rules.
+	Entry string
+}
+
+// String formats the violation as "rule: message (entry)".
+func (v Violation) String() string {
+	s := v.Rule + ": " + v.Message
+	if v.Entry != "" {
+		s += " (" + v.Entry + ")"
+	}
+	return s
+}
+
+// parseRules converts the rules block. Malformed rules are reported by
+// validateConfig and skipped here.
+func parseRules(val any) []Rule {
+	arr, _ := toSlice(val)
+	var rules []Rule
+	for i, item := range arr {
+		m, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		r := Rule{Severity: SeverityError, Scope: scopeEntry}
+		r.Name, _ = m["name"].(string)
+		r.When, _ = m["when"].(string)
+		r.Assert, _ = m["assert"].(string)
+		r.Message, _ = m["message"].(string)
+		if s, ok := m["severity"].(string); ok {
+			r.Severity = s
+		}
+		if s, ok := m["scope"].(string); ok {
+			r.Scope = s
+		}
+		if r.Name == "" {
+			r.Name = indexPath("rules", i)
+		}
+		var err error
+		if r.assert, err = compileExpr(r.Assert); err != nil {
+			continue
+		}
+		if r.When != "" {
+			if r.when, err = compileExpr(r.When); err != nil {
+				continue
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// rule checks one rule of the rules block.
+func (v *validator) rule(path string, m map[string]any) {
+	for _, key := range sortedKeys(m) {
+		if !ruleKeys[key] {
+			v.errorf(path+"."+key, "unknown rule key (expected name, when, assert, message, severity or scope)")
+		}
+	}
+	for _, key := range []string{"name", "message"} {
+		if val, ok := m[key]; ok {
+			if _, ok := val.(string); !ok {
+				v.errorf(path+"."+key, "must be a string")
+			}
+		}
+	}
+	if _, ok := m["assert"]; !ok {
+		v.errorf(path, "assert is required")
+	}
+	for _, key := range []string{"when", "assert"} {
+		val, ok := m[key]
+		if !ok {
+			continue
+		}
+		s, ok := val.(string)
+		if !ok {
+			v.errorf(path+"."+key, "must be a string")
+			continue
+		}
+		if _, err := compileExpr(s); err != nil {
+			v.errorf(path+"."+key, "invalid expression: "+err.Error())
+		}
+	}
+	if val, ok := m["severity"]; ok && val != SeverityError && val != SeverityWarn {
+		v.errorf(path+".severity", "must be error or warn")
+	}
+	if val, ok := m["scope"]; ok && val != scopeEntry && val != scopeMatrix {
+		v.errorf(path+".scope", "must be entry or matrix")
+	}
+	if m["scope"] == scopeMatrix {
+		if _, ok := m["when"]; ok {
+			v.errorf(path+".when", "is not supported for matrix rules")
+		}
+	}
+}
+
+// CheckRules evaluates rules against the expanded entries. event and length,
+// the number of matrix entries, are available in expressions. dimKeys
+// identify violating entries. A rule that fails to evaluate is reported as
+// an error violation.
+func CheckRules(rules []Rule, entries []MatrixEntry, dimKeys []string, event map[string]any, length int) []Violation {
+	var violations []Violation
+	for _, r := range rules {
+		fail := func(entry MatrixEntry, err error) {
+			msg := r.Message
+			if msg == "" {
+				msg = "assertion failed: " + r.Assert
+			}
+			severity := r.Severity
+			if err != nil {
+				msg, severity = "evaluation failed: "+err.Error(), SeverityError
+			}
+			violations = append(violations, Violation{Rule: r.Name, Severity: severity, Message: msg, Entry: entryKeys(entry, dimKeys)})
+		}
+		check := func(entry MatrixEntry, scope exprScope) {
+			if r.when != nil {
+				v, err := r.when.eval(scope)
+				if err != nil {
+					fail(entry, err)
+					return
+				}
+				if !truthy(v) {
+					return
+				}
+			}
+			v, err := r.assert.eval(scope)
+			if err != nil || !truthy(v) {
+				fail(entry, err)
+			}
+		}
+
+		if r.Scope == scopeMatrix {
+			check(nil, exprScope{event: event, length: length})
+			continue
+		}
+		for _, entry := range entries {
+			check(entry, exprScope{entry: entry, event: event, length: length})
+		}
+	}
+	return violations
+}
+
+// entryKeys formats the dimension values of an entry as
+// "environment=prod, service=api".
+func entryKeys(entry MatrixEntry, dimKeys []string) string {
+	keys := append([]string(nil), dimKeys...)
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		if v, ok := entry[k]; ok {
+			parts = append(parts, fmt.Sprintf("%s=%s", k, FormatValue(v)))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,266 @@
+package expander
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Target syntax: "@backend" selects the values of a group from the groups
+// block, "!legacy" drops values, and "terraform:infra" switches the primary
+// dimension to terraform before matching "infra" against its values.
+const (
+	groupPrefix  = "@"
+	negatePrefix = "!"
+	dimensionSep = ":"
+)
+
+// ErrInvalidTarget is returned when a target pattern matches no value or
+// selects an unknown group or several dimensions.
+var ErrInvalidTarget = errors.New("invalid target")
+
+// ResolveTarget handles dimension selection. If dimensionOverride is set (from
+// dimension input), it overrides the config's dimension and removes the old
+// dimension. A target prefixed with a dimension name, e.g. "terraform:infra"
+// or "terraform:*", triggers the same switch. For compatibility, a single
+// target naming a dimension (but not a value of the current dimension)
+// switches too, with a deprecation warning.
+func ResolveTarget(raw RawConfig, optsCfg *OptionsConfig, opts *Options, dimensionOverride string) ([]string, error) {
+	dim, patterns, err := splitTargetDimension(raw, opts.FilterValues)
+	if err != nil {
+		return nil, err
+	}
+	opts.FilterValues = patterns
+
+	var warnings []string
+	switch {
+	case dimensionOverride != "" && isDimension(raw[dimensionOverride]):
+		if dim != "" && dim != dimensionOverride {
+			return nil, fmt.Errorf("%w: target selects dimension %s but the dimension input is %s", ErrInvalidTarget, dim, dimensionOverride)
+		}
+		dim = dimensionOverride
+	case dim == "" && len(patterns) == 1 && isDimension(raw[patterns[0]]) &&
+		!slices.Contains(ExtractDimensionValues(raw, optsCfg.Dimension), patterns[0]):
+		dim = patterns[0]
+		opts.FilterValues = nil
+		warnings = append(warnings, fmt.Sprintf("target %q switches to the %s dimension; use %q instead", dim, dim, dim+dimensionSep+"*"))
+	}
+
+	if dim != "" && dim != optsCfg.Dimension {
+		delete(raw, optsCfg.Dimension)
+		optsCfg.Dimension = dim
+		opts.FilterKey = dim
+	}
+	return warnings, nil
+}
+
+// splitTargetDimension strips dimension prefixes from the targets and
+// returns the dimension they name. "*" and "" after a prefix select every
+// value and are dropped.
+func splitTargetDimension(raw RawConfig, targets []string) (string, []string, error) {
+	var dim string
+	var patterns []string
+	for _, t := range targets {
+		name, pattern, ok := strings.Cut(t, dimensionSep)
+		if !ok || !isDimension(raw[name]) {
+			patterns = append(patterns, t)
+			continue
+		}
+		if dim != "" && dim != name {
+			return "", nil, fmt.Errorf("%w: target selects both the %s and %s dimensions", ErrInvalidTarget, dim, name)
+		}
+		dim = name
+		if pattern != "" && pattern != "*" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return dim, patterns, nil
+}
+
+// MatchTargets resolves target patterns against the values of the primary
+// dimension dim: exact values, glob patterns, groups prefixed with "@" and
+// negations prefixed with "!". Without a positive pattern, negations apply
+// to all values. Glob patterns and negations leave out the disabled values
+// of dim; only naming a disabled value selects it. The result is in the
+// order of values and non-nil; a pattern matching no value is an error that
+// suggests the closest value.
+func MatchTargets(dim string, patterns, values []string, groups map[string][]string, disabled []DisabledValue) ([]string, error) {
+	off := make(map[string]bool)
+	for _, d := range disabled {
+		if d.Dimension == dim {
+			off[d.Value] = true
+		}
+	}
+	selected := make(map[string]bool)
+	excluded := make(map[string]bool)
+	positive := false
+	for _, p := range patterns {
+		name, negated := strings.CutPrefix(p, negatePrefix)
+		matched, err := matchTarget(dim, name, values, groups, off)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidTarget, err)
+		}
+		for _, v := range matched {
+			if negated {
+				excluded[v] = true
+			} else {
+				selected[v] = true
+			}
+		}
+		positive = positive || !negated
+	}
+
+	result := []string{}
+	for _, v := range values {
+		if (!positive && !off[v] || selected[v]) && !excluded[v] {
+			result = append(result, v)
+		}
+	}
+	return result, nil
+}
+
+// matchTarget returns the values one pattern selects. Glob patterns skip
+// the values in off.
+func matchTarget(dim, pattern string, values []string, groups map[string][]string, off map[string]bool) ([]string, error) {
+	if name, ok := strings.CutPrefix(pattern, groupPrefix); ok {
+		members, ok := groups[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown group %q%s", name, didYouMean(name, sortedKeys(groups)))
+		}
+		var matched []string
+		for _, m := range members {
+			mv, err := matchTarget(dim, m, values, nil, off)
+			if err != nil {
+				return nil, fmt.Errorf("group %s: %w", name, err)
+			}
+			matched = append(matched, mv...)
+		}
+		return matched, nil
+	}
+
+	if isGlob(pattern) {
+		if err := ValidateGlob(pattern); err != nil {
+			return nil, err
+		}
+		var matched, skipped []string
+		for _, v := range values {
+			switch {
+			case !MatchGlob(pattern, v):
+			case off[v]:
+				skipped = append(skipped, v)
+			default:
+				matched = append(matched, v)
+			}
+		}
+		if matched == nil && skipped != nil {
+			return nil, fmt.Errorf("%q matches only disabled %s values: %s", pattern, dim, strings.Join(skipped, ", "))
+		}
+		if matched == nil {
+			return nil, fmt.Errorf("%q matches no %s value", pattern, dim)
+		}
+		return matched, nil
+	}
+
+	if !slices.Contains(values, pattern) {
+		candidates := slices.Clone(values)
+		for _, g := range sortedKeys(groups) {
+			candidates = append(candidates, groupPrefix+g)
+		}
+		return nil, fmt.Errorf("unknown %s value %q%s", dim, pattern, didYouMean(pattern, candidates))
+	}
+	return []string{pattern}, nil
+}
+
+// isGlob reports whether a target pattern contains glob metacharacters.
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// didYouMean formats a suggestion for the candidate closest to s, or ""
+// when none is close enough.
+func didYouMean(s string, candidates []string) string {
+	best, bestDist := "", max(1, len(s)/3)+1
+	for _, c := range candidates {
+		if d := editDistance(strings.ToLower(s), strings.ToLower(c)); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return " (did you mean " + strconv.Quote(best) + "?)"
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// groupsDimension reports whether a groups block is a dimension written
+// before groups was reserved for target groups: a list, or a map with
+// per-value configs or empty values instead of lists of values.
+func groupsDimension(val any) bool {
+	if _, ok := toSlice(val); ok {
+		return true
+	}
+	m, _ := val.(map[string]any)
+	for _, members := range m {
+		switch members.(type) {
+		case map[string]any, nil:
+			return true
+		}
+	}
+	return false
+}
+
+// groups checks the groups block: each group is a list of values or glob
+// patterns of the primary dimension.
+func (v *validator) groups(val any) {
+	m, ok := v.object("groups", val)
+	if !ok {
+		return
+	}
+	for _, name := range sortedKeys(m) {
+		path := "groups." + name
+		if strings.ContainsAny(name, groupPrefix+negatePrefix+dimensionSep+",") {
+			v.errorf(path, "group names cannot contain @, !, : or ,")
+			continue
+		}
+		if _, isString := m[name].(string); !isString {
+			before := len(v.errs)
+			v.stringList(path, m[name])
+			if len(v.errs) > before {
+				continue
+			}
+		}
+		for _, member := range toStringList(m[name]) {
+			switch {
+			case strings.HasPrefix(member, groupPrefix) || strings.HasPrefix(member, negatePrefix):
+				v.errorf(path, fmt.Sprintf("%q: groups cannot contain groups or negations", member))
+			case isGlob(member):
+				if err := ValidateGlob(member); err != nil {
+					v.errorf(path, err.Error())
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package expander
+
+import (
+	"strconv"
+	"strings"
+)
+
+// validator collects problems in the reserved blocks of a config, locating
+// each one through the positions of the parsed document.
+type validator struct {
+	file string
+	pos  map[string]position
+	// items maps the paths of list-of-objects items once they are turned
+	// into per-value configs, e.g. "service.api", to their paths in the
+	// document, e.g. "service[0]".
+	items map[string]string
+	errs  ConfigErrors
+}
+
+func (v *validator) errorf(path, msg string) {
+	for value, item := range v.items {
+		if rest, ok := strings.CutPrefix(path, value); ok && (rest == "" || rest[0] == '.') {
+			path = item + rest
+			break
+		}
+	}
+	p := v.pos[path]
+	v.errs = append(v.errs, &ConfigError{File: v.file, Line: p.line, Column: p.column, Path: path, Msg: msg})
+}
+
+// validateConfig checks the types of the reserved top-level blocks and of
+// the reserved keys in per-value configs. Malformed blocks used to be ignored
+// silently; now every problem is reported at once.
+func validateConfig(file string, raw RawConfig, pos map[string]position) ConfigErrors {
+	v := &validator{file: file, pos: pos}
+
+	if s, ok := raw["settings"]; ok && s != nil {
+		if m, ok := v.object("settings", s); ok {
+			v.settings(m)
+		}
+	}
+	if g, ok := raw["global"]; ok && g != nil {
+		v.object("global", g)
+	}
+	for _, key := range []string{"exclude", "include"} {
+		if val, ok := raw[key]; ok && val != nil {
+			v.entries(key, val)
+		}
+	}
+	dims := make(map[string]bool)
+	for key, val := range raw {
+		if isDimension(val) && !reservedKeys[key] {
+			dims[key] = true
+		}
+	}
+	identityKey := defaultIdentityKey
+	if settings, ok := raw["settings"].(map[string]any); ok {
+		if k, ok := settings["identity_key"].(string); ok && k != "" {
+			identityKey = k
+		}
+	}
+	primary := configuredDimension(raw)
+	for _, key := range sortedKeys(raw) {
+		if reservedKeys[key] {
+			continue
+		}
+		if arr, ok := toSlice(raw[key]); ok && objectItems(arr) {
+			v.objectList(key, arr, identityKey)
+			dim := RawConfig{key: arr}
+			normalizeObjectLists(dim, identityKey)
+			v.items = make(map[string]string, len(arr))
+			for i, item := range arr {
+				if obj, ok := item.(map[string]any); ok && obj[identityKey] != nil {
+					v.items[key+"."+FormatValue(obj[identityKey])] = indexPath(key, i)
+				}
+			}
+			v.valueConfigs(key, dim[key].(map[string]any), dims, key == primary)
+			v.items = nil
+		}
+		if dimMap, ok := raw[key].(map[string]any); ok {
+			v.valueConfigs(key, dimMap, dims, key == primary)
+		}
+	}
+	if r, ok := raw["rules"]; ok && r != nil {
+		if arr, ok := toSlice(r); !ok {
+			v.errorf("rules", "must be a list of rules")
+		} else {
+			for i, item := range arr {
+				path := indexPath("rules", i)
+				if m, ok := v.object(path, item); ok {
+					v.rule(path, m)
+				}
+			}
+		}
+	}
+	if g, ok := raw["groups"]; ok && g != nil {
+		if groupsDimension(g) || primary == "groups" {
+			v.errorf("groups", "is reserved for target groups, a map of group names to lists of values; rename the dimension named groups")
+		} else {
+			v.groups(g)
+		}
+	}
+	if p, ok := raw["profiles"]; ok && p != nil {
+		if m, ok := v.object("profiles", p); ok {
+			for _, name := range sortedKeys(m) {
+				path := "profiles." + name
+				if pm, ok := v.object(path, m[name]); ok {
+					v.profile(path, pm)
+				}
+			}
+		}
+	}
+
+	return v.errs
+}
+
+func (v *validator) settings(m map[string]any) {
+	for _, key := range []string{"dimension", "base_dir", "identity_key"} {
+		if val, ok := m[key]; ok {
+			if _, ok := val.(string); !ok {
+				v.errorf("settings."+key, "must be a string")
+			}
+		}
+	}
+	for _, key := range []string{"sort_by", "sensitive", "fields", "omit", "fragment_keys", "required_fields"} {
+		if val, ok := m[key]; ok {
+			v.stringList("settings."+key, val)
+		}
+	}
+	if val, ok := m["ignore_paths"]; ok {
+		v.globs("settings.ignore_paths", val)
+	}
+	if val, ok := m["field_types"]; ok {
+		v.fieldTypes("settings.field_types", val)
+	}
+	for _, key := range []string{"omit_sensitive", "discover_dependencies"} {
+		if val, ok := m[key]; ok {
+			if _, ok := val.(bool); !ok {
+				v.errorf("settings."+key, "must be true or false")
+			}
+		}
+	}
+}
+
+// valueConfigs checks the discover pattern and marker of a discovered
+// dimension and the reserved keys of the per-value configs of a map
+// dimension. The keys reserved in the primary dimension only are checked
+// when primary is set.
+func (v *validator) valueConfigs(key string, dimMap map[string]any, dims map[string]bool, primary bool) {
+	if pattern, _, ok := discoverSpec(dimMap); ok {
+		if err := ValidateGlob(pattern); err != nil {
+			v.errorf(key+"."+discoverKey, err.Error())
+		}
+		if val, ok := dimMap[markerKey]; ok {
+			if _, ok := val.(string); !ok {
+				v.errorf(key+"."+markerKey, "must be a string")
+			}
+		}
+		dimMap = valueConfigMap(dimMap)
+	}
+	for _, value := range sortedKeys(dimMap) {
+		if m, ok := dimMap[value].(map[string]any); ok {
+			if val, ok := m[ignorePathsKey]; ok && primary {
+				v.globs(key+"."+value+"."+ignorePathsKey, val)
+			}
+			if val, ok := m[usesKey]; ok && primary {
+				v.stringList(key+"."+value+"."+usesKey, val)
+			}
+			if val, ok := m[requiredFieldsKey]; ok {
+				v.stringList(key+"."+value+"."+requiredFieldsKey, val)
+			}
+			v.combinations(key+"."+value, m, dims)
+		}
+	}
+}
+
+// configuredDimension returns the primary dimension a config selects,
+// without inputs or profiles: settings.dimension, then the legacy
+// dimension_key settings, then "service".
+func configuredDimension(raw RawConfig) string {
+	settings, _ := raw["settings"].(map[string]any)
+	global, _ := raw["global"].(map[string]any)
+	for _, d := range []any{settings["dimension"], settings["dimension_key"], global["dimension_key"]} {
+		if s, ok := d.(string); ok && s != "" {
+			return s
+		}
+	}
+	return "service"
+}
+
+func (v *validator) profile(path string, m map[string]any) {
+	for _, key := range []string{"target", "environment", "collapse"} {
+		if val, ok := m[key]; ok {
+			if _, isString := val.(string); !isString {
+				v.stringList(path+"."+key, val)
+			}
+		}
+	}
+	for _, key := range []string{"sort_by", "fields", "omit"} {
+		if val, ok := m[key]; ok {
+			v.stringList(path+"."+key, val)
+		}
+	}
+	for _, key := range []string{"exclude", "include"} {
+		if val, ok := m[key]; ok {
+			v.entries(path+"."+key, val)
+		}
+	}
+	if val, ok := m["collapse_policy"]; ok {
+		switch val {
+		case CollapseDrop, CollapseError, CollapseFirst, CollapseList:
+		default:
+			v.errorf(path+".collapse_policy", "must be drop, error, first or list")
+		}
+	}
+}
+
+// object checks that val is a map.
+func (v *validator) object(path string, val any) (map[string]any, bool) {
+	m, ok := val.(map[string]any)
+	if !ok {
+		v.errorf(path, "must be an object")
+	}
+	return m, ok
+}
+
+// stringList checks that val is a list of strings.
+func (v *validator) stringList(path string, val any) {
+	arr, ok := toSlice(val)
+	if !ok {
+		v.errorf(path, "must be a list of strings")
+		return
+	}
+	for i, item := range arr {
+		if _, ok := item.(string); !ok {
+			v.errorf(indexPath(path, i), "must be a string")
+		}
+	}
+}
+
+// globs checks that val is a list of glob patterns.
+func (v *validator) globs(path string, val any) {
+	before := len(v.errs)
+	v.stringList(path, val)
+	if len(v.errs) > before {
+		return
+	}
+	arr, _ := toSlice(val)
+	for i, item := range arr {
+		if err := ValidateGlob(item.(string)); err != nil {
+			v.errorf(indexPath(path, i), err.Error())
+		}
+	}
+}
+
+// entries checks that val is a list of objects.
+func (v *validator) entries(path string, val any) {
+	arr, ok := toSlice(val)
+	if !ok {
+		v.errorf(path, "must be a list of objects")
+		return
+	}
+	for i, item := range arr {
+		if _, ok := item.(map[string]any); !ok {
+			v.errorf(indexPath(path, i), "must be an object")
+		}
+	}
+}
+
+func indexPath(path string, i int) string {
+	return path + "[" + strconv.Itoa(i) + "]"
+}
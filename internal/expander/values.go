@@ -0,0 +1,203 @@
+package expander
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config values are plain JSON-like types: map[string]any, []any, string,
+// bool, nil and json.Number for every number, holding the number as written
+// so that integers such as AWS account IDs never pass through float64.
+// Timestamps stay strings exactly as written.
+
+var (
+	// jsonNumberRe matches numbers that are valid JSON as written.
+	jsonNumberRe = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+	// decimalIntRe matches integers that need no conversion.
+	decimalIntRe = regexp.MustCompile(`^-?(0|[1-9][0-9]*)$`)
+)
+
+// nodeValue converts a parsed YAML node to a config value.
+func nodeValue(n *yaml.Node) (any, error) {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			return nil, nil
+		}
+		return nodeValue(n.Content[0])
+	case yaml.AliasNode:
+		return nodeValue(n.Alias)
+	case yaml.SequenceNode:
+		arr := make([]any, 0, len(n.Content))
+		for _, c := range n.Content {
+			v, err := nodeValue(c)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	case yaml.MappingNode:
+		m := make(map[string]any, len(n.Content)/2)
+		var merges []*yaml.Node
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, val := n.Content[i], n.Content[i+1]
+			if key.ShortTag() == "!!merge" {
+				merges = append(merges, val)
+				continue
+			}
+			v, err := nodeValue(val)
+			if err != nil {
+				return nil, err
+			}
+			m[key.Value] = v
+		}
+		// Keys of the mapping itself win over merged ones, and earlier
+		// merged mappings over later ones.
+		for _, mn := range merges {
+			sources := []*yaml.Node{mn}
+			if mn.Kind == yaml.SequenceNode {
+				sources = mn.Content
+			}
+			for _, src := range sources {
+				v, err := nodeValue(src)
+				if err != nil {
+					return nil, err
+				}
+				merged, ok := v.(map[string]any)
+				if !ok {
+					return nil, fmt.Errorf("line %d: map merge requires a mapping", mn.Line)
+				}
+				for k, mv := range merged {
+					if _, exists := m[k]; !exists {
+						m[k] = mv
+					}
+				}
+			}
+		}
+		return m, nil
+	case yaml.ScalarNode:
+		return scalarValue(n)
+	}
+	return nil, fmt.Errorf("line %d: unsupported YAML node", n.Line)
+}
+
+// scalarValue converts a scalar, keeping numbers and timestamps as written.
+func scalarValue(n *yaml.Node) (any, error) {
+	switch n.ShortTag() {
+	case "!!null":
+		return nil, nil
+	case "!!bool":
+		var b bool
+		if err := n.Decode(&b); err != nil {
+			return nil, err
+		}
+		return b, nil
+	case "!!int":
+		if decimalIntRe.MatchString(strings.TrimPrefix(n.Value, "+")) {
+			return json.Number(strings.TrimPrefix(n.Value, "+")), nil
+		}
+		// Hexadecimal, octal and binary literals.
+		var i any
+		if err := n.Decode(&i); err != nil {
+			return nil, err
+		}
+		switch i := i.(type) {
+		case int:
+			return json.Number(strconv.Itoa(i)), nil
+		case int64:
+			return json.Number(strconv.FormatInt(i, 10)), nil
+		case uint64:
+			return json.Number(strconv.FormatUint(i, 10)), nil
+		}
+		return n.Value, nil
+	case "!!float":
+		if v := strings.TrimPrefix(n.Value, "+"); jsonNumberRe.MatchString(v) {
+			return json.Number(v), nil
+		}
+		var f float64
+		if err := n.Decode(&f); err != nil {
+			return nil, err
+		}
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			// Not representable in JSON.
+			return n.Value, nil
+		}
+		return json.Number(FormatValue(f)), nil
+	default:
+		// Strings, timestamps, binary and custom tags.
+		return n.Value, nil
+	}
+}
+
+// FormatValue renders a config value as a plain string, the same way
+// everywhere values are compared, filtered or emitted: strings as is,
+// numbers and booleans as in JSON, null as "" and maps and lists
+// JSON-encoded.
+func FormatValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return string(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if json.Unmarshal(b, &s) == nil {
+			return s
+		}
+	}
+	return string(b)
+}
+
+// maxSafeInteger is the largest integer that float64, and so JavaScript and
+// many JSON parsers, represent exactly.
+const maxSafeInteger = 1 << 53
+
+// largeNumberWarnings warns about integers that JSON consumers parsing
+// numbers as float64, such as fromJSON in GitHub Actions, would round.
+func largeNumberWarnings(raw RawConfig) []string {
+	var warnings []string
+	var walk func(v any, path string)
+	walk = func(v any, path string) {
+		switch v := v.(type) {
+		case map[string]any:
+			for _, k := range sortedKeys(v) {
+				walk(v[k], joinPath(path, k))
+			}
+		case []any:
+			for i, item := range v {
+				walk(item, indexPath(path, i))
+			}
+		case json.Number:
+			if !decimalIntRe.MatchString(string(v)) {
+				return
+			}
+			if i, err := v.Int64(); err == nil && i <= maxSafeInteger && i >= -maxSafeInteger {
+				return
+			}
+			warnings = append(warnings, fmt.Sprintf("%s: %s is larger than 2^53 and may lose precision where the matrix is parsed as JSON (e.g. fromJSON); quote it to keep it a string", path, v))
+		}
+	}
+	for _, k := range sortedKeys(raw) {
+		walk(raw[k], k)
+	}
+	return warnings
+}
@@ -0,0 +1,210 @@
+// Package formats serializes the expanded matrix into file formats consumed
+// by tools outside of GitHub Actions matrices (Terraform, Make, scripts).
+package formats
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/dnd-it/action-config/v3/internal/expander"
+)
+
+// Supported output formats.
+const (
+	JSON   = "json"
+	YAML   = "yaml"
+	JSONL  = "jsonl"
+	CSV    = "csv"
+	Dotenv = "dotenv"
+)
+
+// FromPath infers the output format from a file extension, defaulting to JSON.
+// The dotenv format writes a directory and must be selected explicitly.
+func FromPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return YAML
+	case ".jsonl", ".ndjson":
+		return JSONL
+	case ".csv":
+		return CSV
+	default:
+		return JSON
+	}
+}
+
+// Marshal encodes the matrix entries in a single-document format.
+// The dotenv format produces one document per entry and is handled by Write.
+func Marshal(format string, entries []expander.MatrixEntry, dimKeys []string) ([]byte, error) {
+	switch format {
+	case JSON:
+		return json.Marshal(entries)
+	case YAML:
+		return yaml.Marshal(entries)
+	case JSONL:
+		var buf bytes.Buffer
+		for _, entry := range entries {
+			line, err := json.Marshal(entry)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(line)
+			buf.WriteByte('\n')
+		}
+		return buf.Bytes(), nil
+	case CSV:
+		return marshalCSV(entries, dimKeys)
+	case Dotenv:
+		return nil, fmt.Errorf("format %q writes one file per entry and cannot be marshalled to a single document", format)
+	default:
+		return nil, fmt.Errorf("unsupported output format %q. Use json, yaml, jsonl, csv, or dotenv", format)
+	}
+}
+
+// Write writes the matrix entries to path in the given format. For the dotenv
+// format, path is a directory and one "<dimension values>.env" file is written
+// per entry; it returns the paths of all files written.
+func Write(path, format string, entries []expander.MatrixEntry, dimKeys []string) ([]string, error) {
+	if format == Dotenv {
+		return writeDotenvFiles(path, entries, dimKeys)
+	}
+
+	data, err := Marshal(format, entries, dimKeys)
+	if err != nil {
+		return nil, err
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create directory for %s: %w", path, err)
+		}
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return []string{path}, nil
+}
+
+// DotenvEntry renders a single entry as KEY=value lines, sorted by key.
+func DotenvEntry(entry expander.MatrixEntry) string {
+	var sb strings.Builder
+	for _, k := range sortedKeys(entry) {
+		fmt.Fprintf(&sb, "%s=%s\n", EnvName(k), quoteDotenv(expander.FormatValue(entry[k])))
+	}
+	return sb.String()
+}
+
+var invalidEnvChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// EnvName converts a field name into a valid environment variable name by
+// replacing unsupported characters with underscores.
+func EnvName(field string) string {
+	name := invalidEnvChars.ReplaceAllString(field, "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// EntryName builds a file-safe name for an entry from its dimension values in
+// dimension key order, e.g. "dev-api". Entries without any dimension values
+// (e.g. from include) fall back to "entry-<index>".
+func EntryName(entry expander.MatrixEntry, dimKeys []string, index int) string {
+	var parts []string
+	for _, dk := range dimKeys {
+		if v, ok := entry[dk]; ok {
+			parts = append(parts, expander.FormatValue(v))
+		}
+	}
+	if len(parts) == 0 {
+		return fmt.Sprintf("entry-%d", index)
+	}
+	name := strings.Join(parts, "-")
+	return strings.NewReplacer("/", "_", "\\", "_", " ", "_").Replace(name)
+}
+
+func writeDotenvFiles(dir string, entries []expander.MatrixEntry, dimKeys []string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+
+	written := make([]string, 0, len(entries))
+	seen := make(map[string]bool, len(entries))
+	for i, entry := range entries {
+		name := EntryName(entry, dimKeys, i)
+		if seen[name] {
+			name = fmt.Sprintf("%s-%d", name, i)
+		}
+		seen[name] = true
+
+		path := filepath.Join(dir, name+".env")
+		if err := os.WriteFile(path, []byte(DotenvEntry(entry)), 0644); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", path, err)
+		}
+		written = append(written, path)
+	}
+	return written, nil
+}
+
+// marshalCSV writes one row per entry. Columns are the dimension keys first,
+// followed by every other field in alphabetical order.
+func marshalCSV(entries []expander.MatrixEntry, dimKeys []string) ([]byte, error) {
+	columns := append([]string{}, dimKeys...)
+	isDim := make(map[string]bool, len(dimKeys))
+	for _, dk := range dimKeys {
+		isDim[dk] = true
+	}
+	fieldSet := make(map[string]bool)
+	for _, entry := range entries {
+		for k := range entry {
+			if !isDim[k] {
+				fieldSet[k] = true
+			}
+		}
+	}
+	columns = append(columns, sortedKeys(fieldSet)...)
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write(columns); err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		row := make([]string, len(columns))
+		for i, col := range columns {
+			row[i] = expander.FormatValue(entry[col])
+		}
+		if err := w.Write(row); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// quoteDotenv double-quotes values containing whitespace, quotes, or shell
+// metacharacters so they survive being sourced.
+func quoteDotenv(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"'`$\\#") {
+		r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "$", `\$`, "`", "\\`")
+		return `"` + r.Replace(s) + `"`
+	}
+	return s
+}
+
+func sortedKeys[M ~map[string]V, V any](m M) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,124 @@
+package formats
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dnd-it/action-config/v3/internal/expander"
+)
+
+func testEntries() []expander.MatrixEntry {
+	return []expander.MatrixEntry{
+		{"environment": "dev", "service": "api", "directory": "deploy/api", "tags": map[string]any{"team": "core"}},
+		{"environment": "prod", "service": "api", "directory": "deploy/api", "note": "has space"},
+	}
+}
+
+func TestFromPath(t *testing.T) {
+	cases := map[string]string{
+		"matrix.json":  JSON,
+		"matrix.yaml":  YAML,
+		"matrix.YML":   YAML,
+		"matrix.jsonl": JSONL,
+		"matrix.csv":   CSV,
+		"matrix":       JSON,
+	}
+	for path, want := range cases {
+		if got := FromPath(path); got != want {
+			t.Errorf("FromPath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestMarshal_JSONL(t *testing.T) {
+	data, err := Marshal(JSONL, testEntries(), []string{"environment", "service"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d: %s", len(lines), data)
+	}
+	if !strings.HasPrefix(lines[0], "{") || !strings.Contains(lines[0], `"environment":"dev"`) {
+		t.Errorf("unexpected first line: %s", lines[0])
+	}
+}
+
+func TestMarshal_CSV(t *testing.T) {
+	data, err := Marshal(CSV, testEntries(), []string{"environment", "service"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "environment,service,directory,note,tags\n" +
+		"dev,api,deploy/api,,\"{\"\"team\"\":\"\"core\"\"}\"\n" +
+		"prod,api,deploy/api,has space,\n"
+	if string(data) != want {
+		t.Errorf("unexpected CSV:\n%s\nwant:\n%s", data, want)
+	}
+}
+
+func TestMarshal_YAML(t *testing.T) {
+	data, err := Marshal(YAML, testEntries(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(string(data), "- directory: deploy/api") {
+		t.Errorf("unexpected YAML:\n%s", data)
+	}
+}
+
+func TestMarshal_UnsupportedFormat(t *testing.T) {
+	if _, err := Marshal("xml", testEntries(), nil); err == nil {
+		t.Fatal("expected error for unsupported format")
+	}
+	if _, err := Marshal(Dotenv, testEntries(), nil); err == nil {
+		t.Fatal("expected error for dotenv via Marshal")
+	}
+}
+
+func TestWrite_Dotenv(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "env")
+	written, err := Write(dir, Dotenv, testEntries(), []string{"environment", "service"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(written) != 2 {
+		t.Fatalf("expected 2 files, got %v", written)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "prod-api.env"))
+	if err != nil {
+		t.Fatalf("expected prod-api.env: %v", err)
+	}
+	want := "directory=deploy/api\nenvironment=prod\nnote=\"has space\"\nservice=api\n"
+	if string(data) != want {
+		t.Errorf("unexpected dotenv:\n%s\nwant:\n%s", data, want)
+	}
+}
+
+func TestWrite_CreatesParentDirectory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out", "matrix.json")
+	if _, err := Write(path, JSON, testEntries(), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected file to exist: %v", err)
+	}
+}
+
+func TestEntryName_FallsBackToIndex(t *testing.T) {
+	if got := EntryName(expander.MatrixEntry{"foo": "bar"}, []string{"service"}, 3); got != "entry-3" {
+		t.Errorf("expected entry-3, got %q", got)
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	if got := EnvName("aws.region-name"); got != "aws_region_name" {
+		t.Errorf("unexpected env name %q", got)
+	}
+	if got := EnvName("1st"); got != "_1st" {
+		t.Errorf("unexpected env name %q", got)
+	}
+}
@@ -1,52 +1,198 @@
-// Package git detects changed files using git diff.
+// Package git detects changed files in the checked-out repository.
 package git
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"strings"
 )
 
-// DetectChangedFiles returns the list of changed file paths by running git diff.
-// It determines the diff base from GitHub Actions environment variables:
-//   - pull_request: diffs against origin/{GITHUB_BASE_REF}
-//   - push: diffs against HEAD~1
-//   - workflow_dispatch or other: returns nil (no filtering)
-func DetectChangedFiles() ([]string, error) {
-	eventName := os.Getenv("GITHUB_EVENT_NAME")
+// request describes the diff to compute, derived from the GitHub Actions
+// environment.
+type request struct {
+	workspace string
+	event     string
+	baseRef   string
+	// ref is the fetched ref of the checkout, e.g. refs/pull/1/merge.
+	ref string
+	// prCommits is the number of commits in the pull request, from the event
+	// payload, or 0 when unknown.
+	prCommits int
+}
 
-	workspace := os.Getenv("GITHUB_WORKSPACE")
-	if workspace == "" {
-		workspace = "."
+// requestFromEnv reads the diff request from GitHub Actions variables.
+func requestFromEnv() request {
+	req := request{
+		workspace: os.Getenv("GITHUB_WORKSPACE"),
+		event:     os.Getenv("GITHUB_EVENT_NAME"),
+		baseRef:   os.Getenv("GITHUB_BASE_REF"),
+		ref:       os.Getenv("GITHUB_REF"),
+	}
+	if req.workspace == "" {
+		req.workspace = "."
+	}
+	if path := os.Getenv("GITHUB_EVENT_PATH"); path != "" {
+		if data, err := os.ReadFile(path); err == nil {
+			var payload struct {
+				PullRequest struct {
+					Commits int `json:"commits"`
+				} `json:"pull_request"`
+			}
+			if json.Unmarshal(data, &payload) == nil {
+				req.prCommits = payload.PullRequest.Commits
+			}
+		}
 	}
+	return req
+}
 
-	// Mark workspace as safe to avoid "dubious ownership" errors in containers.
-	safe := exec.Command("git", "config", "--global", "--add", "safe.directory", workspace)
-	_ = safe.Run()
+// depthForPR returns the fetch-depth that reaches the merge base from the
+// merge commit actions/checkout creates for a pull request: the merge commit
+// itself, the pull request's commits and the merge base.
+func (r request) depthForPR() int {
+	if r.prCommits == 0 {
+		return 0
+	}
+	return r.prCommits + 2
+}
 
-	var args []string
-	switch eventName {
+// Options controls DetectChangedFiles.
+type Options struct {
+	// MaxFetchDepth bounds how many commits a shallow clone is deepened by
+	// to reach the diff base. Zero disables fetching.
+	MaxFetchDepth int
+	// Log receives progress messages, e.g. about fetched history.
+	Log func(msg string)
+}
+
+// initialDeepen is the first deepening step when the needed depth is unknown.
+const initialDeepen = 10
+
+// runGit runs a git command in dir; replaced in tests.
+var runGit = func(dir string, args ...string) error {
+	// Trust the workspace for this command only, instead of adding it to
+	// the global safe.directory list.
+	cmd := exec.Command("git", append([]string{"-c", "safe.directory=*"}, args...)...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git %s failed: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// DetectChangedFiles returns the list of changed file paths in GITHUB_WORKSPACE.
+// It determines the diff base from GitHub Actions environment variables:
+//   - pull_request: diffs against the merge base with origin/{GITHUB_BASE_REF}
+//   - push: diffs against HEAD~1
+//   - workflow_dispatch or other: returns nil (no filtering)
+//
+// A diff without changes, e.g. of an empty commit, returns an empty, non-nil
+// list, unlike an event without a diff base. The action includes every
+// entry in both cases.
+//
+// The repository is read directly. When a shallow clone lacks the diff base,
+// history is fetched in growing steps up to opts.MaxFetchDepth commits. If
+// reading fails for any reason other than missing history (*ShallowError),
+// it falls back to running git diff.
+func DetectChangedFiles(opts Options) ([]string, error) {
+	req := requestFromEnv()
+	switch req.event {
 	case "pull_request", "pull_request_target":
-		baseRef := os.Getenv("GITHUB_BASE_REF")
-		if baseRef == "" {
-			return nil, fmt.Errorf("GITHUB_BASE_REF not set for %s event", eventName)
+		if req.baseRef == "" {
+			return nil, fmt.Errorf("GITHUB_BASE_REF not set for %s event", req.event)
 		}
-		args = []string{"diff", "--name-only", "origin/" + baseRef + "...HEAD"}
 	case "push":
-		args = []string{"diff", "--name-only", "HEAD~1"}
 	default:
 		return nil, nil
 	}
 
-	cmd := exec.Command("git", args...)
-	cmd.Dir = workspace
+	files, err := nativeChangedFiles(req)
+	deepened := 0
+	for {
+		var shallow *ShallowError
+		if !errors.As(err, &shallow) {
+			break
+		}
+		if deepened >= opts.MaxFetchDepth {
+			if deepened > 0 {
+				return nil, fmt.Errorf("%w (fetched %d more commits, max_fetch_depth is %d)", err, deepened, opts.MaxFetchDepth)
+			}
+			return nil, err
+		}
+
+		step := deepened
+		if step == 0 {
+			step = initialDeepen
+			if shallow.Depth > 1 {
+				step = shallow.Depth - 1
+			}
+		}
+		step = min(step, opts.MaxFetchDepth-deepened)
+		if fetchErr := deepen(req, shallow, step); fetchErr != nil {
+			return nil, fmt.Errorf("%w; fetching more history failed: %v", err, fetchErr)
+		}
+		deepened += step
+		if opts.Log != nil {
+			opts.Log(fmt.Sprintf("Shallow clone is missing %s, fetched %d more commits", shallow.Missing, deepened))
+		}
+		files, err = nativeChangedFiles(req)
+	}
+	if err == nil {
+		return files, nil
+	}
+
+	files, execErr := execChangedFiles(req)
+	if execErr != nil {
+		return nil, fmt.Errorf("%w (git fallback: %v)", err, execErr)
+	}
+	return files, nil
+}
+
+// deepen fetches step more commits of history for the checked-out ref and,
+// for pull requests, the base branch. A base branch that was not fetched at
+// all is fetched with that depth instead.
+func deepen(req request, shallow *ShallowError, step int) error {
+	args := []string{"fetch", "--no-tags", "--no-recurse-submodules"}
+	if shallow.Branch != "" {
+		return runGit(req.workspace, append(args, fmt.Sprintf("--depth=%d", step+1), "origin", baseRefspec(shallow.Branch))...)
+	}
+	args = append(args, fmt.Sprintf("--deepen=%d", step), "origin")
+	if req.ref != "" {
+		args = append(args, req.ref)
+	}
+	if req.baseRef != "" {
+		args = append(args, baseRefspec(req.baseRef))
+	}
+	return runGit(req.workspace, args...)
+}
+
+// baseRefspec fetches a branch into its remote-tracking ref.
+func baseRefspec(branch string) string {
+	return fmt.Sprintf("+refs/heads/%s:refs/remotes/origin/%s", branch, branch)
+}
+
+// execChangedFiles runs git diff.
+func execChangedFiles(req request) ([]string, error) {
+	var args []string
+	if req.event == "push" {
+		args = []string{"diff", "--name-only", "HEAD~1"}
+	} else {
+		args = []string{"diff", "--name-only", "origin/" + req.baseRef + "...HEAD"}
+	}
+
+	// Trust the workspace for this command only, as runGit does, to avoid
+	// "dubious ownership" errors in containers.
+	cmd := exec.Command("git", append([]string{"-c", "safe.directory=*"}, args...)...)
+	cmd.Dir = req.workspace
 	output, err := cmd.Output()
 	if err != nil {
 		return nil, fmt.Errorf("git %s failed: %w", strings.Join(args, " "), err)
 	}
 
-	var files []string
+	files := []string{}
 	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
 		if line != "" {
 			files = append(files, line)
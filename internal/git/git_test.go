@@ -0,0 +1,355 @@
+package git
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// testRepo is a repository in a temp dir with helpers to commit files.
+type testRepo struct {
+	t    *testing.T
+	dir  string
+	repo *gogit.Repository
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	t.Helper()
+	dir := t.TempDir()
+	repo, err := gogit.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testRepo{t: t, dir: dir, repo: repo}
+}
+
+// commit writes the given files and commits them, returning the hash.
+func (r *testRepo) commit(files ...string) plumbing.Hash {
+	r.t.Helper()
+	wt, err := r.repo.Worktree()
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	for _, f := range files {
+		path := filepath.Join(r.dir, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			r.t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(time.Now().String()), 0644); err != nil {
+			r.t.Fatal(err)
+		}
+		if _, err := wt.Add(f); err != nil {
+			r.t.Fatal(err)
+		}
+	}
+	hash, err := wt.Commit("change", &gogit.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return hash
+}
+
+func (r *testRepo) setRef(name plumbing.ReferenceName, hash plumbing.Hash) {
+	r.t.Helper()
+	if err := r.repo.Storer.SetReference(plumbing.NewHashReference(name, hash)); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+func (r *testRepo) checkout(branch plumbing.ReferenceName, create bool) {
+	r.t.Helper()
+	wt, _ := r.repo.Worktree()
+	if err := wt.Checkout(&gogit.CheckoutOptions{Branch: branch, Create: create}); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+// makeShallow marks HEAD as a shallow boundary and deletes its parent, as a
+// fetch-depth: 1 checkout would. The returned func undoes it, like a fetch.
+func (r *testRepo) makeShallow() (restore func()) {
+	r.t.Helper()
+	head, _ := r.repo.Head()
+	commit, _ := r.repo.CommitObject(head.Hash())
+	if err := r.repo.Storer.SetShallow([]plumbing.Hash{head.Hash()}); err != nil {
+		r.t.Fatal(err)
+	}
+	parent := commit.ParentHashes[0].String()
+	path := filepath.Join(r.dir, ".git", "objects", parent[:2], parent[2:])
+	data, err := os.ReadFile(path)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		r.t.Fatal(err)
+	}
+	return func() {
+		_ = os.WriteFile(path, data, 0444)
+		_ = r.repo.Storer.SetShallow(nil)
+	}
+}
+
+// fakeGit replaces runGit, recording each call and running fn.
+func fakeGit(t *testing.T, fn func(args []string)) *[][]string {
+	var calls [][]string
+	orig := runGit
+	runGit = func(_ string, args ...string) error {
+		calls = append(calls, args)
+		fn(args)
+		return nil
+	}
+	t.Cleanup(func() { runGit = orig })
+	return &calls
+}
+
+func setPushEnv(t *testing.T, dir string) {
+	t.Setenv("GITHUB_WORKSPACE", dir)
+	t.Setenv("GITHUB_EVENT_NAME", "push")
+	t.Setenv("GITHUB_REF", "refs/heads/main")
+	t.Setenv("GITHUB_EVENT_PATH", "")
+}
+
+func TestNativeChangedFiles_Push(t *testing.T) {
+	r := newTestRepo(t)
+	r.commit("README.md", "deploy/api/main.tf")
+	r.commit("deploy/api/main.tf", "deploy/frontend/main.tf")
+
+	files, err := nativeChangedFiles(request{workspace: r.dir, event: "push"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"deploy/api/main.tf", "deploy/frontend/main.tf"}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("expected %v, got %v", want, files)
+	}
+}
+
+func TestExecChangedFiles_KeepsGlobalConfig(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", home)
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(home, ".gitconfig"))
+	r := newTestRepo(t)
+	r.commit("README.md")
+	r.commit("deploy/api/main.tf")
+
+	files, err := execChangedFiles(request{workspace: r.dir, event: "push"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(files, []string{"deploy/api/main.tf"}) {
+		t.Errorf("unexpected files %v", files)
+	}
+	if _, err := os.Stat(filepath.Join(home, ".gitconfig")); !os.IsNotExist(err) {
+		t.Errorf("expected the global git config to be left alone, got %v", err)
+	}
+}
+
+func TestNativeChangedFiles_PushFirstCommit(t *testing.T) {
+	r := newTestRepo(t)
+	r.commit("deploy/api/main.tf")
+
+	files, err := nativeChangedFiles(request{workspace: r.dir, event: "push"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(files, []string{"deploy/api/main.tf"}) {
+		t.Errorf("unexpected files %v", files)
+	}
+}
+
+func TestNativeChangedFiles_PullRequestUsesMergeBase(t *testing.T) {
+	r := newTestRepo(t)
+	base := r.commit("README.md")
+	r.checkout(plumbing.NewBranchReferenceName("feature"), true)
+	r.commit("deploy/api/main.tf")
+
+	// main moved on after the branch point; its changes are not part of the PR.
+	r.checkout(plumbing.Master, false)
+	r.commit("deploy/frontend/main.tf")
+	mainTip, _ := r.repo.Head()
+	r.setRef(plumbing.NewRemoteReferenceName("origin", "main"), mainTip.Hash())
+	r.checkout(plumbing.NewBranchReferenceName("feature"), false)
+
+	files, err := nativeChangedFiles(request{workspace: r.dir, event: "pull_request", baseRef: "main"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(files, []string{"deploy/api/main.tf"}) {
+		t.Errorf("expected only the PR's changes since %s, got %v", base, files)
+	}
+}
+
+func TestNativeChangedFiles_PullRequestMergeCommit(t *testing.T) {
+	r := newTestRepo(t)
+	r.commit("README.md")
+	r.checkout(plumbing.NewBranchReferenceName("feature"), true)
+	featureTip := r.commit("deploy/api/main.tf")
+	r.checkout(plumbing.Master, false)
+	mainTip := r.commit("deploy/frontend/main.tf")
+
+	// Like refs/pull/N/merge: main merged with the PR, no origin/main ref.
+	r.checkout(plumbing.NewBranchReferenceName("merge"), true)
+	r.commit("deploy/api/main.tf")
+	head, _ := r.repo.Head()
+	headCommit, _ := r.repo.CommitObject(head.Hash())
+	tree, _ := headCommit.Tree()
+	merge := &object.Commit{
+		Author:       object.Signature{Name: "test", When: time.Now()},
+		Committer:    object.Signature{Name: "test", When: time.Now()},
+		Message:      "merge",
+		TreeHash:     tree.Hash,
+		ParentHashes: []plumbing.Hash{mainTip, featureTip},
+	}
+	obj := r.repo.Storer.NewEncodedObject()
+	if err := merge.Encode(obj); err != nil {
+		t.Fatal(err)
+	}
+	mergeHash, err := r.repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.setRef(plumbing.HEAD, mergeHash)
+
+	files, err := nativeChangedFiles(request{workspace: r.dir, event: "pull_request", baseRef: "main"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(files, []string{"deploy/api/main.tf"}) {
+		t.Errorf("expected only the PR's changes, got %v", files)
+	}
+}
+
+func TestNativeChangedFiles_ShallowPush(t *testing.T) {
+	r := newTestRepo(t)
+	r.commit("README.md")
+	r.commit("deploy/api/main.tf")
+	r.makeShallow()
+
+	_, err := nativeChangedFiles(request{workspace: r.dir, event: "push"})
+	var shallow *ShallowError
+	if !errors.As(err, &shallow) {
+		t.Fatalf("expected ShallowError, got %v", err)
+	}
+	if shallow.Depth != 2 {
+		t.Errorf("expected fetch-depth 2, got %d", shallow.Depth)
+	}
+}
+
+func TestDetectChangedFiles_DeepensShallowClone(t *testing.T) {
+	r := newTestRepo(t)
+	r.commit("README.md")
+	r.commit("deploy/api/main.tf")
+	restore := r.makeShallow()
+	setPushEnv(t, r.dir)
+	calls := fakeGit(t, func([]string) { restore() })
+
+	var logs []string
+	files, err := DetectChangedFiles(Options{MaxFetchDepth: 50, Log: func(msg string) { logs = append(logs, msg) }})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(files, []string{"deploy/api/main.tf"}) {
+		t.Errorf("unexpected files %v", files)
+	}
+	want := [][]string{{"fetch", "--no-tags", "--no-recurse-submodules", "--deepen=1", "origin", "refs/heads/main"}}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Errorf("expected %v, got %v", want, *calls)
+	}
+	if len(logs) != 1 {
+		t.Errorf("expected one log message, got %v", logs)
+	}
+}
+
+func TestDetectChangedFiles_MaxFetchDepth(t *testing.T) {
+	r := newTestRepo(t)
+	r.commit("README.md")
+	r.commit("deploy/api/main.tf")
+	r.makeShallow()
+	setPushEnv(t, r.dir)
+	calls := fakeGit(t, func([]string) {})
+
+	_, err := DetectChangedFiles(Options{MaxFetchDepth: 6})
+	var shallow *ShallowError
+	if !errors.As(err, &shallow) {
+		t.Fatalf("expected ShallowError, got %v", err)
+	}
+	// Steps double from the needed depth and stop at the bound: 1+1+2+2.
+	var steps []string
+	for _, c := range *calls {
+		steps = append(steps, c[3])
+	}
+	if want := []string{"--deepen=1", "--deepen=1", "--deepen=2", "--deepen=2"}; !reflect.DeepEqual(steps, want) {
+		t.Errorf("expected %v, got %v", want, steps)
+	}
+
+	*calls = nil
+	if _, err := DetectChangedFiles(Options{}); !errors.As(err, &shallow) || len(*calls) != 0 {
+		t.Errorf("expected no fetch with max_fetch_depth 0, got %v (%v)", *calls, err)
+	}
+}
+
+func TestNativeChangedFiles_MissingBaseRef(t *testing.T) {
+	r := newTestRepo(t)
+	r.commit("README.md")
+
+	// A full clone without the base branch is not fixed by fetching history.
+	_, err := nativeChangedFiles(request{workspace: r.dir, event: "pull_request", baseRef: "main", prCommits: 3})
+	var shallow *ShallowError
+	if err == nil || errors.As(err, &shallow) {
+		t.Fatalf("expected a plain error, got %v", err)
+	}
+	if !errors.Is(err, plumbing.ErrReferenceNotFound) {
+		t.Errorf("expected ErrReferenceNotFound, got %v", err)
+	}
+}
+
+func TestNativeChangedFiles_ShallowMissingBaseRef(t *testing.T) {
+	r := newTestRepo(t)
+	r.commit("README.md")
+	r.commit("main.go")
+	r.makeShallow()
+
+	_, err := nativeChangedFiles(request{workspace: r.dir, event: "pull_request", baseRef: "main", prCommits: 3})
+	var shallow *ShallowError
+	if !errors.As(err, &shallow) {
+		t.Fatalf("expected ShallowError, got %v", err)
+	}
+	if shallow.Depth != 5 || shallow.Branch != "main" {
+		t.Errorf("expected fetch-depth 5 for branch main, got %+v", shallow)
+	}
+}
+
+func TestRequestFromEnv_PullRequestCommits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "event.json")
+	if err := os.WriteFile(path, []byte(`{"pull_request": {"commits": 4}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GITHUB_EVENT_PATH", path)
+	t.Setenv("GITHUB_WORKSPACE", "")
+
+	req := requestFromEnv()
+	if req.prCommits != 4 || req.workspace != "." {
+		t.Errorf("unexpected request %+v", req)
+	}
+}
+
+func TestDetectChangedFiles_NotApplicable(t *testing.T) {
+	t.Setenv("GITHUB_EVENT_NAME", "workflow_dispatch")
+	files, err := DetectChangedFiles(Options{})
+	if err != nil || files != nil {
+		t.Errorf("expected nil files and error, got %v, %v", files, err)
+	}
+}
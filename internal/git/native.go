@@ -0,0 +1,143 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// ShallowError reports that the checkout does not contain enough history to
+// compute the diff.
+type ShallowError struct {
+	// Depth is the fetch-depth needed, or 0 when only full history helps.
+	Depth int
+	// Missing describes the commit or ref that could not be found.
+	Missing string
+	// Branch is set when the base branch itself was not fetched.
+	Branch string
+}
+
+func (e *ShallowError) Error() string {
+	if e.Depth > 0 {
+		return fmt.Sprintf("checkout is missing %s; change detection needs actions/checkout with fetch-depth: %d or more (0 for full history)", e.Missing, e.Depth)
+	}
+	return fmt.Sprintf("checkout is missing %s; change detection needs actions/checkout with fetch-depth: 0", e.Missing)
+}
+
+// nativeChangedFiles computes the changed files by reading the repository
+// directly with go-git.
+func nativeChangedFiles(req request) ([]string, error) {
+	repo, err := gogit.PlainOpenWithOptions(req.workspace, &gogit.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open repository in %s: %w", req.workspace, err)
+	}
+	shallow, err := repo.Storer.Shallow()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read shallow commits: %w", err)
+	}
+	isShallow := len(shallow) > 0
+
+	headRef, err := repo.Head()
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve HEAD: %w", err)
+	}
+	head, err := repo.CommitObject(headRef.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read HEAD commit: %w", err)
+	}
+
+	var base *object.Commit
+	switch req.event {
+	case "push":
+		if head.NumParents() == 0 {
+			if isShallow {
+				return nil, &ShallowError{Depth: 2, Missing: "the parent of HEAD"}
+			}
+			// The first commit of a repository: everything is new.
+			return diffTrees(nil, head)
+		}
+		base, err = head.Parent(0)
+		if err != nil {
+			if isShallow || errors.Is(err, plumbing.ErrObjectNotFound) {
+				return nil, &ShallowError{Depth: 2, Missing: "the parent of HEAD"}
+			}
+			return nil, fmt.Errorf("failed to read parent of HEAD: %w", err)
+		}
+	case "pull_request", "pull_request_target":
+		refName := plumbing.NewRemoteReferenceName("origin", req.baseRef)
+		ref, err := repo.Reference(refName, true)
+		if err != nil && head.NumParents() == 2 {
+			// actions/checkout checks out the merge commit of the pull
+			// request and does not fetch the base branch. Its first parent
+			// is the base branch tip, so the diff against it is the PR.
+			base, err = head.Parent(0)
+			if err != nil {
+				return nil, &ShallowError{Depth: 2, Missing: "the first parent of the merge commit"}
+			}
+			break
+		}
+		if err != nil {
+			if isShallow {
+				return nil, &ShallowError{Depth: req.depthForPR(), Missing: refName.Short(), Branch: req.baseRef}
+			}
+			return nil, fmt.Errorf("failed to resolve %s: %w", refName.Short(), err)
+		}
+		baseTip, err := repo.CommitObject(ref.Hash())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", refName.Short(), err)
+		}
+		bases, err := head.MergeBase(baseTip)
+		if (err != nil || len(bases) == 0) && isShallow {
+			return nil, &ShallowError{Depth: req.depthForPR(), Missing: "the merge base of HEAD and " + refName.Short()}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to find merge base with %s: %w", refName.Short(), err)
+		}
+		if len(bases) == 0 {
+			return nil, fmt.Errorf("HEAD and %s have no common history", refName.Short())
+		}
+		base = bases[0]
+	default:
+		return nil, nil
+	}
+
+	return diffTrees(base, head)
+}
+
+// diffTrees returns the sorted paths that differ between the trees of two
+// commits. Renames are reported under both names. A nil base is an empty tree.
+// Identical trees yield an empty, non-nil list.
+func diffTrees(base, head *object.Commit) ([]string, error) {
+	headTree, err := head.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tree of %s: %w", head.Hash, err)
+	}
+	baseTree := &object.Tree{}
+	if base != nil {
+		if baseTree, err = base.Tree(); err != nil {
+			return nil, fmt.Errorf("failed to read tree of %s: %w", base.Hash, err)
+		}
+	}
+
+	changes, err := object.DiffTree(baseTree, headTree)
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff %s: %w", head.Hash, err)
+	}
+
+	seen := make(map[string]bool)
+	files := []string{}
+	for _, c := range changes {
+		for _, name := range []string{c.From.Name, c.To.Name} {
+			if name != "" && !seen[name] {
+				seen[name] = true
+				files = append(files, name)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
@@ -3,54 +3,105 @@ package inputs
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
-	"github.com/dnd-it/action-config/internal/expander"
+	"github.com/dnd-it/action-config/v3/pkg/matrix"
 )
 
 // Config holds all parsed input values.
 type Config struct {
-	ConfigPath      string
-	Dimension       string
-	Target          string
-	Environment     string
-	Exclude         string
-	Include         string
-	ChangeDetection bool
-	Summary         bool
+	ConfigPath         string
+	Dimension          string
+	Target             string
+	Environment        string
+	Exclude            string
+	Include            string
+	ChangeDetection    bool
+	ChangedFiles       string
+	IgnorePaths        string
+	MaxFetchDepth      string
+	OnDetectionFailure string
+	Summary            bool
+	OutputFile         string
+	OutputFormat       string
+	ExportEnv          bool
+	Backend            string
+	Fields             string
+	Omit               string
+	Profile            string
+	Collapse           string
+	CollapsePolicy     string
+	GroupBy            string
+	FlatOutputs        string
+	FlatOutputsPrefix  string
+	Lint               bool
+	// Workspace is the repository checkout, from GITHUB_WORKSPACE rather
+	// than an input.
+	Workspace string
 }
 
 // Parse reads inputs from environment variables.
 func Parse() *Config {
 	return &Config{
-		ConfigPath:      getEnv("CONFIG_PATH", ".github/matrix-config.yaml"),
-		Dimension:       getEnv("DIMENSION", ""),
-		Target:          getEnv("TARGET", ""),
-		Environment:     getEnv("ENVIRONMENT", ""),
-		Exclude:         getEnv("EXCLUDE", ""),
-		Include:         getEnv("INCLUDE", ""),
-		ChangeDetection: getEnv("CHANGE_DETECTION", "false") == "true",
-		Summary:         getEnv("SUMMARY", "true") != "false",
+		ConfigPath:         getEnv("CONFIG_PATH", ".github/matrix-config.yaml"),
+		Dimension:          getEnv("DIMENSION", ""),
+		Target:             getEnv("TARGET", ""),
+		Environment:        getEnv("ENVIRONMENT", ""),
+		Exclude:            getEnv("EXCLUDE", ""),
+		Include:            getEnv("INCLUDE", ""),
+		ChangeDetection:    getEnv("CHANGE_DETECTION", "false") == "true",
+		ChangedFiles:       getEnv("CHANGED_FILES", ""),
+		IgnorePaths:        getEnv("CHANGE_DETECTION_IGNORE", ""),
+		MaxFetchDepth:      getEnv("MAX_FETCH_DEPTH", "100"),
+		OnDetectionFailure: getEnv("ON_DETECTION_FAILURE", "all"),
+		Summary:            getEnv("SUMMARY", "true") != "false",
+		OutputFile:         getEnv("OUTPUT_FILE", ""),
+		OutputFormat:       getEnv("OUTPUT_FORMAT", ""),
+		ExportEnv:          getEnv("EXPORT_ENV", "false") == "true",
+		Backend:            getEnv("BACKEND", ""),
+		Fields:             getEnv("FIELDS", ""),
+		Omit:               getEnv("OMIT", ""),
+		Profile:            getEnv("PROFILE", ""),
+		Collapse:           getEnv("COLLAPSE", ""),
+		CollapsePolicy:     getEnv("COLLAPSE_POLICY", ""),
+		GroupBy:            getEnv("GROUP_BY", ""),
+		FlatOutputs:        getEnv("FLAT_OUTPUTS", "uniform"),
+		FlatOutputsPrefix:  getEnv("FLAT_OUTPUTS_PREFIX", ""),
+		Lint:               getEnv("LINT", "false") == "true",
+		Workspace:          os.Getenv("GITHUB_WORKSPACE"),
 	}
 }
 
-// BuildExpanderOptions converts raw input strings to typed expander.Options.
-func (c *Config) BuildExpanderOptions() (expander.Options, error) {
-	opts := expander.Options{
-		FilterValues:      parseList(c.Target, ","),
-		EnvironmentFilter: parseList(c.Environment, ","),
+// MatrixOptions converts raw input strings to matrix.Options. The selected
+// profile is resolved by matrix.Expand.
+func (c *Config) MatrixOptions() (matrix.Options, error) {
+	opts := matrix.Options{
+		Dimension:   c.Dimension,
+		Profile:     c.Profile,
+		Target:      parseList(c.Target, ","),
+		Environment: parseList(c.Environment, ","),
+		Fields:      parseList(c.Fields, ","),
+		Omit:        parseList(c.Omit, ","),
+		Collapse:    parseList(c.Collapse, ","),
+		IgnorePaths: parseLines(c.IgnorePaths),
+		Root:        c.Workspace,
+		Event:       eventContext(),
+		// Empty falls back to the profile's policy, then to drop.
+		CollapsePolicy: c.CollapsePolicy,
 	}
 
 	if c.Exclude != "" {
-		if err := json.Unmarshal([]byte(c.Exclude), &opts.InputExclude); err != nil {
+		if err := decodeJSON(c.Exclude, &opts.Exclude); err != nil {
 			return opts, fmt.Errorf("invalid exclude JSON: %w", err)
 		}
 	}
 
 	if c.Include != "" {
-		if err := json.Unmarshal([]byte(c.Include), &opts.InputInclude); err != nil {
+		if err := decodeJSON(c.Include, &opts.Include); err != nil {
 			return opts, fmt.Errorf("invalid include JSON: %w", err)
 		}
 	}
@@ -58,6 +109,172 @@ func (c *Config) BuildExpanderOptions() (expander.Options, error) {
 	return opts, nil
 }
 
+// OutputPath returns the output_file input, joined with the workspace when
+// it is relative, or "" when it is not set.
+func (c *Config) OutputPath() string {
+	if c.OutputFile == "" || filepath.IsAbs(c.OutputFile) || c.Workspace == "" {
+		return c.OutputFile
+	}
+	return filepath.Join(c.Workspace, c.OutputFile)
+}
+
+// eventContext returns the event context that rules see as event, from the
+// variables of the CI system running the action. Event names and refs use
+// the GitHub Actions forms, e.g. "pull_request" and "refs/heads/main", so
+// that rules work on every CI system. Unset variables are empty strings.
+func eventContext() map[string]any {
+	switch {
+	case os.Getenv("GITLAB_CI") == "true":
+		return gitlabEvent()
+	case os.Getenv("BUILDKITE") == "true":
+		return buildkiteEvent()
+	case strings.EqualFold(os.Getenv("TF_BUILD"), "true"):
+		return azureEvent()
+	}
+	return map[string]any{
+		"name":       os.Getenv("GITHUB_EVENT_NAME"),
+		"ref":        os.Getenv("GITHUB_REF"),
+		"base_ref":   os.Getenv("GITHUB_BASE_REF"),
+		"head_ref":   os.Getenv("GITHUB_HEAD_REF"),
+		"actor":      os.Getenv("GITHUB_ACTOR"),
+		"repository": os.Getenv("GITHUB_REPOSITORY"),
+	}
+}
+
+// gitlabEvent maps the GitLab CI predefined variables.
+func gitlabEvent() map[string]any {
+	name := os.Getenv("CI_PIPELINE_SOURCE")
+	switch name {
+	case "merge_request_event":
+		name = "pull_request"
+	case "web":
+		name = "workflow_dispatch"
+	}
+	ref := ""
+	switch {
+	case os.Getenv("CI_COMMIT_TAG") != "":
+		ref = "refs/tags/" + os.Getenv("CI_COMMIT_TAG")
+	case os.Getenv("CI_MERGE_REQUEST_IID") != "":
+		ref = "refs/merge-requests/" + os.Getenv("CI_MERGE_REQUEST_IID") + "/head"
+	case os.Getenv("CI_COMMIT_BRANCH") != "":
+		ref = "refs/heads/" + os.Getenv("CI_COMMIT_BRANCH")
+	}
+	return map[string]any{
+		"name":       name,
+		"ref":        ref,
+		"base_ref":   os.Getenv("CI_MERGE_REQUEST_TARGET_BRANCH_NAME"),
+		"head_ref":   os.Getenv("CI_MERGE_REQUEST_SOURCE_BRANCH_NAME"),
+		"actor":      os.Getenv("GITLAB_USER_LOGIN"),
+		"repository": os.Getenv("CI_PROJECT_PATH"),
+	}
+}
+
+// buildkiteEvent maps the Buildkite environment variables.
+func buildkiteEvent() map[string]any {
+	name := os.Getenv("BUILDKITE_SOURCE")
+	pr := os.Getenv("BUILDKITE_PULL_REQUEST")
+	switch {
+	case pr != "" && pr != "false":
+		name = "pull_request"
+	case name == "webhook":
+		name = "push"
+	case name == "ui" || name == "api":
+		name = "workflow_dispatch"
+	}
+	ref := "refs/heads/" + os.Getenv("BUILDKITE_BRANCH")
+	if tag := os.Getenv("BUILDKITE_TAG"); tag != "" {
+		ref = "refs/tags/" + tag
+	}
+	event := map[string]any{
+		"name":       name,
+		"ref":        ref,
+		"base_ref":   os.Getenv("BUILDKITE_PULL_REQUEST_BASE_BRANCH"),
+		"head_ref":   "",
+		"actor":      os.Getenv("BUILDKITE_BUILD_CREATOR_EMAIL"),
+		"repository": os.Getenv("BUILDKITE_REPO"),
+	}
+	if name == "pull_request" {
+		event["head_ref"] = os.Getenv("BUILDKITE_BRANCH")
+	}
+	return event
+}
+
+// azureEvent maps the Azure Pipelines predefined variables.
+func azureEvent() map[string]any {
+	name := os.Getenv("BUILD_REASON")
+	switch name {
+	case "IndividualCI", "BatchedCI":
+		name = "push"
+	case "PullRequest":
+		name = "pull_request"
+	case "Schedule":
+		name = "schedule"
+	case "Manual":
+		name = "workflow_dispatch"
+	}
+	return map[string]any{
+		"name":       name,
+		"ref":        os.Getenv("BUILD_SOURCEBRANCH"),
+		"base_ref":   strings.TrimPrefix(os.Getenv("SYSTEM_PULLREQUEST_TARGETBRANCH"), "refs/heads/"),
+		"head_ref":   strings.TrimPrefix(os.Getenv("SYSTEM_PULLREQUEST_SOURCEBRANCH"), "refs/heads/"),
+		"actor":      os.Getenv("BUILD_REQUESTEDFOR"),
+		"repository": os.Getenv("BUILD_REPOSITORY_NAME"),
+	}
+}
+
+// decodeJSON decodes a JSON input, keeping numbers as written like the
+// config file does.
+func decodeJSON(s string, v any) error {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("unexpected data after the JSON value")
+	}
+	return nil
+}
+
+// ChangedFileList parses the changed_files input: a JSON array, one path per
+// line, or a comma-separated list. A value starting with @ names a file that
+// holds the list in any of these forms. It returns nil when the input is not
+// set and an empty, non-nil list when it is set but lists no files.
+func (c *Config) ChangedFileList() ([]string, error) {
+	value := strings.TrimSpace(c.ChangedFiles)
+	if value == "" {
+		return nil, nil
+	}
+	if path, ok := strings.CutPrefix(value, "@"); ok {
+		data, err := os.ReadFile(strings.TrimSpace(path))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read changed_files: %w", err)
+		}
+		value = strings.TrimSpace(string(data))
+	}
+
+	var items []string
+	switch {
+	case strings.HasPrefix(value, "["):
+		if err := json.Unmarshal([]byte(value), &items); err != nil {
+			return nil, fmt.Errorf("invalid changed_files JSON: %w", err)
+		}
+	case strings.Contains(value, "\n"):
+		items = strings.Split(value, "\n")
+	default:
+		items = strings.Split(value, ",")
+	}
+
+	files := []string{}
+	for _, item := range items {
+		item = strings.TrimPrefix(strings.TrimSpace(item), "./")
+		if item != "" {
+			files = append(files, item)
+		}
+	}
+	return files, nil
+}
+
 func getEnv(name, defaultValue string) string {
 	key := "INPUT_" + strings.ToUpper(name)
 	if v := os.Getenv(key); v != "" {
@@ -79,3 +296,8 @@ func parseList(s, sep string) []string {
 	}
 	return result
 }
+
+// parseLines splits a list given one item per line or comma-separated.
+func parseLines(s string) []string {
+	return parseList(strings.ReplaceAll(s, "\n", ","), ",")
+}
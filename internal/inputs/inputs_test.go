@@ -0,0 +1,190 @@
+package inputs
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMatrixOptions(t *testing.T) {
+	c := &Config{
+		Dimension:   "stack",
+		Profile:     "plan",
+		Target:      "api, frontend",
+		Environment: "dev",
+		Fields:      "directory",
+		IgnorePaths: "**/*.md\ndocs/**, *.txt\n",
+		Workspace:   "/work",
+	}
+	opts, err := c.MatrixOptions()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if opts.Dimension != "stack" || opts.Profile != "plan" {
+		t.Errorf("unexpected dimension %q or profile %q", opts.Dimension, opts.Profile)
+	}
+	if opts.Root != "/work" {
+		t.Errorf("expected the workspace as root, got %q", opts.Root)
+	}
+	if !reflect.DeepEqual(opts.Target, []string{"api", "frontend"}) {
+		t.Errorf("unexpected target %v", opts.Target)
+	}
+	if !reflect.DeepEqual(opts.Environment, []string{"dev"}) {
+		t.Errorf("unexpected environment %v", opts.Environment)
+	}
+	if !reflect.DeepEqual(opts.Fields, []string{"directory"}) {
+		t.Errorf("unexpected fields %v", opts.Fields)
+	}
+	if !reflect.DeepEqual(opts.IgnorePaths, []string{"**/*.md", "docs/**", "*.txt"}) {
+		t.Errorf("unexpected ignore paths %v", opts.IgnorePaths)
+	}
+	if opts.Omit != nil {
+		t.Errorf("expected unset omit to stay nil so the profile applies, got %v", opts.Omit)
+	}
+}
+
+func TestMatrixOptions_ExcludeInclude(t *testing.T) {
+	c := &Config{
+		Exclude: `[{"service":"shared"}]`,
+		Include: `[{"service":"extra","environment":"dev"}]`,
+	}
+	opts, err := c.MatrixOptions()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(opts.Exclude) != 1 || opts.Exclude[0]["service"] != "shared" {
+		t.Errorf("unexpected exclude %v", opts.Exclude)
+	}
+	if len(opts.Include) != 1 || opts.Include[0]["service"] != "extra" {
+		t.Errorf("unexpected include %v", opts.Include)
+	}
+}
+
+func TestMatrixOptions_InvalidExclude(t *testing.T) {
+	c := &Config{Exclude: "not json"}
+	if _, err := c.MatrixOptions(); err == nil {
+		t.Fatal("expected error for invalid exclude JSON")
+	}
+}
+
+func TestChangedFileList(t *testing.T) {
+	want := []string{"deploy/api/main.tf", "deploy/frontend/main.tf"}
+	for name, input := range map[string]string{
+		"json":    `["deploy/api/main.tf", "deploy/frontend/main.tf"]`,
+		"lines":   "deploy/api/main.tf\n./deploy/frontend/main.tf\n",
+		"commas":  "deploy/api/main.tf, deploy/frontend/main.tf",
+		"spacing": "  deploy/api/main.tf\r\n\r\ndeploy/frontend/main.tf  ",
+	} {
+		t.Run(name, func(t *testing.T) {
+			files, err := (&Config{ChangedFiles: input}).ChangedFileList()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(files, want) {
+				t.Errorf("expected %v, got %v", want, files)
+			}
+		})
+	}
+}
+
+func TestChangedFileList_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "changed.txt")
+	if err := os.WriteFile(path, []byte("deploy/api/main.tf\nREADME.md\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files, err := (&Config{ChangedFiles: "@" + path}).ChangedFileList()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"deploy/api/main.tf", "README.md"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("expected %v, got %v", want, files)
+	}
+
+	if _, err := (&Config{ChangedFiles: "@" + path + ".missing"}).ChangedFileList(); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestChangedFileList_Empty(t *testing.T) {
+	files, err := (&Config{}).ChangedFileList()
+	if err != nil || files != nil {
+		t.Errorf("expected nil when unset, got %v, %v", files, err)
+	}
+	files, err = (&Config{ChangedFiles: "[]"}).ChangedFileList()
+	if err != nil || files == nil || len(files) != 0 {
+		t.Errorf("expected empty list for [], got %#v, %v", files, err)
+	}
+	if _, err := (&Config{ChangedFiles: "[1, 2]"}).ChangedFileList(); err == nil {
+		t.Error("expected error for non-string JSON items")
+	}
+}
+
+func TestOutputPath(t *testing.T) {
+	tests := []struct {
+		file, workspace, want string
+	}{
+		{"", "/work", ""},
+		{"build/matrix.json", "/work", filepath.Join("/work", "build/matrix.json")},
+		{"/tmp/matrix.json", "/work", "/tmp/matrix.json"},
+		{"matrix.json", "", "matrix.json"},
+	}
+	for _, tt := range tests {
+		c := &Config{OutputFile: tt.file, Workspace: tt.workspace}
+		if got := c.OutputPath(); got != tt.want {
+			t.Errorf("OutputPath(%q, %q) = %q, want %q", tt.file, tt.workspace, got, tt.want)
+		}
+	}
+}
+
+func TestEventContext(t *testing.T) {
+	for _, key := range []string{"GITLAB_CI", "BUILDKITE", "TF_BUILD"} {
+		t.Setenv(key, "")
+	}
+	tests := []struct {
+		name string
+		env  map[string]string
+		want map[string]any
+	}{
+		{
+			name: "github",
+			env:  map[string]string{"GITHUB_EVENT_NAME": "pull_request", "GITHUB_REF": "refs/pull/1/merge", "GITHUB_BASE_REF": "main", "GITHUB_HEAD_REF": "feature", "GITHUB_ACTOR": "octo", "GITHUB_REPOSITORY": "org/repo"},
+			want: map[string]any{"name": "pull_request", "ref": "refs/pull/1/merge", "base_ref": "main", "head_ref": "feature", "actor": "octo", "repository": "org/repo"},
+		},
+		{
+			name: "gitlab merge request",
+			env:  map[string]string{"GITLAB_CI": "true", "CI_PIPELINE_SOURCE": "merge_request_event", "CI_MERGE_REQUEST_IID": "7", "CI_MERGE_REQUEST_TARGET_BRANCH_NAME": "main", "CI_MERGE_REQUEST_SOURCE_BRANCH_NAME": "feature", "GITLAB_USER_LOGIN": "dev", "CI_PROJECT_PATH": "group/repo"},
+			want: map[string]any{"name": "pull_request", "ref": "refs/merge-requests/7/head", "base_ref": "main", "head_ref": "feature", "actor": "dev", "repository": "group/repo"},
+		},
+		{
+			name: "gitlab tag",
+			env:  map[string]string{"GITLAB_CI": "true", "CI_PIPELINE_SOURCE": "push", "CI_COMMIT_TAG": "v1.0.0"},
+			want: map[string]any{"name": "push", "ref": "refs/tags/v1.0.0", "base_ref": "", "head_ref": "", "actor": "", "repository": ""},
+		},
+		{
+			name: "buildkite pull request",
+			env:  map[string]string{"BUILDKITE": "true", "BUILDKITE_SOURCE": "webhook", "BUILDKITE_PULL_REQUEST": "12", "BUILDKITE_BRANCH": "feature", "BUILDKITE_PULL_REQUEST_BASE_BRANCH": "main", "BUILDKITE_BUILD_CREATOR_EMAIL": "dev@example.com", "BUILDKITE_REPO": "git@github.com:org/repo.git"},
+			want: map[string]any{"name": "pull_request", "ref": "refs/heads/feature", "base_ref": "main", "head_ref": "feature", "actor": "dev@example.com", "repository": "git@github.com:org/repo.git"},
+		},
+		{
+			name: "buildkite push",
+			env:  map[string]string{"BUILDKITE": "true", "BUILDKITE_SOURCE": "webhook", "BUILDKITE_PULL_REQUEST": "false", "BUILDKITE_BRANCH": "main"},
+			want: map[string]any{"name": "push", "ref": "refs/heads/main", "base_ref": "", "head_ref": "", "actor": "", "repository": ""},
+		},
+		{
+			name: "azure pull request",
+			env:  map[string]string{"TF_BUILD": "True", "BUILD_REASON": "PullRequest", "BUILD_SOURCEBRANCH": "refs/pull/3/merge", "SYSTEM_PULLREQUEST_TARGETBRANCH": "refs/heads/main", "SYSTEM_PULLREQUEST_SOURCEBRANCH": "refs/heads/feature", "BUILD_REQUESTEDFOR": "Dev", "BUILD_REPOSITORY_NAME": "repo"},
+			want: map[string]any{"name": "pull_request", "ref": "refs/pull/3/merge", "base_ref": "main", "head_ref": "feature", "actor": "Dev", "repository": "repo"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			if got := eventContext(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
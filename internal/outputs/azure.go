@@ -0,0 +1,113 @@
+package outputs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dnd-it/action-config/v3/internal/expander"
+	"github.com/dnd-it/action-config/v3/internal/formats"
+)
+
+// Azure sets output variables and logs with Azure Pipelines logging
+// commands. The matrix is published as a "legs" output variable in the
+// object-of-legs shape expected by strategy.matrix.
+type Azure struct {
+	Out io.Writer
+	// SummaryDir receives the markdown file uploaded as the build summary.
+	SummaryDir string
+}
+
+func newAzure() *Azure {
+	return &Azure{
+		Out:        os.Stdout,
+		SummaryDir: envOr("AGENT_TEMPDIRECTORY", os.TempDir()),
+	}
+}
+
+// Name implements Backend.
+func (a *Azure) Name() string { return AzureBackend }
+
+// SetOutput implements Backend.
+func (a *Azure) SetOutput(name, value string) error {
+	_, err := fmt.Fprintf(a.Out, "##vso[task.setvariable variable=%s;isOutput=true]%s\n", name, azureEscape(value))
+	return err
+}
+
+// SetEnv implements Backend. Pipeline variables are exposed to later steps
+// as environment variables.
+func (a *Azure) SetEnv(name, value string) error {
+	_, err := fmt.Fprintf(a.Out, "##vso[task.setvariable variable=%s]%s\n", name, azureEscape(value))
+	return err
+}
+
+// Mask implements Backend via task.setsecret.
+func (a *Azure) Mask(value string) {
+	_, _ = fmt.Fprintf(a.Out, "##vso[task.setsecret]%s\n", azureEscape(value))
+}
+
+// Log implements Backend.
+func (a *Azure) Log(level Level, msg string) {
+	switch level {
+	case LevelDebug:
+		_, _ = fmt.Fprintf(a.Out, "##[debug]%s\n", msg)
+	case LevelWarning:
+		_, _ = fmt.Fprintf(a.Out, "##vso[task.logissue type=warning]%s\n", azureEscape(msg))
+	case LevelError:
+		_, _ = fmt.Fprintf(a.Out, "##vso[task.logissue type=error]%s\n", azureEscape(msg))
+	default:
+		_, _ = fmt.Fprintln(a.Out, msg)
+	}
+}
+
+// Annotate implements Annotator via task.logissue with a source location.
+func (a *Azure) Annotate(level Level, file string, line, col int, msg string) {
+	issue := "error"
+	if level < LevelError {
+		issue = "warning"
+	}
+	props := fmt.Sprintf("type=%s;sourcepath=%s", issue, azureEscape(file))
+	if line > 0 {
+		props += fmt.Sprintf(";linenumber=%d", line)
+		if col > 0 {
+			props += fmt.Sprintf(";columnnumber=%d", col)
+		}
+	}
+	_, _ = fmt.Fprintf(a.Out, "##vso[task.logissue %s]%s\n", props, azureEscape(msg))
+}
+
+// WriteSummary implements Backend by uploading a markdown file.
+func (a *Azure) WriteSummary(markdown string) error {
+	path := filepath.Join(a.SummaryDir, "action-config-summary.md")
+	if err := os.WriteFile(path, []byte(markdown), 0644); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(a.Out, "##vso[task.uploadsummary]%s\n", path)
+	return err
+}
+
+// WriteMatrix implements Backend by setting the "legs" output variable to an
+// object keyed by leg name, e.g. {"dev_api": {"environment": "dev", ...}}.
+func (a *Azure) WriteMatrix(entries []expander.MatrixEntry, dimKeys []string) error {
+	legs := make(map[string]map[string]string, len(entries))
+	for i, entry := range entries {
+		name := formats.EnvName(strings.ReplaceAll(entryLabel(entry, dimKeys, i), " ", "_"))
+		if _, exists := legs[name]; exists {
+			name = fmt.Sprintf("%s_%d", name, i)
+		}
+		legs[name] = stringFields(entry)
+	}
+	data, err := json.Marshal(legs)
+	if err != nil {
+		return err
+	}
+	return a.SetOutput("legs", string(data))
+}
+
+// azureEscape escapes characters that terminate or corrupt a logging command.
+func azureEscape(s string) string {
+	return strings.NewReplacer("%", "%AZP25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
@@ -0,0 +1,103 @@
+package outputs
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/dnd-it/action-config/v3/internal/expander"
+)
+
+// Buildkite stores outputs as build meta-data and writes the matrix as a
+// dynamic pipeline document for "buildkite-agent pipeline upload".
+type Buildkite struct {
+	textLogger
+	// PipelineFile receives the generated pipeline document.
+	PipelineFile string
+	// Command is run by every generated step.
+	Command string
+	// Agent runs a buildkite-agent subcommand with the given stdin.
+	Agent func(stdin string, args ...string) error
+}
+
+func newBuildkite() *Buildkite {
+	return &Buildkite{
+		textLogger:   newTextLogger(),
+		PipelineFile: envOr("ACTION_CONFIG_PIPELINE", "action-config-pipeline.yml"),
+		Command:      os.Getenv("ACTION_CONFIG_COMMAND"),
+		Agent:        runBuildkiteAgent,
+	}
+}
+
+// Name implements Backend.
+func (b *Buildkite) Name() string { return BuildkiteBackend }
+
+// SetOutput implements Backend via "buildkite-agent meta-data set".
+func (b *Buildkite) SetOutput(name, value string) error {
+	return b.Agent(value, "meta-data", "set", name)
+}
+
+// SetEnv implements Backend via "buildkite-agent env set".
+func (b *Buildkite) SetEnv(name, value string) error {
+	return b.Agent("", "env", "set", name+"="+value)
+}
+
+// Mask implements Backend via "buildkite-agent redactor add".
+func (b *Buildkite) Mask(value string) {
+	if err := b.Agent(value, "redactor", "add"); err != nil {
+		b.Log(LevelWarning, fmt.Sprintf("failed to register value for redaction: %v", err))
+	}
+}
+
+// WriteSummary implements Backend by annotating the build.
+func (b *Buildkite) WriteSummary(markdown string) error {
+	return b.Agent(markdown, "annotate", "--context", "action-config", "--style", "info")
+}
+
+type buildkiteStep struct {
+	Label   string            `yaml:"label"`
+	Command string            `yaml:"command"`
+	Env     map[string]string `yaml:"env"`
+}
+
+// WriteMatrix implements Backend by writing one step per entry, with the
+// entry's fields exposed as step environment variables.
+func (b *Buildkite) WriteMatrix(entries []expander.MatrixEntry, dimKeys []string) error {
+	if b.Command == "" {
+		return fmt.Errorf("ACTION_CONFIG_COMMAND must be set to generate a Buildkite pipeline")
+	}
+
+	steps := make([]buildkiteStep, 0, len(entries))
+	for i, entry := range entries {
+		steps = append(steps, buildkiteStep{
+			Label:   entryLabel(entry, dimKeys, i),
+			Command: b.Command,
+			Env:     stringFields(entry),
+		})
+	}
+
+	data, err := yaml.Marshal(map[string]any{"steps": steps})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(b.PipelineFile, data, 0644); err != nil {
+		return err
+	}
+	b.Log(LevelNotice, fmt.Sprintf("Wrote pipeline with %d steps to %s", len(steps), b.PipelineFile))
+	return nil
+}
+
+// runBuildkiteAgent runs buildkite-agent with the given arguments, passing
+// stdin as the value to store.
+func runBuildkiteAgent(stdin string, args ...string) error {
+	cmd := exec.Command("buildkite-agent", args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("buildkite-agent %s failed: %w", strings.Join(args, " "), err)
+	}
+	return nil
+}
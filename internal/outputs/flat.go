@@ -0,0 +1,111 @@
+package outputs
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/dnd-it/action-config/v3/internal/expander"
+)
+
+// Flat output modes accepted by the flat_outputs input. Any other value is
+// a comma-separated list of the fields to emit, optionally prefixed with
+// "fields:".
+const (
+	FlatAll     = "all"
+	FlatUniform = "uniform"
+	FlatNone    = "none"
+
+	flatFieldsPrefix = "fields:"
+)
+
+// FlatMode selects the fields emitted as flat outputs.
+type FlatMode struct {
+	// Kind is FlatAll, FlatUniform or FlatNone, or "" when Fields lists
+	// the fields.
+	Kind   string
+	Fields []string
+}
+
+// ParseFlatMode parses the flat_outputs input. Empty means FlatUniform.
+func ParseFlatMode(s string) (FlatMode, error) {
+	s = strings.TrimSpace(s)
+	switch s {
+	case "":
+		return FlatMode{Kind: FlatUniform}, nil
+	case FlatAll, FlatUniform, FlatNone:
+		return FlatMode{Kind: s}, nil
+	}
+	list, _ := strings.CutPrefix(s, flatFieldsPrefix)
+	var fields []string
+	for _, f := range strings.Split(list, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			fields = append(fields, f)
+		}
+	}
+	if len(fields) == 0 {
+		return FlatMode{}, fmt.Errorf("flat_outputs %q lists no fields", s)
+	}
+	return FlatMode{Fields: fields}, nil
+}
+
+// FlatValues returns the value of each flat output, keyed by field.
+//   - uniform: only fields with the same value in every entry
+//   - all: every field; fields that differ between entries are encoded as a
+//     JSON array of their unique values
+//   - none: nothing
+//   - fields: only the listed fields, encoded as for all
+//
+// Maps and lists are JSON-encoded. Fields in skip and fields no entry has
+// are left out.
+func FlatValues(entries []expander.MatrixEntry, mode FlatMode, skip map[string]bool) (map[string]string, error) {
+	result := make(map[string]string)
+	if mode.Kind == FlatNone || len(entries) == 0 {
+		return result, nil
+	}
+
+	fields := mode.Fields
+	if mode.Kind != "" {
+		set := make(map[string]bool)
+		for _, entry := range entries {
+			for k := range entry {
+				set[k] = true
+			}
+		}
+		fields = sortedKeys(set)
+	}
+
+	for _, field := range fields {
+		if skip[field] {
+			continue
+		}
+		var values []string
+		seen := make(map[string]bool)
+		present := 0
+		for _, entry := range entries {
+			v, ok := entry[field]
+			if !ok {
+				continue
+			}
+			present++
+			s := expander.FormatValue(v)
+			if !seen[s] {
+				seen[s] = true
+				values = append(values, s)
+			}
+		}
+		switch {
+		case present == 0:
+		case len(values) == 1 && present == len(entries):
+			result[field] = values[0]
+		case mode.Kind == FlatUniform:
+		default:
+			b, err := json.Marshal(values)
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal values of %s: %w", field, err)
+			}
+			result[field] = string(b)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,175 @@
+package outputs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/dnd-it/action-config/v3/internal/expander"
+)
+
+// githubMaxOutputSize is GitHub's limit for a single step output (1 MiB).
+const githubMaxOutputSize = 1 << 20
+
+// GitHub writes outputs to GITHUB_OUTPUT and logs with workflow commands.
+type GitHub struct {
+	Out         io.Writer
+	OutputFile  string
+	EnvFile     string
+	SummaryFile string
+}
+
+func newGitHub() *GitHub {
+	return &GitHub{
+		Out:         os.Stdout,
+		OutputFile:  os.Getenv("GITHUB_OUTPUT"),
+		EnvFile:     os.Getenv("GITHUB_ENV"),
+		SummaryFile: os.Getenv("GITHUB_STEP_SUMMARY"),
+	}
+}
+
+// Name implements Backend.
+func (g *GitHub) Name() string { return GitHubBackend }
+
+// SetOutput implements Backend.
+func (g *GitHub) SetOutput(name, value string) error {
+	if g.OutputFile == "" {
+		return fmt.Errorf("GITHUB_OUTPUT is not set, cannot write output %s", name)
+	}
+	if len(value) > githubMaxOutputSize {
+		return fmt.Errorf("output %s is %d bytes, exceeding GitHub's %d byte per-output limit; narrow the matrix with target, environment or exclude", name, len(value), githubMaxOutputSize)
+	}
+	return appendKeyValue(g.OutputFile, name, value)
+}
+
+// SetEnv implements Backend.
+func (g *GitHub) SetEnv(name, value string) error {
+	if g.EnvFile == "" {
+		return fmt.Errorf("GITHUB_ENV is not set, cannot export %s", name)
+	}
+	return appendKeyValue(g.EnvFile, name, value)
+}
+
+// Mask implements Backend. Each line is registered separately because
+// add-mask only applies to single-line values.
+func (g *GitHub) Mask(value string) {
+	for _, line := range strings.Split(value, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			_, _ = fmt.Fprintf(g.Out, "::add-mask::%s\n", line)
+		}
+	}
+}
+
+// Log implements Backend.
+func (g *GitHub) Log(level Level, msg string) {
+	switch level {
+	case LevelDebug:
+		_, _ = fmt.Fprintf(g.Out, "::debug::%s\n", msg)
+	case LevelNotice:
+		_, _ = fmt.Fprintf(g.Out, "::notice::%s\n", msg)
+	case LevelWarning:
+		_, _ = fmt.Fprintf(g.Out, "::warning::%s\n", msg)
+	case LevelError:
+		_, _ = fmt.Fprintf(g.Out, "::error::%s\n", msg)
+	default:
+		_, _ = fmt.Fprintln(g.Out, msg)
+	}
+}
+
+// Annotate implements Annotator with the file, line and col properties of
+// the warning and error workflow commands.
+func (g *GitHub) Annotate(level Level, file string, line, col int, msg string) {
+	command := "error"
+	if level < LevelError {
+		command = "warning"
+	}
+	props := "file=" + githubEscapeProperty(file)
+	if line > 0 {
+		props += fmt.Sprintf(",line=%d", line)
+		if col > 0 {
+			props += fmt.Sprintf(",col=%d", col)
+		}
+	}
+	_, _ = fmt.Fprintf(g.Out, "::%s %s::%s\n", command, props, githubEscapeData(msg))
+}
+
+// WriteSummary implements Backend by appending to GITHUB_STEP_SUMMARY.
+func (g *GitHub) WriteSummary(markdown string) error {
+	if g.SummaryFile == "" {
+		return nil
+	}
+	f, err := os.OpenFile(g.SummaryFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	_, err = f.WriteString(markdown)
+	return err
+}
+
+// WriteMatrix implements Backend. GitHub consumes the "matrix" output via
+// fromJson, so there is nothing else to write.
+func (g *GitHub) WriteMatrix([]expander.MatrixEntry, []string) error {
+	return nil
+}
+
+// appendKeyValue appends name=value to a GitHub Actions file command file,
+// using the heredoc syntax for multiline values.
+func appendKeyValue(path, name, value string) error {
+	// Use os.Stdout directly to avoid a second file descriptor that
+	// races with fmt.Print* and causes truncated output.
+	var f *os.File
+	if path == "/dev/stdout" {
+		f = os.Stdout
+	} else if path == "/dev/stderr" {
+		f = os.Stderr
+	} else {
+		var err error
+		f, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = f.Close() }()
+	}
+
+	if !strings.Contains(value, "\n") {
+		_, err := fmt.Fprintf(f, "%s=%s\n", name, value)
+		return err
+	}
+
+	delimiter, err := heredocDelimiter(value)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s<<%s\n%s\n%s\n", name, delimiter, value, delimiter)
+	return err
+}
+
+// heredocDelimiter returns a random delimiter that does not occur in value,
+// so a value can never terminate its own heredoc early.
+func heredocDelimiter(value string) (string, error) {
+	for range 10 {
+		buf := make([]byte, 16)
+		if _, err := rand.Read(buf); err != nil {
+			return "", fmt.Errorf("failed to generate delimiter: %w", err)
+		}
+		delimiter := "ghadelimiter_" + hex.EncodeToString(buf)
+		if !strings.Contains(value, delimiter) {
+			return delimiter, nil
+		}
+	}
+	return "", fmt.Errorf("failed to generate a delimiter not contained in the value")
+}
+
+// githubEscapeData escapes a workflow command message.
+func githubEscapeData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// githubEscapeProperty escapes a workflow command property value.
+func githubEscapeProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
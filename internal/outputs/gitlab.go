@@ -0,0 +1,181 @@
+package outputs
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/dnd-it/action-config/v3/internal/expander"
+	"github.com/dnd-it/action-config/v3/internal/formats"
+)
+
+// gitlabMaxParallel is GitLab's limit on jobs generated by parallel:matrix.
+const gitlabMaxParallel = 200
+
+// GitLab's default limits on a dotenv report. A report exceeding them is
+// rejected as a whole, so variables that do not fit are left out.
+const (
+	gitlabMaxDotenvBytes     = 5 * 1024
+	gitlabMaxDotenvVariables = 20
+)
+
+// GitLab writes outputs to a dotenv report (artifacts:reports:dotenv) and the
+// matrix to a child pipeline using parallel:matrix.
+type GitLab struct {
+	textLogger
+	// DotenvFile receives outputs; declare it as artifacts:reports:dotenv.
+	DotenvFile string
+	// PipelineFile receives the generated child pipeline.
+	PipelineFile string
+	// JobTemplate is the hidden job the generated job extends.
+	JobTemplate string
+	// Include is an optional local file included by the child pipeline,
+	// typically the one defining JobTemplate.
+	Include string
+	// MaxDotenvBytes and MaxDotenvVariables are the dotenv report limits of
+	// the GitLab instance; zero means GitLab's defaults.
+	MaxDotenvBytes     int
+	MaxDotenvVariables int
+
+	// dotenvNames and dotenvBytes track what this run wrote to DotenvFile,
+	// which is truncated on the first write.
+	dotenvNames map[string]bool
+	dotenvBytes int
+}
+
+func newGitLab() *GitLab {
+	return &GitLab{
+		textLogger:   newTextLogger(),
+		DotenvFile:   envOr("ACTION_CONFIG_DOTENV", "action-config.env"),
+		PipelineFile: envOr("ACTION_CONFIG_PIPELINE", "action-config-pipeline.yml"),
+		JobTemplate:  envOr("ACTION_CONFIG_JOB_TEMPLATE", ".action-config"),
+		Include:      os.Getenv("ACTION_CONFIG_INCLUDE"),
+		// Self-managed instances may raise the limits.
+		MaxDotenvBytes:     envInt("ACTION_CONFIG_DOTENV_MAX_BYTES"),
+		MaxDotenvVariables: envInt("ACTION_CONFIG_DOTENV_MAX_VARIABLES"),
+	}
+}
+
+// Name implements Backend.
+func (g *GitLab) Name() string { return GitLabBackend }
+
+// SetOutput implements Backend. GitLab dotenv reports do not support
+// multiline values. A variable that would take the report over its size or
+// variable limit is left out with a warning, since GitLab rejects the whole
+// report otherwise.
+func (g *GitLab) SetOutput(name, value string) error {
+	if strings.Contains(value, "\n") {
+		return fmt.Errorf("GitLab dotenv reports do not support multiline values")
+	}
+	key := formats.EnvName(name)
+	line := key + "=" + value + "\n"
+	maxBytes := cmp.Or(g.MaxDotenvBytes, gitlabMaxDotenvBytes)
+	maxVars := cmp.Or(g.MaxDotenvVariables, gitlabMaxDotenvVariables)
+	switch {
+	case !g.dotenvNames[key] && len(g.dotenvNames) >= maxVars:
+		g.Log(LevelWarning, fmt.Sprintf("Output %s is not written to %s: GitLab dotenv reports hold at most %d variables (set ACTION_CONFIG_DOTENV_MAX_VARIABLES if your instance allows more)", name, g.DotenvFile, maxVars))
+		return nil
+	case g.dotenvBytes+len(line) > maxBytes:
+		g.Log(LevelWarning, fmt.Sprintf("Output %s is not written to %s: GitLab dotenv reports are limited to %d bytes (set ACTION_CONFIG_DOTENV_MAX_BYTES if your instance allows more)", name, g.DotenvFile, maxBytes))
+		return nil
+	}
+
+	flags := os.O_APPEND | os.O_WRONLY | os.O_CREATE
+	if g.dotenvNames == nil {
+		// Start a fresh report rather than appending to a previous run's.
+		flags |= os.O_TRUNC
+		g.dotenvNames = make(map[string]bool)
+	}
+	f, err := os.OpenFile(g.DotenvFile, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	if _, err := f.WriteString(line); err != nil {
+		return err
+	}
+	g.dotenvNames[key] = true
+	g.dotenvBytes += len(line)
+	return nil
+}
+
+// SetEnv implements Backend. GitLab jobs share variables through the same
+// dotenv report.
+func (g *GitLab) SetEnv(name, value string) error {
+	return g.SetOutput(name, value)
+}
+
+// Mask implements Backend. GitLab only masks variables declared as masked
+// in the project settings, so runtime masking is not possible.
+func (g *GitLab) Mask(string) {}
+
+// WriteSummary implements Backend by printing the markdown to the job log.
+func (g *GitLab) WriteSummary(markdown string) error {
+	_, err := fmt.Fprintln(g.Out, markdown)
+	return err
+}
+
+// WriteMatrix implements Backend by writing a child pipeline with one
+// parallel:matrix item per entry.
+func (g *GitLab) WriteMatrix(entries []expander.MatrixEntry, _ []string) error {
+	if len(entries) > gitlabMaxParallel {
+		return fmt.Errorf("matrix has %d entries, GitLab parallel:matrix supports at most %d", len(entries), gitlabMaxParallel)
+	}
+
+	pipeline := make(map[string]any)
+	if g.Include != "" {
+		pipeline["include"] = []map[string]string{{"local": g.Include}}
+	}
+
+	if len(entries) == 0 {
+		// A child pipeline without jobs is rejected, so emit a no-op job.
+		pipeline["action-config"] = map[string]any{
+			"script": []string{"echo 'No matrix entries'"},
+		}
+	} else {
+		items := make([]map[string]string, 0, len(entries))
+		for _, entry := range entries {
+			item := make(map[string]string, len(entry))
+			for k, v := range stringFields(entry) {
+				item[formats.EnvName(k)] = v
+			}
+			items = append(items, item)
+		}
+		pipeline["action-config"] = map[string]any{
+			"extends":  g.JobTemplate,
+			"parallel": map[string]any{"matrix": items},
+		}
+	}
+
+	data, err := yaml.Marshal(pipeline)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(g.PipelineFile, data, 0644); err != nil {
+		return err
+	}
+	g.Log(LevelNotice, fmt.Sprintf("Wrote child pipeline with %d jobs to %s", len(entries), g.PipelineFile))
+	return nil
+}
+
+// envInt returns the environment variable as an integer, or 0 when unset or
+// not a positive integer.
+func envInt(name string) int {
+	n, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// envOr returns the environment variable value, or def when unset.
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
@@ -1,14 +1,121 @@
-// Package outputs provides GitHub Actions output and logging utilities.
+// Package outputs provides CI output and logging utilities. Outputs, log
+// messages and summaries are routed through a Backend so the same run can
+// target GitHub Actions, GitLab CI, Buildkite, Azure Pipelines, or a plain
+// terminal.
 package outputs
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
+	"slices"
+	"sort"
 	"strings"
-	"time"
+
+	"github.com/dnd-it/action-config/v3/internal/expander"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+// Log levels, from least to most severe.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelNotice
+	LevelWarning
+	LevelError
+)
+
+// Backend emits outputs, log messages, summaries and generated pipelines
+// for a specific CI system.
+type Backend interface {
+	// Name returns the backend identifier used for selection (e.g. "github").
+	Name() string
+	// SetOutput publishes a named output for downstream steps or jobs.
+	SetOutput(name, value string) error
+	// SetEnv exports an environment variable for subsequent steps.
+	SetEnv(name, value string) error
+	// Mask hides a value from all subsequent log output, where supported.
+	Mask(value string)
+	// Log prints a message at the given level.
+	Log(level Level, msg string)
+	// WriteSummary publishes a markdown summary of the run.
+	WriteSummary(markdown string) error
+	// WriteMatrix publishes the expanded matrix in the CI system's native
+	// form (e.g. a child pipeline). Backends whose matrix is consumed via
+	// the "matrix" output do nothing.
+	WriteMatrix(entries []expander.MatrixEntry, dimKeys []string) error
+}
+
+// Annotator is implemented by backends that can attach a message to a file
+// location, so the CI system highlights the offending line.
+type Annotator interface {
+	// Annotate prints a warning or error for file at line and column; line
+	// and column are 1-based and zero when unknown.
+	Annotate(level Level, file string, line, col int, msg string)
+}
+
+// Backend names accepted by New.
+const (
+	GitHubBackend    = "github"
+	GitLabBackend    = "gitlab"
+	BuildkiteBackend = "buildkite"
+	AzureBackend     = "azure"
+	PlainBackend     = "plain"
 )
 
+var current Backend = newGitHub()
+
+// New returns the backend with the given name, configured from the
+// environment. An empty name auto-detects the backend via Detect.
+func New(name string) (Backend, error) {
+	switch strings.ToLower(name) {
+	case "":
+		return Detect(), nil
+	case GitHubBackend:
+		return newGitHub(), nil
+	case GitLabBackend:
+		return newGitLab(), nil
+	case BuildkiteBackend:
+		return newBuildkite(), nil
+	case AzureBackend:
+		return newAzure(), nil
+	case PlainBackend:
+		return newPlain(), nil
+	default:
+		return nil, fmt.Errorf("unknown output backend %q. Use github, gitlab, buildkite, azure, or plain", name)
+	}
+}
+
+// Detect picks a backend from the well-known environment variables each CI
+// system sets, falling back to plain output outside of CI.
+func Detect() Backend {
+	switch {
+	case os.Getenv("GITHUB_ACTIONS") == "true" || os.Getenv("GITHUB_OUTPUT") != "":
+		return newGitHub()
+	case os.Getenv("GITLAB_CI") == "true":
+		return newGitLab()
+	case os.Getenv("BUILDKITE") == "true":
+		return newBuildkite()
+	case strings.EqualFold(os.Getenv("TF_BUILD"), "true"):
+		return newAzure()
+	default:
+		return newPlain()
+	}
+}
+
+// Use sets the backend for all package-level output and logging functions.
+func Use(b Backend) {
+	current = b
+}
+
+// Current returns the active backend.
+func Current() Backend {
+	return current
+}
+
 type outputEntry struct {
 	name  string
 	value string
@@ -16,80 +123,189 @@ type outputEntry struct {
 
 var recorded []outputEntry
 
-// SetOutput writes a value to GITHUB_OUTPUT.
-func SetOutput(name, value string) {
+type summarySection struct {
+	title    string
+	markdown string
+}
+
+var sections []summarySection
+
+// AddSummarySection adds a markdown section below the outputs in the summary
+// written by WriteSummary.
+func AddSummarySection(title, markdown string) {
+	sections = append(sections, summarySection{title, markdown})
+}
+
+// SetOutput publishes a named output through the active backend. Values are
+// not echoed to the log; only their size is, to keep sensitive data out.
+func SetOutput(name, value string) error {
 	recorded = append(recorded, outputEntry{name, value})
-	fmt.Printf("::debug::output %s=%s\n", name, value)
-	outputFile := os.Getenv("GITHUB_OUTPUT")
-	if outputFile == "" {
-		fmt.Printf("::set-output name=%s::%s\n", name, value)
+	current.Log(LevelDebug, fmt.Sprintf("output %s (%d bytes)", name, len(value)))
+	if err := current.SetOutput(name, value); err != nil {
+		return fmt.Errorf("failed to set output %s: %w", name, err)
+	}
+	return nil
+}
+
+// SetEnv exports a variable to subsequent steps through the active backend.
+func SetEnv(name, value string) error {
+	current.Log(LevelDebug, fmt.Sprintf("env %s (%d bytes)", name, len(value)))
+	return current.SetEnv(name, value)
+}
+
+var masked []string
+
+// minMaskLength is the shortest value Mask hides. Shorter values such as
+// "1" or "true" would redact unrelated text throughout the log.
+const minMaskLength = 4
+
+// Mask hides a value from all subsequent log output and summaries, also in
+// its JSON-escaped forms as it appears in the matrix and config outputs.
+// Empty values are ignored since masking them would redact every line;
+// values shorter than minMaskLength are not masked, with a warning.
+func Mask(value string) {
+	if value == "" {
 		return
 	}
+	if len(value) < minMaskLength {
+		current.Log(LevelWarning, fmt.Sprintf("A sensitive value of %d characters is too short to be masked without redacting unrelated text; it may appear in logs", len(value)))
+		return
+	}
+	for _, form := range maskForms(value) {
+		if slices.Contains(masked, form) {
+			continue
+		}
+		masked = append(masked, form)
+		current.Mask(form)
+	}
+	// Longest first, so a value containing another masked value is
+	// replaced as a whole.
+	sort.SliceStable(masked, func(i, j int) bool { return len(masked[i]) > len(masked[j]) })
+}
 
-	// Use os.Stdout directly to avoid a second file descriptor that
-	// races with fmt.Print* and causes truncated output.
-	var f *os.File
-	if outputFile == "/dev/stdout" {
-		f = os.Stdout
-	} else if outputFile == "/dev/stderr" {
-		f = os.Stderr
-	} else {
-		var err error
-		f, err = os.OpenFile(outputFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
-		if err != nil {
-			fmt.Printf("::set-output name=%s::%s\n", name, value)
-			return
+// maskForms returns value and the distinct forms it takes inside JSON
+// strings, with and without HTML escaping.
+func maskForms(value string) []string {
+	forms := []string{value}
+	for _, escapeHTML := range []bool{true, false} {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(escapeHTML)
+		if err := enc.Encode(value); err != nil {
+			continue
+		}
+		quoted := strings.TrimSuffix(buf.String(), "\n")
+		if form := quoted[1 : len(quoted)-1]; !slices.Contains(forms, form) {
+			forms = append(forms, form)
 		}
-		defer func() { _ = f.Close() }()
 	}
+	return forms
+}
 
-	if strings.Contains(value, "\n") {
-		delimiter := fmt.Sprintf("ghadelimiter_%d", time.Now().UnixNano())
-		_, _ = fmt.Fprintf(f, "%s<<%s\n%s\n%s\n", name, delimiter, value, delimiter)
-	} else {
-		_, _ = fmt.Fprintf(f, "%s=%s\n", name, value)
+// Redact replaces every masked value in s with "***".
+func Redact(s string) string {
+	for _, m := range masked {
+		s = strings.ReplaceAll(s, m, "***")
 	}
+	return s
+}
+
+// WriteMatrix publishes the matrix in the active backend's native form.
+func WriteMatrix(entries []expander.MatrixEntry, dimKeys []string) error {
+	return current.WriteMatrix(entries, dimKeys)
 }
 
 // LogInfo prints an info message.
 func LogInfo(msg string) {
-	fmt.Println(msg)
+	current.Log(LevelInfo, Redact(msg))
 }
 
 // LogNotice prints a notice message.
 func LogNotice(msg string) {
-	fmt.Printf("::notice::%s\n", msg)
+	current.Log(LevelNotice, Redact(msg))
+}
+
+// LogWarning prints a warning message.
+func LogWarning(msg string) {
+	current.Log(LevelWarning, Redact(msg))
 }
 
 // LogError prints an error message.
 func LogError(msg string) {
-	fmt.Printf("::error::%s\n", msg)
+	current.Log(LevelError, Redact(msg))
 }
 
-func prettyJSON(s string) string {
-	var v any
-	if err := json.Unmarshal([]byte(s), &v); err != nil {
-		return s
+// LogErrorAt prints an error message attached to a file location.
+func LogErrorAt(file string, line, col int, msg string) {
+	logAt(LevelError, file, line, col, msg)
+}
+
+// LogWarningAt prints a warning message attached to a file location.
+func LogWarningAt(file string, line, col int, msg string) {
+	logAt(LevelWarning, file, line, col, msg)
+}
+
+// logAt annotates the location when the backend supports it and otherwise
+// prefixes the message with "file:line:col: ".
+func logAt(level Level, file string, line, col int, msg string) {
+	msg = Redact(msg)
+	if a, ok := current.(Annotator); ok && file != "" {
+		a.Annotate(level, file, line, col, msg)
+		return
 	}
-	b, err := json.MarshalIndent(v, "", "  ")
-	if err != nil {
+	if file != "" {
+		loc := file
+		if line > 0 {
+			loc += fmt.Sprintf(":%d", line)
+			if col > 0 {
+				loc += fmt.Sprintf(":%d", col)
+			}
+		}
+		msg = loc + ": " + msg
+	}
+	current.Log(level, msg)
+}
+
+// prettyJSON indents a JSON value, leaving numbers exactly as they are.
+func prettyJSON(s string) string {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, []byte(s), "", "  "); err != nil {
 		return s
 	}
-	return string(b)
+	return buf.String()
 }
 
 func isLongValue(v string) bool {
 	return strings.Contains(v, "\n") || len(v) > 100
 }
 
-// WriteSummary writes all recorded outputs to the GitHub Actions step summary.
+// WriteSummary writes all recorded outputs and added sections to the active
+// backend's summary. Masked values are redacted, since summaries are not
+// covered by log masking.
 func WriteSummary() {
-	summaryFile := os.Getenv("GITHUB_STEP_SUMMARY")
-	if summaryFile == "" || len(recorded) == 0 {
+	if len(recorded) == 0 && len(sections) == 0 {
 		return
 	}
 
 	var sb strings.Builder
+	if len(recorded) > 0 {
+		writeOutputsTable(&sb)
+	}
+	for _, sec := range sections {
+		if sb.Len() > 0 {
+			sb.WriteString("\n")
+		}
+		fmt.Fprintf(&sb, "### %s\n\n%s\n", sec.title, strings.TrimRight(sec.markdown, "\n"))
+	}
+
+	if err := current.WriteSummary(Redact(sb.String())); err != nil {
+		current.Log(LevelDebug, fmt.Sprintf("failed to write summary: %v", err))
+	}
+}
+
+// writeOutputsTable renders the recorded outputs, with long values in
+// collapsible blocks below the table.
+func writeOutputsTable(sb *strings.Builder) {
 	var details []outputEntry
 
 	sb.WriteString("### Outputs\n\n")
@@ -98,21 +314,49 @@ func WriteSummary() {
 
 	for _, e := range recorded {
 		if isLongValue(e.value) {
-			fmt.Fprintf(&sb, "| `%s` | *(see below)* |\n", e.name)
+			fmt.Fprintf(sb, "| `%s` | *(see below)* |\n", e.name)
 			details = append(details, e)
 		} else {
-			fmt.Fprintf(&sb, "| `%s` | `%s` |\n", e.name, e.value)
+			fmt.Fprintf(sb, "| `%s` | `%s` |\n", e.name, e.value)
 		}
 	}
 
 	for _, e := range details {
-		fmt.Fprintf(&sb, "\n<details><summary><code>%s</code></summary>\n\n```json\n%s\n```\n\n</details>\n", e.name, prettyJSON(e.value))
+		fmt.Fprintf(sb, "\n<details><summary><code>%s</code></summary>\n\n```json\n%s\n```\n\n</details>\n", e.name, prettyJSON(e.value))
+	}
+}
+
+// entryLabel builds a human-readable name for an entry from its dimension
+// values, e.g. "dev api". Entries without dimension values use their index.
+func entryLabel(entry expander.MatrixEntry, dimKeys []string, index int) string {
+	var parts []string
+	for _, dk := range dimKeys {
+		if v, ok := entry[dk]; ok {
+			parts = append(parts, expander.FormatValue(v))
+		}
 	}
+	if len(parts) == 0 {
+		return fmt.Sprintf("entry %d", index)
+	}
+	return strings.Join(parts, " ")
+}
 
-	f, err := os.OpenFile(summaryFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		return
+// stringFields renders an entry's fields as strings, JSON-encoding nested
+// values, for CI systems that only accept string variables.
+func stringFields(entry expander.MatrixEntry) map[string]string {
+	fields := make(map[string]string, len(entry))
+	for k, v := range entry {
+		fields[k] = expander.FormatValue(v)
+	}
+	return fields
+}
+
+// sortedKeys returns the keys of a map sorted alphabetically.
+func sortedKeys[M ~map[string]V, V any](m M) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
-	defer func() { _ = f.Close() }()
-	_, _ = f.WriteString(sb.String())
+	sort.Strings(keys)
+	return keys
 }
@@ -0,0 +1,449 @@
+package outputs
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dnd-it/action-config/v3/internal/expander"
+)
+
+var update = flag.Bool("update", false, "update golden fixtures in testdata/outputs")
+
+var fixtureEntries = []expander.MatrixEntry{
+	{"environment": "dev", "service": "api", "directory": "deploy/api", "tags": map[string]any{"team": "core"}},
+	{"environment": "prod", "service": "api", "directory": "deploy/api"},
+}
+
+var fixtureDimKeys = []string{"environment", "service"}
+
+// exercise drives a backend through a typical run and returns everything it
+// printed plus the contents of the given files, with tmp replaced by $TMP.
+func exercise(t *testing.T, b Backend, out *bytes.Buffer, tmp string, files ...string) string {
+	t.Helper()
+	Use(b)
+	recorded = nil
+	t.Cleanup(func() { Use(newGitHub()); recorded = nil })
+
+	if err := SetOutput("matrix", `[{"environment":"dev","service":"api"},{"environment":"prod","service":"api"}]`); err != nil {
+		t.Fatalf("SetOutput: %v", err)
+	}
+	if err := SetOutput("length", "2"); err != nil {
+		t.Fatalf("SetOutput: %v", err)
+	}
+	LogInfo("info message")
+	LogNotice("notice message")
+	LogWarning("warning message")
+	LogError("error message")
+	if err := WriteMatrix(fixtureEntries, fixtureDimKeys); err != nil {
+		t.Fatalf("WriteMatrix: %v", err)
+	}
+	WriteSummary()
+
+	var sb strings.Builder
+	sb.WriteString(out.String())
+	for _, name := range files {
+		data, err := os.ReadFile(filepath.Join(tmp, name))
+		if err != nil {
+			t.Fatalf("expected %s to be written: %v", name, err)
+		}
+		fmt.Fprintf(&sb, "--- %s ---\n%s", name, data)
+	}
+	if tmp == "" {
+		return sb.String()
+	}
+	return strings.ReplaceAll(sb.String(), tmp, "$TMP")
+}
+
+func assertGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("..", "..", "testdata", "outputs", name+".golden")
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("missing fixture %s (run with -update): %v", path, err)
+	}
+	if got != string(want) {
+		t.Errorf("output does not match %s:\n--- got ---\n%s\n--- want ---\n%s", path, got, want)
+	}
+}
+
+func TestGitHubBackend(t *testing.T) {
+	tmp := t.TempDir()
+	var out bytes.Buffer
+	b := &GitHub{
+		Out:         &out,
+		OutputFile:  filepath.Join(tmp, "output"),
+		EnvFile:     filepath.Join(tmp, "env"),
+		SummaryFile: filepath.Join(tmp, "summary.md"),
+	}
+	got := exercise(t, b, &out, tmp, "output", "summary.md")
+	assertGolden(t, "github", got)
+}
+
+func TestGitHubBackend_MultilineUsesRandomDelimiter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "output")
+	b := &GitHub{Out: &bytes.Buffer{}, OutputFile: path}
+
+	for range 2 {
+		if err := b.SetOutput("value", "line1\nline2"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	data, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 8 {
+		t.Fatalf("expected two 4-line heredocs, got:\n%s", data)
+	}
+	first := strings.TrimPrefix(lines[0], "value<<")
+	second := strings.TrimPrefix(lines[4], "value<<")
+	if !strings.HasPrefix(first, "ghadelimiter_") || lines[3] != first {
+		t.Errorf("malformed heredoc:\n%s", data)
+	}
+	if first == second {
+		t.Errorf("expected distinct delimiters, got %s twice", first)
+	}
+}
+
+func TestGitHubBackend_MissingOutputFile(t *testing.T) {
+	b := &GitHub{Out: &bytes.Buffer{}}
+	if err := b.SetOutput("matrix", "[]"); err == nil {
+		t.Fatal("expected error when GITHUB_OUTPUT is not set")
+	}
+}
+
+func TestGitHubBackend_UnwritableOutputFile(t *testing.T) {
+	b := &GitHub{Out: &bytes.Buffer{}, OutputFile: filepath.Join(t.TempDir(), "missing", "output")}
+	if err := b.SetOutput("matrix", "[]"); err == nil {
+		t.Fatal("expected error instead of falling back to set-output")
+	}
+}
+
+func TestGitHubBackend_OutputSizeLimit(t *testing.T) {
+	b := &GitHub{Out: &bytes.Buffer{}, OutputFile: filepath.Join(t.TempDir(), "output")}
+	err := b.SetOutput("matrix", strings.Repeat("x", githubMaxOutputSize+1))
+	if err == nil || !strings.Contains(err.Error(), "per-output limit") {
+		t.Fatalf("expected size limit error, got %v", err)
+	}
+}
+
+func TestGitHubBackend_Mask(t *testing.T) {
+	var out bytes.Buffer
+	b := &GitHub{Out: &out}
+	b.Mask("secret\n  other  ")
+	if out.String() != "::add-mask::secret\n::add-mask::other\n" {
+		t.Errorf("unexpected mask output: %q", out.String())
+	}
+}
+
+func TestLogErrorAt(t *testing.T) {
+	var out bytes.Buffer
+	Use(&GitHub{Out: &out})
+	t.Cleanup(func() { Use(newGitHub()) })
+
+	LogErrorAt("config.yaml", 3, 5, "settings.sort_by: must be a list\nof strings")
+	LogWarningAt("dir,name:x.yaml", 0, 0, "warning")
+	want := "::error file=config.yaml,line=3,col=5::settings.sort_by: must be a list%0Aof strings\n" +
+		"::warning file=dir%2Cname%3Ax.yaml::warning\n"
+	if out.String() != want {
+		t.Errorf("unexpected annotations:\n%s", out.String())
+	}
+
+	out.Reset()
+	Use(&Plain{textLogger: textLogger{Out: &out}})
+	LogErrorAt("config.yaml", 3, 0, "bad")
+	if out.String() != "ERROR: config.yaml:3: bad\n" {
+		t.Errorf("unexpected fallback: %q", out.String())
+	}
+}
+
+func TestMask_RedactsSummaryAndLogs(t *testing.T) {
+	var out bytes.Buffer
+	b := &Plain{textLogger: textLogger{Out: &out}}
+	Use(b)
+	recorded, masked = nil, nil
+	t.Cleanup(func() { Use(newGitHub()); recorded, masked = nil, nil })
+
+	Mask("111111111111")
+	Mask("")
+	if err := SetOutput("aws_account_id", "111111111111"); err != nil {
+		t.Fatal(err)
+	}
+	LogInfo("account 111111111111")
+	WriteSummary()
+
+	got := out.String()
+	if !strings.HasPrefix(got, "aws_account_id=***\n") {
+		t.Errorf("expected the printed output to be redacted, got:\n%s", got)
+	}
+	if strings.Contains(got, "111111111111") {
+		t.Errorf("expected output, log and summary to be redacted, got:\n%s", got)
+	}
+	if !strings.Contains(got, "account ***") || !strings.Contains(got, "| `aws_account_id` | `***` |") {
+		t.Errorf("expected redaction markers, got:\n%s", got)
+	}
+
+	out.Reset()
+	if err := b.SetEnv("AWS_ACCOUNT_ID", "111111111111"); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != "export AWS_ACCOUNT_ID=\"***\"\n" {
+		t.Errorf("expected the exported value to be redacted, got %q", got)
+	}
+}
+
+func TestAddSummarySection(t *testing.T) {
+	var out bytes.Buffer
+	Use(&Plain{textLogger: textLogger{Out: &out}})
+	recorded, sections, masked = nil, nil, nil
+	t.Cleanup(func() { Use(newGitHub()); recorded, sections, masked = nil, nil, nil })
+
+	Mask("secret.md")
+	AddSummarySection("Ignored changes", "- `deploy/api/secret.md`\n")
+	WriteSummary()
+
+	got := out.String()
+	if !strings.Contains(got, "### Ignored changes\n\n- `deploy/api/***`\n") {
+		t.Errorf("expected a redacted section, got:\n%s", got)
+	}
+	if strings.Contains(got, "### Outputs") {
+		t.Errorf("expected no outputs table without outputs, got:\n%s", got)
+	}
+}
+
+func TestHeredocDelimiter_NotInValue(t *testing.T) {
+	value := "ghadelimiter_\nfoo"
+	d, err := heredocDelimiter(value)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(value, d) {
+		t.Errorf("delimiter %s occurs in value", d)
+	}
+}
+
+func TestGitLabBackend(t *testing.T) {
+	tmp := t.TempDir()
+	var out bytes.Buffer
+	b := &GitLab{
+		textLogger:   textLogger{Out: &out},
+		DotenvFile:   filepath.Join(tmp, "action-config.env"),
+		PipelineFile: filepath.Join(tmp, "pipeline.yml"),
+		JobTemplate:  ".deploy",
+		Include:      ".gitlab/deploy.yml",
+	}
+	got := exercise(t, b, &out, tmp, "action-config.env", "pipeline.yml")
+	assertGolden(t, "gitlab", got)
+}
+
+func TestGitLabBackend_EmptyMatrix(t *testing.T) {
+	tmp := t.TempDir()
+	b := &GitLab{
+		textLogger:   textLogger{Out: &bytes.Buffer{}},
+		PipelineFile: filepath.Join(tmp, "pipeline.yml"),
+		JobTemplate:  ".deploy",
+	}
+	if err := b.WriteMatrix(nil, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, _ := os.ReadFile(b.PipelineFile)
+	if !strings.Contains(string(data), "No matrix entries") || strings.Contains(string(data), "extends") {
+		t.Errorf("expected a no-op job, got:\n%s", data)
+	}
+}
+
+func TestGitLabBackend_RejectsMultilineOutput(t *testing.T) {
+	b := &GitLab{DotenvFile: filepath.Join(t.TempDir(), "out.env")}
+	if err := b.SetOutput("x", "a\nb"); err == nil {
+		t.Fatal("expected error for multiline dotenv value")
+	}
+}
+
+func TestBuildkiteBackend(t *testing.T) {
+	tmp := t.TempDir()
+	var out bytes.Buffer
+	b := &Buildkite{
+		textLogger:   textLogger{Out: &out},
+		PipelineFile: filepath.Join(tmp, "pipeline.yml"),
+		Command:      "make deploy",
+		Agent: func(stdin string, args ...string) error {
+			fmt.Fprintf(&out, "buildkite-agent %s <<< %q\n", strings.Join(args, " "), stdin)
+			return nil
+		},
+	}
+	got := exercise(t, b, &out, tmp, "pipeline.yml")
+	assertGolden(t, "buildkite", got)
+}
+
+func TestBuildkiteBackend_RequiresCommand(t *testing.T) {
+	b := &Buildkite{PipelineFile: filepath.Join(t.TempDir(), "pipeline.yml")}
+	if err := b.WriteMatrix(fixtureEntries, fixtureDimKeys); err == nil {
+		t.Fatal("expected error without a command")
+	}
+}
+
+func TestAzureBackend(t *testing.T) {
+	tmp := t.TempDir()
+	var out bytes.Buffer
+	b := &Azure{Out: &out, SummaryDir: tmp}
+	got := exercise(t, b, &out, tmp, "action-config-summary.md")
+	assertGolden(t, "azure", got)
+}
+
+func TestPlainBackend(t *testing.T) {
+	var out bytes.Buffer
+	b := &Plain{textLogger: textLogger{Out: &out}}
+	got := exercise(t, b, &out, "")
+	assertGolden(t, "plain", got)
+}
+
+func TestNew_UnknownBackend(t *testing.T) {
+	if _, err := New("jenkins"); err == nil {
+		t.Fatal("expected error for unknown backend")
+	}
+}
+
+func TestDetect(t *testing.T) {
+	for _, v := range []string{"GITHUB_ACTIONS", "GITHUB_OUTPUT", "GITLAB_CI", "BUILDKITE", "TF_BUILD"} {
+		t.Setenv(v, "")
+	}
+
+	if got := Detect().Name(); got != PlainBackend {
+		t.Errorf("expected plain outside CI, got %s", got)
+	}
+
+	t.Setenv("GITLAB_CI", "true")
+	if got := Detect().Name(); got != GitLabBackend {
+		t.Errorf("expected gitlab, got %s", got)
+	}
+
+	t.Setenv("GITLAB_CI", "")
+	t.Setenv("TF_BUILD", "True")
+	if got := Detect().Name(); got != AzureBackend {
+		t.Errorf("expected azure, got %s", got)
+	}
+
+	t.Setenv("GITHUB_ACTIONS", "true")
+	if got := Detect().Name(); got != GitHubBackend {
+		t.Errorf("expected github to take precedence, got %s", got)
+	}
+}
+
+func TestGitLabBackend_TruncatesDotenv(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "out.env")
+	if err := os.WriteFile(file, []byte("STALE=1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b := &GitLab{textLogger: textLogger{Out: &bytes.Buffer{}}, DotenvFile: file}
+	for _, name := range []string{"a", "b"} {
+		if err := b.SetOutput(name, "1"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	data, _ := os.ReadFile(file)
+	if string(data) != "a=1\nb=1\n" {
+		t.Errorf("expected only this run's variables, got:\n%s", data)
+	}
+}
+
+func TestGitLabBackend_DotenvLimits(t *testing.T) {
+	var out bytes.Buffer
+	b := &GitLab{
+		textLogger:         textLogger{Out: &out},
+		DotenvFile:         filepath.Join(t.TempDir(), "out.env"),
+		MaxDotenvBytes:     16,
+		MaxDotenvVariables: 2,
+	}
+	for _, kv := range [][2]string{{"a", "1"}, {"long", "0123456789"}, {"b", "2"}, {"c", "3"}, {"a", "4"}} {
+		if err := b.SetOutput(kv[0], kv[1]); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	data, _ := os.ReadFile(b.DotenvFile)
+	if string(data) != "a=1\nb=2\na=4\n" {
+		t.Errorf("unexpected report:\n%s", data)
+	}
+	if !strings.Contains(out.String(), "limited to 16 bytes") || !strings.Contains(out.String(), "at most 2 variables") {
+		t.Errorf("expected warnings about both limits, got:\n%s", out.String())
+	}
+}
+
+func TestMask_EscapedFormsAndShortValues(t *testing.T) {
+	var out bytes.Buffer
+	Use(&Plain{textLogger: textLogger{Out: &out}})
+	masked = nil
+	t.Cleanup(func() { Use(newGitHub()); masked = nil })
+
+	Mask(`pa"ss\word<`)
+	Mask("1")
+	got := Redact(`{"password":"pa\"ss\\word<","raw":"pa\"ss\\word<","n":1}`)
+	if got != `{"password":"***","raw":"***","n":1}` {
+		t.Errorf("expected escaped forms to be redacted, got %s", got)
+	}
+	if !strings.Contains(out.String(), "too short to be masked") {
+		t.Errorf("expected a warning about the short value, got:\n%s", out.String())
+	}
+}
+
+func TestParseFlatMode(t *testing.T) {
+	tests := []struct {
+		in   string
+		want FlatMode
+		err  bool
+	}{
+		{in: "", want: FlatMode{Kind: FlatUniform}},
+		{in: " all ", want: FlatMode{Kind: FlatAll}},
+		{in: "none", want: FlatMode{Kind: FlatNone}},
+		{in: "fields: directory, aws_region", want: FlatMode{Fields: []string{"directory", "aws_region"}}},
+		{in: "directory, aws_region", want: FlatMode{Fields: []string{"directory", "aws_region"}}},
+		{in: "directory", want: FlatMode{Fields: []string{"directory"}}},
+		{in: "fields:", err: true},
+		{in: " , ", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseFlatMode(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: expected %v, got %v, %v", tt.in, tt.want, got, err)
+		}
+	}
+}
+
+func TestFlatValues(t *testing.T) {
+	entries := []expander.MatrixEntry{
+		{"service": "api", "region": "eu", "tags": map[string]any{"team": "core"}, "token": "x"},
+		{"service": "worker", "region": "eu", "tags": map[string]any{"team": "core"}, "token": "x"},
+	}
+	skip := map[string]bool{"token": true}
+	tests := []struct {
+		mode FlatMode
+		want map[string]string
+	}{
+		{FlatMode{Kind: FlatUniform}, map[string]string{"region": "eu", "tags": `{"team":"core"}`}},
+		{FlatMode{Kind: FlatAll}, map[string]string{"region": "eu", "tags": `{"team":"core"}`, "service": `["api","worker"]`}},
+		{FlatMode{Kind: FlatNone}, map[string]string{}},
+		{FlatMode{Fields: []string{"service", "missing"}}, map[string]string{"service": `["api","worker"]`}},
+	}
+	for _, tt := range tests {
+		got, err := FlatValues(entries, tt.mode, skip)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: expected %v, got %v, %v", tt.mode, tt.want, got, err)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package outputs
+
+import (
+	"fmt"
+
+	"github.com/dnd-it/action-config/v3/internal/expander"
+)
+
+// Plain prints outputs as name=value lines for local runs and unknown CI
+// systems.
+type Plain struct {
+	textLogger
+}
+
+func newPlain() *Plain {
+	return &Plain{textLogger: newTextLogger()}
+}
+
+// Name implements Backend.
+func (p *Plain) Name() string { return PlainBackend }
+
+// SetOutput implements Backend. The output goes to the log, so masked
+// values are redacted.
+func (p *Plain) SetOutput(name, value string) error {
+	_, err := fmt.Fprintf(p.Out, "%s=%s\n", name, Redact(value))
+	return err
+}
+
+// SetEnv implements Backend by printing a shell export statement, with
+// masked values redacted.
+func (p *Plain) SetEnv(name, value string) error {
+	_, err := fmt.Fprintf(p.Out, "export %s=%q\n", name, Redact(value))
+	return err
+}
+
+// Mask implements Backend. Plain output has no masking of its own; its
+// outputs are redacted instead.
+func (p *Plain) Mask(string) {}
+
+// WriteSummary implements Backend by printing the markdown.
+func (p *Plain) WriteSummary(markdown string) error {
+	_, err := fmt.Fprintln(p.Out, markdown)
+	return err
+}
+
+// WriteMatrix implements Backend. The matrix is already printed as the
+// "matrix" output.
+func (p *Plain) WriteMatrix([]expander.MatrixEntry, []string) error {
+	return nil
+}
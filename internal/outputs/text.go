@@ -0,0 +1,35 @@
+package outputs
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// textLogger prints log messages as plain prefixed lines, for CI systems
+// without workflow commands. Debug messages are only shown when
+// ACTION_CONFIG_DEBUG=true.
+type textLogger struct {
+	Out   io.Writer
+	Debug bool
+}
+
+func newTextLogger() textLogger {
+	return textLogger{Out: os.Stdout, Debug: os.Getenv("ACTION_CONFIG_DEBUG") == "true"}
+}
+
+// Log implements Backend.
+func (t textLogger) Log(level Level, msg string) {
+	switch level {
+	case LevelDebug:
+		if t.Debug {
+			_, _ = fmt.Fprintf(t.Out, "DEBUG: %s\n", msg)
+		}
+	case LevelWarning:
+		_, _ = fmt.Fprintf(t.Out, "WARNING: %s\n", msg)
+	case LevelError:
+		_, _ = fmt.Fprintf(t.Out, "ERROR: %s\n", msg)
+	default:
+		_, _ = fmt.Fprintln(t.Out, msg)
+	}
+}
@@ -0,0 +1,604 @@
+// Package matrix is the public Go API of action-config. It loads matrix
+// configuration files, expands them into matrix entries, restricts them to
+// changed files and explains where each field of an entry came from.
+//
+// The package is versioned with the module: within a major version (the /v3
+// import path) exported identifiers are neither removed nor changed in an
+// incompatible way. Packages under internal/ carry no such guarantee.
+package matrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/dnd-it/action-config/v3/internal/expander"
+)
+
+// Entry is a single expanded matrix entry, keyed by field name. Values are
+// kept as written in the config: numbers are json.Number, never float64,
+// YAML timestamps are strings, and the rest are string, bool, nil, []any and
+// map[string]any. json.Marshal encodes them unchanged.
+type Entry = expander.MatrixEntry
+
+// defaultDimension is the primary dimension used when neither Options nor
+// settings.dimension name one.
+const defaultDimension = "service"
+
+// ConfigError is a problem in a configuration file, located by file, line,
+// column and the dotted path of the offending value.
+type ConfigError = expander.ConfigError
+
+// ConfigErrors is returned by Load with every problem found in the file.
+// It matches ErrInvalidConfig.
+type ConfigErrors = expander.ConfigErrors
+
+// DisabledValue is a dimension value turned off with enabled: false, with
+// its disabled_reason.
+type DisabledValue = expander.DisabledValue
+
+// FieldError is an expanded entry missing a required field or holding a
+// value that violates settings.field_types.
+type FieldError = expander.FieldError
+
+// FieldErrors is returned by Expand with every field problem of every
+// entry. It matches ErrInvalidConfig.
+type FieldErrors = expander.FieldErrors
+
+// ChangeReason explains why change detection selected a value: a changed
+// file and the chain of uses paths that led to it.
+type ChangeReason = expander.ChangeReason
+
+// Violation is a rule of the rules block that did not hold for an entry or
+// for the matrix.
+type Violation = expander.Violation
+
+// Rule severities: violations of error rules should fail the run, warn
+// rules are only reported.
+const (
+	SeverityError = expander.SeverityError
+	SeverityWarn  = expander.SeverityWarn
+)
+
+// Collapse policies for a field that differs between the entries merged by
+// Options.Collapse.
+const (
+	CollapseDrop  = expander.CollapseDrop
+	CollapseError = expander.CollapseError
+	CollapseFirst = expander.CollapseFirst
+	CollapseList  = expander.CollapseList
+)
+
+var (
+	// ErrConfigNotFound is returned by Load when the file does not exist.
+	ErrConfigNotFound = expander.ErrConfigNotFound
+	// ErrInvalidConfig is matched by the ConfigErrors returned by Load when
+	// the file cannot be parsed or is malformed.
+	ErrInvalidConfig = expander.ErrInvalidConfig
+	// ErrUnknownProfile is returned when Options.Profile is not defined in
+	// the profiles block.
+	ErrUnknownProfile = errors.New("unknown profile")
+	// ErrInvalidTarget is returned when an Options.Target entry matches no
+	// value, names an unknown group or selects several dimensions.
+	ErrInvalidTarget = expander.ErrInvalidTarget
+	// ErrInvalidCollapse is returned when Options.Collapse names an unknown
+	// or the primary dimension, when Options.CollapsePolicy is unknown and
+	// when collapsed entries conflict under CollapseError.
+	ErrInvalidCollapse = expander.ErrInvalidCollapse
+)
+
+// Config is a loaded configuration file. It is not modified by Expand or
+// Explain and may be reused for several expansions.
+type Config struct {
+	path string
+	// raw is the complete parsed file, dims the non-reserved top-level keys.
+	raw  expander.RawConfig
+	dims expander.RawConfig
+	opts expander.OptionsConfig
+}
+
+// Load reads and parses a JSON or YAML configuration file.
+func Load(ctx context.Context, path string) (*Config, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	raw, err := expander.ParseConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	opts, dims := expander.ParseOptions(raw)
+	return &Config{path: path, raw: raw, dims: dims, opts: opts}, nil
+}
+
+// Path returns the path the config was loaded from.
+func (c *Config) Path() string { return c.path }
+
+// Dimension returns settings.dimension, or "" when unset.
+func (c *Config) Dimension() string { return c.opts.Dimension }
+
+// BaseDir returns settings.base_dir, or "" when unset.
+func (c *Config) BaseDir() string { return c.opts.BaseDir }
+
+// Dimensions returns the sorted names of all dimensions in the config.
+func (c *Config) Dimensions() []string { return expander.DimensionKeys(c.dims) }
+
+// Values returns the values of a dimension, or nil if it is not defined.
+// For a discovered dimension only the values with an explicit config are
+// known before expansion; Result.Values lists the discovered ones too.
+func (c *Config) Values(dimension string) []string {
+	return expander.ExtractDimensionValues(c.dims, dimension)
+}
+
+// Profiles returns the sorted names of the profiles in the profiles block.
+func (c *Config) Profiles() []string {
+	names := make([]string, 0, len(c.opts.Profiles))
+	for name := range c.opts.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SensitiveFields returns the fields listed in settings.sensitive or tagged
+// with !secret.
+func (c *Config) SensitiveFields() []string { return c.opts.Sensitive }
+
+// OmitSensitive reports whether settings.omit_sensitive is set.
+func (c *Config) OmitSensitive() bool { return c.opts.OmitSensitive }
+
+// Warnings returns deprecation warnings about legacy keys in the config,
+// which Migrate rewrites.
+func (c *Config) Warnings() []string { return c.opts.Warnings }
+
+// SensitiveValues returns every value stored under a sensitive field
+// anywhere in the config, for masking before anything is printed.
+func (c *Config) SensitiveValues() []string {
+	return expander.SensitiveConfigValues(c.raw, c.opts.Sensitive)
+}
+
+// Options controls an expansion. Zero values fall back to the selected
+// profile and then to the config's settings.
+type Options struct {
+	// Dimension selects the primary dimension, overriding settings.dimension.
+	Dimension string
+	// Profile selects a named profile from the profiles block. Target,
+	// Environment, SortBy, Fields, Omit, Collapse and CollapsePolicy replace
+	// the profile's values when set; Exclude and Include are applied in
+	// addition to the profile's.
+	Profile string
+	// Target keeps only these values of the primary dimension. Entries may
+	// be glob patterns ("api-*"), groups from the groups block ("@backend")
+	// or negations ("!legacy"); an entry matching nothing fails with
+	// ErrInvalidTarget. A "dimension:" prefix ("terraform:*") switches the
+	// primary dimension first, as does, deprecated, a single value naming
+	// another dimension.
+	Target      []string
+	Environment []string
+	Exclude     []Entry
+	Include     []Entry
+	SortBy      []string
+	Fields      []string
+	Omit        []string
+	// Collapse removes these dimensions, e.g. environment for a job that
+	// runs once per service, and merges the entries that only differed in
+	// them. CollapsePolicy decides what happens to a field that differs
+	// between merged entries: CollapseDrop (the default) leaves it out,
+	// CollapseError fails, CollapseFirst keeps the first entry's value and
+	// CollapseList collects the distinct values into a list. Required fields
+	// and field types are checked before merging.
+	Collapse       []string
+	CollapsePolicy string
+	// ChangedFiles keeps only primary dimension values with at least one
+	// changed file under {base_dir}/{value}/ or under a path the value uses,
+	// directly or transitively. Nil disables change filtering;
+	// an empty, non-nil slice means nothing changed. When Target is set and
+	// none of its values changed, the target is dropped and every changed
+	// value is kept, as the action always did.
+	ChangedFiles []string
+	// DetectChanges, if set and ChangedFiles is nil, is called to get the
+	// changed files, e.g. from git. It is only called when the primary
+	// dimension has values, so configs without one never run detection.
+	DetectChanges func() ([]string, error)
+	// IgnorePaths are glob patterns, relative to the repository root, for
+	// changed files that do not count as changes. They are used in addition
+	// to settings.ignore_paths and the ignore_paths of each value.
+	IgnorePaths []string
+	// Root is the repository root that ChangedFiles, uses paths and
+	// discover patterns are relative to. It is read to discover dimension
+	// values, to load fragments when settings.fragment_keys is set and, when
+	// settings.discover_dependencies is set, dependencies. Empty means the
+	// current directory.
+	Root string
+	// Event is the context rules see as event, e.g. {"name": "push"}.
+	Event map[string]any
+}
+
+// Result is the outcome of an expansion.
+type Result struct {
+	Entries []Entry
+	// Dimension is the resolved primary dimension.
+	Dimension string
+	// Dimensions are the sorted dimension names remaining after dimension
+	// selection and collapsing.
+	Dimensions []string
+	// Keys are the sorted non-reserved top-level keys remaining after
+	// dimension selection and collapsing: the dimensions and top-level
+	// fields. The action orders the matrix, indexes the config output and
+	// emits values_<key> outputs by them.
+	Keys []string
+	// Collapsed are the dimensions removed by Options.Collapse or the
+	// profile.
+	Collapsed []string
+	// Values are all values of the primary dimension, discovered ones
+	// included, before any filtering.
+	Values  []string
+	BaseDir string
+	// Target and Environment are the effective filters after applying the
+	// profile and change filtering. Target holds the values the target
+	// patterns matched.
+	Target      []string
+	Environment []string
+	// ChangeFiltered reports whether changed files were applied. It is false
+	// when there were none or the primary dimension is not in the config.
+	ChangeFiltered bool
+	// ChangedFiles are the changed files applied, from Options.ChangedFiles
+	// or Options.DetectChanges.
+	ChangedFiles []string
+	// ChangedValues are the primary dimension values with changes in their
+	// directory or in a path they use.
+	ChangedValues []string
+	// ChangeReasons explains, for each changed value, why it was selected.
+	ChangeReasons map[string]ChangeReason
+	// IgnoredFiles are the changed files dropped by an ignore pattern.
+	IgnoredFiles []string
+	// Disabled are the values turned off with enabled: false, which no
+	// entry has.
+	Disabled []DisabledValue
+	// Violations are the rules that did not hold for Entries. Expand does
+	// not fail because of them; callers decide based on their severity.
+	Violations []Violation
+	// Sensitive are the sensitive fields: those of the config and the fields
+	// tagged !secret in fragments.
+	Sensitive []string
+	// SensitiveValues are the values of sensitive fields in fragments and
+	// in Options.Include, which the config's SensitiveValues do not cover.
+	// Mask them before printing anything from the result.
+	SensitiveValues []string
+	// Warnings are deprecation warnings about the options, such as a target
+	// switching the dimension without a "dimension:" prefix or the implicit
+	// "service" dimension being used.
+	Warnings []string
+}
+
+// Explanation is an expanded entry with the source of each of its fields,
+// e.g. "global", "dimension", "service.api" or "include".
+type Explanation struct {
+	Entry   Entry
+	Sources map[string]string
+}
+
+// Explained is the result of Explain.
+type Explained struct {
+	// Entries are the expanded entries with the source of their fields.
+	Entries []Explanation
+	// Disabled are the values turned off with enabled: false, which no
+	// entry has, with their disabled_reason.
+	Disabled []DisabledValue
+}
+
+// Expand expands the config into matrix entries and checks them against
+// the rules block.
+func Expand(ctx context.Context, c *Config, opts Options) (*Result, error) {
+	res, _, _, err := expand(ctx, c, opts)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Explain expands the config like Expand and reports, for every entry, which
+// part of the config supplied each field, and the disabled values.
+func Explain(ctx context.Context, c *Config, opts Options) (*Explained, error) {
+	res, dims, optsCfg, err := expand(ctx, c, opts)
+	if err != nil {
+		return nil, err
+	}
+	explained := &Explained{
+		Entries:  make([]Explanation, len(res.Entries)),
+		Disabled: res.Disabled,
+	}
+	for i, entry := range res.Entries {
+		explained.Entries[i] = Explanation{
+			Entry:   entry,
+			Sources: expander.Provenance(dims, optsCfg, entry, res.Collapsed),
+		}
+	}
+	return explained, nil
+}
+
+// FilterChanged returns the values with at least one changed file under
+// {baseDir}/{value}/ (or {value}/ when baseDir is empty).
+//
+// Deprecated: set Options.ChangedFiles instead, which also applies
+// ignore_paths and uses.
+func FilterChanged(changedFiles []string, baseDir string, values []string) []string {
+	return expander.FilterChanged(changedFiles, baseDir, values)
+}
+
+// Lint checks the config against the repository at opts.Root: every value
+// of the primary dimension, discovered or explicit, must have a
+// {base_dir}/{value} directory. The primary dimension is selected as in
+// Expand, from opts.Dimension, opts.Target or the profile's target. It
+// returns one ConfigError per problem; the error is for invalid options or
+// a failed discovery.
+func Lint(ctx context.Context, c *Config, opts Options) (ConfigErrors, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	dims, optsCfg, _, _, err := c.selectDimension(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	missing := expander.MissingDirectories(dims, optsCfg.Dimension, optsCfg.BaseDir, opts.Root)
+	var problems ConfigErrors
+	for _, path := range slices.Sorted(maps.Keys(missing)) {
+		problems = append(problems, &ConfigError{
+			File: c.path,
+			Path: path,
+			Msg:  fmt.Sprintf("directory %s does not exist", missing[path]),
+		})
+	}
+	return problems, nil
+}
+
+// Migrate rewrites a configuration file in the format given by its
+// extension (".json", ".yaml" or ".yml") to the current format, preserving
+// YAML comments and key order. It returns the rewritten file and a
+// description of each change; without changes the data is returned as is.
+func Migrate(data []byte, ext string) ([]byte, []string, error) {
+	return expander.Migrate(data, ext)
+}
+
+// expand runs an expansion and also returns the dimensions and settings it
+// resolved, for Explain.
+func expand(ctx context.Context, c *Config, opts Options) (*Result, expander.RawConfig, expander.OptionsConfig, error) {
+	optsCfg := c.opts
+	if err := ctx.Err(); err != nil {
+		return nil, nil, optsCfg, err
+	}
+
+	for _, p := range opts.IgnorePaths {
+		if err := expander.ValidateGlob(p); err != nil {
+			return nil, nil, optsCfg, fmt.Errorf("ignore path: %w", err)
+		}
+	}
+
+	dims, optsCfg, eopts, warnings, err := c.selectDimension(opts)
+	if err != nil {
+		return nil, nil, optsCfg, err
+	}
+	if err := expander.LoadFragments(dims, &optsCfg, opts.Root); err != nil {
+		return nil, nil, optsCfg, err
+	}
+	if err := expander.ValidateCollapse(dims, optsCfg.Dimension, eopts.Collapse, eopts.CollapsePolicy); err != nil {
+		return nil, nil, optsCfg, err
+	}
+
+	collapsed := func(k string) bool { return slices.Contains(eopts.Collapse, k) }
+	sensitive := slices.Concat(
+		expander.SensitiveFragmentValues(optsCfg.Fragments, optsCfg.Sensitive),
+		expander.SensitiveValues(eopts.InputInclude, optsCfg.Sensitive))
+
+	res := &Result{
+		Dimension:       optsCfg.Dimension,
+		Dimensions:      slices.DeleteFunc(expander.DimensionKeys(dims), collapsed),
+		Keys:            slices.DeleteFunc(slices.Sorted(maps.Keys(dims)), collapsed),
+		Collapsed:       eopts.Collapse,
+		Values:          expander.ExtractDimensionValues(dims, optsCfg.Dimension),
+		BaseDir:         optsCfg.BaseDir,
+		Disabled:        expander.DisabledValues(dims),
+		Sensitive:       optsCfg.Sensitive,
+		SensitiveValues: sensitive,
+		Warnings:        warnings,
+	}
+
+	if len(eopts.FilterValues) > 0 {
+		eopts.FilterValues, err = expander.MatchTargets(optsCfg.Dimension, eopts.FilterValues, res.Values, optsCfg.Groups, res.Disabled)
+		if err != nil {
+			return nil, nil, optsCfg, err
+		}
+		disabled, err := expander.DisabledTargets(optsCfg.Dimension, eopts.FilterValues, res.Disabled)
+		if err != nil {
+			return nil, nil, optsCfg, err
+		}
+		res.Warnings = append(res.Warnings, disabled...)
+		// Negations may leave nothing, which applyFilter would take as no
+		// filter.
+		if len(eopts.FilterValues) == 0 {
+			res.Target = eopts.FilterValues
+			res.Entries = []Entry{}
+			res.Violations = expander.CheckRules(optsCfg.Rules, nil, nil, opts.Event, 0)
+			return res, dims, optsCfg, nil
+		}
+	}
+
+	changedFiles := opts.ChangedFiles
+	if known := res.Values; known != nil {
+		if changedFiles == nil && opts.DetectChanges != nil {
+			if changedFiles, err = opts.DetectChanges(); err != nil {
+				return nil, nil, optsCfg, err
+			}
+		}
+		if changedFiles != nil {
+			res.ChangeFiltered = true
+			res.ChangedFiles = changedFiles
+			files, ignored := expander.IgnoreChanged(changedFiles, optsCfg.BaseDir,
+				slices.Concat(optsCfg.IgnorePaths, opts.IgnorePaths), expander.ValueIgnorePaths(dims, optsCfg.Dimension))
+			res.IgnoredFiles = ignored
+			res.ChangeReasons = expander.ChangedValuesWithDeps(files, optsCfg.BaseDir, known, dependencies(dims, optsCfg, opts.Root))
+			for _, v := range known {
+				if _, ok := res.ChangeReasons[v]; ok {
+					res.ChangedValues = append(res.ChangedValues, v)
+				}
+			}
+			if len(res.ChangedValues) == 0 {
+				res.Entries = []Entry{}
+				res.Violations = expander.CheckRules(optsCfg.Rules, nil, nil, opts.Event, 0)
+				return res, dims, optsCfg, nil
+			}
+			eopts.FilterValues = intersect(eopts.FilterValues, res.ChangedValues)
+		}
+	}
+	res.Target = eopts.FilterValues
+	res.Environment = eopts.EnvironmentFilter
+
+	if err := ctx.Err(); err != nil {
+		return nil, nil, optsCfg, err
+	}
+	eopts.Event = opts.Event
+	eopts.OnViolation = func(v Violation) { res.Violations = append(res.Violations, v) }
+	entries, err := expander.Expand(dims, optsCfg, eopts)
+	if err != nil {
+		return nil, nil, optsCfg, err
+	}
+	res.Entries = entries
+	return res, dims, optsCfg, nil
+}
+
+// dependencies returns the paths each directory uses: the uses of the value
+// it belongs to and, with settings.discover_dependencies, the local
+// dependencies found in its go.mod and Terraform files.
+func dependencies(dims expander.RawConfig, optsCfg expander.OptionsConfig, root string) func(dir string) []string {
+	uses := expander.ValueUses(dims, optsCfg.Dimension, optsCfg.BaseDir)
+	if root == "" {
+		root = "."
+	}
+	return func(dir string) []string {
+		deps := uses[dir]
+		if optsCfg.DiscoverDependencies {
+			deps = slices.Concat(deps, expander.DiscoverDependencies(root, dir))
+		}
+		return deps
+	}
+}
+
+// selectDimension resolves the options and the primary dimension: the
+// dimension option, then a dimension named by the target, which a profile
+// may set, then settings.dimension, then "service". It returns a copy of the
+// dimensions with discovered values added and a replaced primary dimension
+// removed, and the deprecation warnings.
+func (c *Config) selectDimension(opts Options) (expander.RawConfig, expander.OptionsConfig, expander.Options, []string, error) {
+	optsCfg := c.opts
+	eopts, err := c.resolveOptions(opts)
+	if err != nil {
+		return nil, optsCfg, eopts, nil, err
+	}
+
+	// Dimension priority: explicit option > config settings > "service".
+	// The "service" fallback preserves backward compat for v3; v4 will
+	// remove it to make dimension fully optional.
+	fallback := opts.Dimension == "" && optsCfg.Dimension == ""
+	if fallback {
+		optsCfg.Dimension = defaultDimension
+	}
+	eopts.FilterKey = optsCfg.Dimension
+
+	// Discovery and ResolveTarget replace dimensions, so work on a copy.
+	dims := maps.Clone(c.dims)
+	prefixes, err := expander.DiscoverValues(dims, opts.Root)
+	if err != nil {
+		return nil, optsCfg, eopts, nil, err
+	}
+	warnings, err := expander.ResolveTarget(dims, &optsCfg, &eopts, opts.Dimension)
+	if err != nil {
+		return nil, optsCfg, eopts, nil, err
+	}
+	// Warn only when the fallback is used: not when the target switches to
+	// another dimension.
+	if _, ok := dims[defaultDimension]; ok && fallback && optsCfg.Dimension == defaultDimension {
+		warnings = append(warnings, expander.ServiceFallbackWarning)
+	}
+	// The directories of a discovered primary dimension are under the static
+	// part of its pattern unless base_dir says otherwise.
+	if optsCfg.BaseDir == "" {
+		optsCfg.BaseDir = prefixes[optsCfg.Dimension]
+	}
+	return dims, optsCfg, eopts, warnings, nil
+}
+
+// resolveOptions applies the selected profile and the explicit options on
+// top of it.
+func (c *Config) resolveOptions(opts Options) (expander.Options, error) {
+	var eopts expander.Options
+
+	if opts.Profile != "" {
+		p, ok := c.opts.Profiles[opts.Profile]
+		if !ok {
+			return eopts, fmt.Errorf("%w %q (available: %s)", ErrUnknownProfile, opts.Profile, strings.Join(c.Profiles(), ", "))
+		}
+		eopts = expander.Options{
+			FilterValues:      p.Target,
+			EnvironmentFilter: p.Environment,
+			InputExclude:      p.Exclude,
+			InputInclude:      p.Include,
+			SortBy:            p.SortBy,
+			Fields:            p.Fields,
+			Omit:              p.Omit,
+			Collapse:          p.Collapse,
+			CollapsePolicy:    p.CollapsePolicy,
+		}
+	}
+
+	if opts.Target != nil {
+		eopts.FilterValues = opts.Target
+	}
+	if opts.Environment != nil {
+		eopts.EnvironmentFilter = opts.Environment
+	}
+	if opts.SortBy != nil {
+		eopts.SortBy = opts.SortBy
+	}
+	if opts.Fields != nil {
+		eopts.Fields = opts.Fields
+	}
+	if opts.Omit != nil {
+		eopts.Omit = opts.Omit
+	}
+	if opts.Collapse != nil {
+		eopts.Collapse = opts.Collapse
+	}
+	if opts.CollapsePolicy != "" {
+		eopts.CollapsePolicy = opts.CollapsePolicy
+	}
+	eopts.InputExclude = slices.Concat(eopts.InputExclude, opts.Exclude)
+	eopts.InputInclude = slices.Concat(eopts.InputInclude, opts.Include)
+
+	return eopts, nil
+}
+
+// intersect returns the changed values that are also in filter, or all
+// changed values when there is no filter or none of its values changed.
+func intersect(filter, changed []string) []string {
+	if len(filter) == 0 {
+		return changed
+	}
+	allowed := make(map[string]bool, len(filter))
+	for _, s := range filter {
+		allowed[s] = true
+	}
+	var result []string
+	for _, s := range changed {
+		if allowed[s] {
+			result = append(result, s)
+		}
+	}
+	if result == nil {
+		return changed
+	}
+	return result
+}
@@ -0,0 +1,583 @@
+package matrix
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testConfig = `
+settings:
+  base_dir: deploy
+  ignore_paths: ["**/*.md"]
+global:
+  aws_region: us-east-1
+profiles:
+  plan:
+    target: api
+    environment: [dev, prod]
+    exclude:
+      - environment: prod
+        service: frontend
+    sort_by: [service]
+environment:
+  dev:
+    aws_account_id: "111111111111"
+  prod:
+    aws_account_id: "222222222222"
+service:
+  api:
+    aws_region: eu-west-1
+    ignore_paths: [docs/]
+    uses: [libs/auth]
+  frontend:
+`
+
+func loadTestConfig(t *testing.T) *Config {
+	t.Helper()
+	f, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(testConfig); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	c, err := Load(context.Background(), f.Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return c
+}
+
+func values(entries []Entry, key string) []string {
+	var result []string
+	for _, e := range entries {
+		result = append(result, e[key].(string))
+	}
+	return result
+}
+
+func TestLoad_Errors(t *testing.T) {
+	_, err := Load(context.Background(), "testdata/missing.yaml")
+	if !errors.Is(err, ErrConfigNotFound) {
+		t.Errorf("expected ErrConfigNotFound, got %v", err)
+	}
+
+	_, err = Load(context.Background(), "../../testdata/invalid-config.json")
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("expected ErrInvalidConfig, got %v", err)
+	}
+}
+
+func TestLoad_CanceledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Load(ctx, "../../testdata/valid-list-config.yml"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestConfig_Accessors(t *testing.T) {
+	c := loadTestConfig(t)
+	if !reflect.DeepEqual(c.Dimensions(), []string{"environment", "service"}) {
+		t.Errorf("unexpected dimensions %v", c.Dimensions())
+	}
+	if !reflect.DeepEqual(c.Values("service"), []string{"api", "frontend"}) {
+		t.Errorf("unexpected values %v", c.Values("service"))
+	}
+	if !reflect.DeepEqual(c.Profiles(), []string{"plan"}) {
+		t.Errorf("unexpected profiles %v", c.Profiles())
+	}
+	if c.BaseDir() != "deploy" {
+		t.Errorf("unexpected base dir %q", c.BaseDir())
+	}
+}
+
+func TestExpand(t *testing.T) {
+	c := loadTestConfig(t)
+	res, err := Expand(context.Background(), c, Options{Environment: []string{"dev"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Dimension != "service" {
+		t.Errorf("expected the service fallback dimension, got %q", res.Dimension)
+	}
+	if !reflect.DeepEqual(values(res.Entries, "service"), []string{"api", "frontend"}) {
+		t.Errorf("unexpected entries %v", res.Entries)
+	}
+	if res.Entries[0]["directory"] != "deploy/api" {
+		t.Errorf("unexpected directory %v", res.Entries[0]["directory"])
+	}
+}
+
+func TestExpand_ProfileAndOverrides(t *testing.T) {
+	c := loadTestConfig(t)
+	res, err := Expand(context.Background(), c, Options{
+		Profile: "plan",
+		Target:  []string{"api", "frontend"},
+		Exclude: []Entry{{"environment": "dev", "service": "api"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Target replaces the profile's target; both excludes apply.
+	var got []string
+	for _, e := range res.Entries {
+		got = append(got, e["service"].(string)+"/"+e["environment"].(string))
+	}
+	want := []string{"api/prod", "frontend/dev"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestExpand_UnknownProfile(t *testing.T) {
+	c := loadTestConfig(t)
+	_, err := Expand(context.Background(), c, Options{Profile: "deploy"})
+	if !errors.Is(err, ErrUnknownProfile) {
+		t.Fatalf("expected ErrUnknownProfile, got %v", err)
+	}
+	if want := `unknown profile "deploy" (available: plan)`; err.Error() != want {
+		t.Errorf("expected %q, got %q", want, err.Error())
+	}
+}
+
+func TestExpand_ChangedFiles(t *testing.T) {
+	c := loadTestConfig(t)
+
+	res, err := Expand(context.Background(), c, Options{ChangedFiles: []string{"deploy/frontend/main.tf", "README.md"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !res.ChangeFiltered || !reflect.DeepEqual(res.ChangedValues, []string{"frontend"}) {
+		t.Errorf("unexpected changed values %v", res.ChangedValues)
+	}
+	if !reflect.DeepEqual(values(res.Entries, "service"), []string{"frontend", "frontend"}) {
+		t.Errorf("unexpected entries %v", res.Entries)
+	}
+
+	// A target without changes is dropped, as the action always did.
+	res, err = Expand(context.Background(), c, Options{Target: []string{"api"}, ChangedFiles: []string{"deploy/frontend/main.tf"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(res.Target, []string{"frontend"}) || !reflect.DeepEqual(values(res.Entries, "service"), []string{"frontend", "frontend"}) {
+		t.Errorf("expected only the changed value, got %v, %v", res.Target, res.Entries)
+	}
+
+	res, err = Expand(context.Background(), c, Options{ChangedFiles: []string{}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Entries == nil || len(res.Entries) != 0 {
+		t.Errorf("expected an empty, non-nil matrix, got %v", res.Entries)
+	}
+}
+
+func TestExpand_IgnorePaths(t *testing.T) {
+	c := loadTestConfig(t)
+
+	res, err := Expand(context.Background(), c, Options{
+		ChangedFiles: []string{"deploy/api/docs/usage.txt", "deploy/api/README.md", "deploy/frontend/app.ts", "deploy/frontend/tests/app.test.ts"},
+		IgnorePaths:  []string{"deploy/*/tests/**"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(res.ChangedValues, []string{"frontend"}) {
+		t.Errorf("expected only frontend to change, got %v", res.ChangedValues)
+	}
+	want := []string{"deploy/api/docs/usage.txt", "deploy/api/README.md", "deploy/frontend/tests/app.test.ts"}
+	if !reflect.DeepEqual(res.IgnoredFiles, want) {
+		t.Errorf("expected ignored %v, got %v", want, res.IgnoredFiles)
+	}
+	for _, e := range res.Entries {
+		if _, ok := e["ignore_paths"]; ok {
+			t.Errorf("expected ignore_paths to be stripped from %v", e)
+		}
+	}
+
+	// Per-value patterns are relative to the value's directory.
+	res, err = Expand(context.Background(), c, Options{ChangedFiles: []string{"deploy/frontend/docs/a.txt"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(res.ChangedValues, []string{"frontend"}) || res.IgnoredFiles != nil {
+		t.Errorf("expected frontend docs to count, got %v (ignored %v)", res.ChangedValues, res.IgnoredFiles)
+	}
+
+	if _, err := Expand(context.Background(), c, Options{IgnorePaths: []string{"[docs"}}); err == nil {
+		t.Error("expected error for malformed pattern")
+	}
+}
+
+func TestExpand_Uses(t *testing.T) {
+	c := loadTestConfig(t)
+
+	res, err := Expand(context.Background(), c, Options{ChangedFiles: []string{"libs/auth/token.go", "deploy/frontend/app.ts"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(res.ChangedValues, []string{"api", "frontend"}) {
+		t.Errorf("expected api to change through libs/auth, got %v", res.ChangedValues)
+	}
+	want := map[string]ChangeReason{
+		"api":      {File: "libs/auth/token.go", Via: []string{"libs/auth"}},
+		"frontend": {File: "deploy/frontend/app.ts"},
+	}
+	if !reflect.DeepEqual(res.ChangeReasons, want) {
+		t.Errorf("expected reasons %v, got %v", want, res.ChangeReasons)
+	}
+	for _, e := range res.Entries {
+		if _, ok := e["uses"]; ok {
+			t.Errorf("expected uses to be stripped from %v", e)
+		}
+	}
+}
+
+func TestExpand_ServiceFallbackWarning(t *testing.T) {
+	c := loadTestConfig(t)
+	res, err := Expand(context.Background(), c, Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(res.Warnings) != 1 || len(c.Warnings()) != 0 {
+		t.Errorf("expected one warning about the implicit service dimension, got %v, %v", res.Warnings, c.Warnings())
+	}
+
+	// Not when the dimension input selects the dimension.
+	for _, dim := range []string{"service", "environment"} {
+		res, err = Expand(context.Background(), c, Options{Dimension: dim})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(res.Warnings) != 0 {
+			t.Errorf("%s: expected no warnings, got %v", dim, res.Warnings)
+		}
+	}
+}
+
+func TestExpand_DoesNotModifyConfig(t *testing.T) {
+	c := loadTestConfig(t)
+	// A target naming another dimension switches to it and drops service.
+	res, err := Expand(context.Background(), c, Options{Target: []string{"environment"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Dimension != "environment" || !reflect.DeepEqual(res.Dimensions, []string{"environment"}) {
+		t.Errorf("unexpected dimension switch: %q %v", res.Dimension, res.Dimensions)
+	}
+	if !reflect.DeepEqual(c.Dimensions(), []string{"environment", "service"}) {
+		t.Errorf("expected config to be unchanged, got %v", c.Dimensions())
+	}
+}
+
+func TestExplain(t *testing.T) {
+	c := loadTestConfig(t)
+	explained, err := Explain(context.Background(), c, Options{
+		Target:      []string{"api"},
+		Environment: []string{"dev"},
+		Include:     []Entry{{"service": "extra"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	bySvc := make(map[string]Explanation, len(explained.Entries))
+	for _, e := range explained.Entries {
+		bySvc[e.Entry["service"].(string)] = e
+	}
+	if len(bySvc) != 2 {
+		t.Fatalf("expected 2 explanations, got %v", explained.Entries)
+	}
+
+	want := map[string]string{
+		"aws_account_id": "environment.dev",
+		"aws_region":     "service.api",
+		"directory":      "directory",
+		"environment":    "dimension",
+		"service":        "dimension",
+	}
+	if !reflect.DeepEqual(bySvc["api"].Sources, want) {
+		t.Errorf("unexpected sources %v", bySvc["api"].Sources)
+	}
+	if bySvc["extra"].Sources["service"] != "include" {
+		t.Errorf("expected include source, got %v", bySvc["extra"].Sources)
+	}
+}
+
+func TestExpand_DisabledValues(t *testing.T) {
+	f, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, _ = f.WriteString(`settings:
+  dimension: service
+service:
+  api:
+  legacy:
+    enabled: false
+    disabled_reason: replaced by api
+`)
+	f.Close()
+	c, err := Load(context.Background(), f.Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	explained, err := Explain(context.Background(), c, Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []DisabledValue{{Dimension: "service", Value: "legacy", Reason: "replaced by api"}}
+	if len(explained.Entries) != 1 || !reflect.DeepEqual(explained.Disabled, want) {
+		t.Errorf("expected one entry and the disabled value, got %v", explained)
+	}
+
+	res, err := Expand(context.Background(), c, Options{Target: []string{"api", "legacy"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(res.Entries) != 1 || len(res.Warnings) != 1 || !strings.Contains(res.Warnings[0], "legacy (replaced by api), which is disabled") {
+		t.Errorf("expected the api entry and a warning, got %v, %v", res.Entries, res.Warnings)
+	}
+
+	if _, err := Expand(context.Background(), c, Options{Target: []string{"legacy"}}); !errors.Is(err, ErrInvalidTarget) {
+		t.Errorf("expected ErrInvalidTarget for a disabled target, got %v", err)
+	}
+}
+
+func TestExpand_Discover(t *testing.T) {
+	root := t.TempDir()
+	for _, f := range []string{"deploy/api/main.tf", "deploy/web/main.tf", "deploy/docs/README.md"} {
+		p := filepath.Join(root, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfgPath := filepath.Join(root, "config.yaml")
+	config := "service:\n  discover: deploy/*\n  marker: main.tf\n  api:\n    replicas: 2\n  legacy:\n"
+	if err := os.WriteFile(cfgPath, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(context.Background(), cfgPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := c.Values("service"); !reflect.DeepEqual(got, []string{"api", "legacy"}) {
+		t.Errorf("expected only explicit values before expansion, got %v", got)
+	}
+
+	res, err := Expand(context.Background(), c, Options{Root: root})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(res.Values, []string{"api", "legacy", "web"}) {
+		t.Errorf("unexpected values %v", res.Values)
+	}
+	if res.BaseDir != "deploy" || res.Entries[0]["directory"] != "deploy/api" || res.Entries[0]["replicas"] == nil {
+		t.Errorf("unexpected result %+v", res)
+	}
+
+	problems, err := Lint(context.Background(), c, Options{Root: root})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(problems) != 1 || problems[0].Path != "service.legacy" {
+		t.Errorf("expected service.legacy to be reported, got %v", problems)
+	}
+}
+
+func TestLint_ProfileDimension(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"deploy/api"} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.FromSlash(dir)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfgPath := filepath.Join(root, "config.yaml")
+	config := "settings:\n  dimension: service\n  base_dir: deploy\nprofiles:\n  infra:\n    target: \"terraform:*\"\nservice: [api]\nterraform: [infra, legacy]\n"
+	if err := os.WriteFile(cfgPath, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(context.Background(), cfgPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	problems, err := Lint(context.Background(), c, Options{Root: root})
+	if err != nil || len(problems) != 0 {
+		t.Errorf("expected no problems for service, got %v, %v", problems, err)
+	}
+	problems, err = Lint(context.Background(), c, Options{Root: root, Profile: "infra"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(problems) != 2 || problems[0].Path != "terraform.infra" || problems[1].Path != "terraform.legacy" {
+		t.Errorf("expected the terraform values to be checked under deploy, got %v", problems)
+	}
+}
+
+func TestExpand_Rules(t *testing.T) {
+	f, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, _ = f.WriteString(`rules:
+  - name: no-prod-from-pr
+    when: event.name == "pull_request"
+    assert: environment != "prod"
+environment: [dev, prod]
+service: [api]
+`)
+	f.Close()
+	c, err := Load(context.Background(), f.Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	res, err := Expand(context.Background(), c, Options{Event: map[string]any{"name": "push"}})
+	if err != nil || len(res.Violations) != 0 {
+		t.Fatalf("expected no violations, got %v, %v", res, err)
+	}
+	res, err = Expand(context.Background(), c, Options{Event: map[string]any{"name": "pull_request"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(res.Violations) != 1 || res.Violations[0].Entry != "environment=prod, service=api" || res.Violations[0].Severity != SeverityError {
+		t.Errorf("unexpected violations %v", res.Violations)
+	}
+}
+
+func TestExpand_RulesSeeFullEntries(t *testing.T) {
+	f, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, _ = f.WriteString(`rules:
+  - name: prod-approval
+    when: environment == "prod"
+    assert: approval_required == true
+  - name: small
+    assert: length <= 1
+    scope: matrix
+settings:
+  dimension: service
+  base_dir: deploy
+environment:
+  dev: {}
+  prod:
+    approval_required: true
+service: [api]
+`)
+	f.Close()
+	c, err := Load(context.Background(), f.Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, opts := range []Options{
+		{Fields: []string{"directory"}},
+		{Omit: []string{"approval_required", "environment"}},
+		{Collapse: []string{"environment"}, CollapsePolicy: CollapseFirst},
+	} {
+		res, err := Expand(context.Background(), c, opts)
+		if err != nil {
+			t.Fatalf("%+v: unexpected error: %v", opts, err)
+		}
+		// Only the collapsed matrix is small enough.
+		want := 1
+		if len(opts.Collapse) > 0 {
+			want = 0
+		}
+		if len(res.Violations) != want || want == 1 && res.Violations[0].Rule != "small" {
+			t.Errorf("%+v: unexpected violations %v", opts, res.Violations)
+		}
+	}
+}
+
+func TestExpand_TargetPatterns(t *testing.T) {
+	f, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, _ = f.WriteString(`groups:
+  backend: [api-*, worker]
+service: [api-public, api-internal, worker, legacy]
+terraform: [infra, dns]
+`)
+	f.Close()
+	c, err := Load(context.Background(), f.Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	res, err := Expand(context.Background(), c, Options{Target: []string{"@backend", "!api-internal"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(res.Target, []string{"api-public", "worker"}) || len(res.Entries) != 4 {
+		t.Errorf("unexpected result %v, %v", res.Target, res.Entries)
+	}
+
+	res, err = Expand(context.Background(), c, Options{Target: []string{"!api-*", "!worker", "!legacy"}})
+	if err != nil || len(res.Entries) != 0 {
+		t.Errorf("expected an empty matrix, got %v, %v", res, err)
+	}
+
+	res, err = Expand(context.Background(), c, Options{Target: []string{"terraform:*"}})
+	if err != nil || res.Dimension != "terraform" || len(res.Entries) != 2 || len(res.Warnings) != 0 {
+		t.Errorf("expected all terraform entries, got %v, %v", res, err)
+	}
+
+	if _, err := Expand(context.Background(), c, Options{Target: []string{"wroker"}}); !errors.Is(err, ErrInvalidTarget) {
+		t.Errorf("expected ErrInvalidTarget, got %v", err)
+	}
+}
+
+func TestExpand_Collapse(t *testing.T) {
+	f, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, _ = f.WriteString(`profiles:
+  build:
+    collapse: environment
+    collapse_policy: first
+service: [api, worker]
+environment:
+  dev: { account: "111" }
+  prod: { account: "222" }
+`)
+	f.Close()
+	c, err := Load(context.Background(), f.Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	res, err := Expand(context.Background(), c, Options{Profile: "build"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(res.Entries) != 2 || !reflect.DeepEqual(res.Dimensions, []string{"service"}) || !reflect.DeepEqual(res.Collapsed, []string{"environment"}) {
+		t.Errorf("unexpected result %v", res)
+	}
+
+	if _, err := Expand(context.Background(), c, Options{Collapse: []string{"environment"}, CollapsePolicy: CollapseError}); !errors.Is(err, ErrInvalidCollapse) {
+		t.Errorf("expected ErrInvalidCollapse, got %v", err)
+	}
+}